@@ -1,33 +1,96 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/config"
+	"github.com/wafi11/microservices/api-gateway/internal/client"
+	"github.com/wafi11/microservices/api-gateway/internal/handler"
+	"github.com/wafi11/microservices/api-gateway/pkg"
 	"github.com/wafi11/microservices/api-gateway/server"
+	"github.com/wafi11/microservices/users-services/proto"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+
 	r := gin.New()
+	// Without this gin believes X-Forwarded-For from anyone, letting clients
+	// pick the IP used for login throttling, sessions and the audit log.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
 	r.Use(gin.Recovery())
+	r.Use(pkg.RequestID())
 
 	r.Use(cors.New(cors.Config{
 		AllowAllOrigins:     false,
-		AllowOrigins:        []string{"http://localhost:3000"},
+		AllowOrigins:        cfg.CORSAllowedOrigins,
 		AllowMethods:        []string{"POST", "GET", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowPrivateNetwork: false,
-		AllowHeaders:        []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		AllowHeaders:        []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Device-Label", "X-Request-ID"},
+		ExposeHeaders:       []string{"X-Request-ID"},
 		AllowCredentials:    true,
 		MaxAge:              0,
 	}))
 
-	server.Routes(r)
+	userClient, err := client.NewUserClient(cfg.UsersServiceAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	health := handler.NewHealthHandler(cfg.HealthCheckTimeout, handler.Upstream{
+		Name:    "users-service",
+		Service: proto.UserService_ServiceDesc.ServiceName,
+		Checker: userClient,
+	})
+	if err := server.Routes(r, cfg, userClient, health); err != nil {
+		log.Fatal(err)
+	}
+
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: cfg.HTTPAddr, Handler: r}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	log.Printf("HTTP running on %s", cfg.HTTPAddr)
 
-	log.Println("HTTP running on :5000")
-	if err := r.Run(":5000"); err != nil {
+	select {
+	case err := <-served:
 		log.Fatal(err)
+	case <-c.Done():
 	}
-	log.Println("HTTP running on :5000")
+	// A second signal kills the process instead of waiting for the drain.
+	stop()
+	log.Println("shutting down")
 
+	// Fail readiness first, then stop accepting connections and wait for
+	// in-flight requests, which may still need users-service.
+	health.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("in-flight requests did not finish within %s, closing them: %v", cfg.ShutdownTimeout, err)
+		srv.Close()
+	}
+
+	if err := userClient.Close(); err != nil {
+		log.Printf("could not close users-service connection: %v", err)
+	}
+	log.Println("shutdown complete")
 }
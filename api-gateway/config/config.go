@@ -0,0 +1,134 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	HTTPAddr           string
+	UsersServiceAddr   string
+	CORSAllowedOrigins []string
+	// TrustedProxies are the addresses or CIDR ranges whose
+	// X-Forwarded-For header is believed. Empty trusts none, so the client
+	// IP is always the address of the connection.
+	TrustedProxies     []string
+	Cookie             CookieConfig
+	JWKSCacheTTL       time.Duration
+	RevocationCacheTTL time.Duration
+	HealthCheckTimeout time.Duration
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// after SIGINT or SIGTERM before they are cut off.
+	ShutdownTimeout time.Duration
+	OAuth           OAuthConfig
+}
+
+// OAuthConfig configures login through external OAuth2/OIDC providers.
+type OAuthConfig struct {
+	// ProvidersFile is a JSON list of providers; empty disables external
+	// login.
+	ProvidersFile string
+	// PublicURL is where browsers reach the gateway, used to build the
+	// callback URL registered with each provider.
+	PublicURL string
+	// RedirectURL is the frontend page the browser lands on afterwards.
+	RedirectURL string
+}
+
+type CookieConfig struct {
+	Domain string
+	Secure bool
+}
+
+// Load reads the gateway configuration from flags, the environment and an
+// optional env file, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := &Config{}
+	var origins, proxies string
+	l := newLoader("api-gateway")
+
+	l.stringVar(&cfg.HTTPAddr, "http-addr", "HTTP_ADDR", ":5000", "address the HTTP server listens on")
+	l.stringVar(&cfg.UsersServiceAddr, "users-service-addr", "USERS_SERVICE_ADDR", "localhost:50051", "gRPC address of users-services")
+	l.stringVar(&origins, "cors-allowed-origins", "CORS_ALLOWED_ORIGINS", "http://localhost:3000", "comma separated list of origins allowed by CORS")
+	l.stringVar(&proxies, "trusted-proxies", "TRUSTED_PROXIES", "", "comma separated addresses or CIDR ranges of proxies allowed to set X-Forwarded-For")
+	l.stringVar(&cfg.Cookie.Domain, "cookie-domain", "COOKIE_DOMAIN", "localhost", "domain attribute of auth cookies")
+	l.boolVar(&cfg.Cookie.Secure, "cookie-secure", "COOKIE_SECURE", false, "only send auth cookies over HTTPS")
+	l.durationVar(&cfg.JWKSCacheTTL, "jwks-cache-ttl", "JWKS_CACHE_TTL", 5*time.Minute, "how long fetched signing keys are cached")
+	l.durationVar(&cfg.RevocationCacheTTL, "revocation-cache-ttl", "REVOCATION_CACHE_TTL", 30*time.Second, "how long a token is trusted before its revocation status is checked again")
+	l.durationVar(&cfg.HealthCheckTimeout, "health-check-timeout", "HEALTH_CHECK_TIMEOUT", 2*time.Second, "how long /healthz and /readyz wait for each upstream")
+	l.durationVar(&cfg.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", 15*time.Second, "how long in-flight requests may run after a shutdown signal")
+	l.stringVar(&cfg.OAuth.ProvidersFile, "oauth-providers-file", "OAUTH_PROVIDERS_FILE", "", "JSON file listing OAuth2/OIDC login providers")
+	l.stringVar(&cfg.OAuth.PublicURL, "oauth-public-url", "OAUTH_PUBLIC_URL", "http://localhost:5000", "public base URL of the gateway for OAuth callbacks")
+	l.stringVar(&cfg.OAuth.RedirectURL, "oauth-redirect-url", "OAUTH_REDIRECT_URL", "http://localhost:3000", "frontend URL to return to after an OAuth login")
+
+	if _, err := l.parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.CORSAllowedOrigins = append(cfg.CORSAllowedOrigins, origin)
+		}
+	}
+	for _, proxy := range strings.Split(proxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("HTTP_ADDR: %v", err))
+	}
+	if _, _, err := net.SplitHostPort(cfg.UsersServiceAddr); err != nil {
+		errs = append(errs, fmt.Errorf("USERS_SERVICE_ADDR: %v", err))
+	}
+	for _, origin := range cfg.CORSAllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("CORS_ALLOWED_ORIGINS: %q is not an origin like https://example.com", origin))
+		}
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", proxy))
+		}
+	}
+	if cfg.JWKSCacheTTL <= 0 {
+		errs = append(errs, errors.New("JWKS_CACHE_TTL: must be positive"))
+	}
+	if cfg.RevocationCacheTTL <= 0 {
+		errs = append(errs, errors.New("REVOCATION_CACHE_TTL: must be positive"))
+	}
+	if cfg.HealthCheckTimeout <= 0 {
+		errs = append(errs, errors.New("HEALTH_CHECK_TIMEOUT: must be positive"))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT: must be positive"))
+	}
+	if cfg.OAuth.ProvidersFile != "" {
+		for env, value := range map[string]string{"OAUTH_PUBLIC_URL": cfg.OAuth.PublicURL, "OAUTH_REDIRECT_URL": cfg.OAuth.RedirectURL} {
+			u, err := url.Parse(value)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: %q is not an absolute URL", env, value))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// loader registers each setting as a flag and remembers the environment
+// variable backing it. A flag given on the command line wins, then the
+// process environment, then the env file, then the flag default.
+type loader struct {
+	fs      *flag.FlagSet
+	envs    map[string]string
+	envFile string
+}
+
+func newLoader(name string) *loader {
+	l := &loader{fs: flag.NewFlagSet(name, flag.ContinueOnError), envs: make(map[string]string)}
+	l.fs.StringVar(&l.envFile, "env-file", "", "path to an env file, defaults to .env.$APP_ENV ($ENV_FILE)")
+	return l
+}
+
+func (l *loader) stringVar(p *string, name, env, value, usage string) {
+	l.fs.StringVar(p, name, value, usage+" ($"+env+")")
+	l.envs[name] = env
+}
+
+func (l *loader) boolVar(p *bool, name, env string, value bool, usage string) {
+	l.fs.BoolVar(p, name, value, usage+" ($"+env+")")
+	l.envs[name] = env
+}
+
+func (l *loader) durationVar(p *time.Duration, name, env string, value time.Duration, usage string) {
+	l.fs.DurationVar(p, name, value, usage+" ($"+env+")")
+	l.envs[name] = env
+}
+
+// parse resolves every registered setting and returns the remaining
+// positional arguments.
+func (l *loader) parse(args []string) ([]string, error) {
+	if err := l.fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := make(map[string]bool)
+	l.fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	envFile, err := envFilePath(l.envFile)
+	if err != nil {
+		return nil, err
+	}
+	fileValues, err := readEnvFile(envFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		env, ok := l.envs[f.Name]
+		if !ok || explicit[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			value, ok = fileValues[env]
+		}
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", value, env, err))
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return l.fs.Args(), nil
+}
+
+// readEnvFile parses KEY=VALUE lines. Blank lines, comments and an optional
+// "export " prefix are ignored, and matching quotes around values are
+// stripped.
+func readEnvFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if path == "" {
+		return values, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open env file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read env file: %v", err)
+	}
+	return values, nil
+}
+
+// envFilePath picks the env file to read: -env-file, then $ENV_FILE, then
+// .env.<APP_ENV> if it exists. Only an explicitly requested file has to
+// exist.
+func envFilePath(flagValue string) (string, error) {
+	path, explicit := flagValue, flagValue != ""
+	if !explicit {
+		path, explicit = os.LookupEnv("ENV_FILE")
+	}
+	if explicit {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("env file %q: %w", path, err)
+		}
+		return path, nil
+	}
+
+	appEnv := os.Getenv("APP_ENV")
+	if appEnv == "" {
+		appEnv = "development"
+	}
+	path = ".env." + appEnv
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return path, nil
+}
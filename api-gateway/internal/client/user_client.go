@@ -4,26 +4,55 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/pkg"
 	"github.com/wafi11/microservices/users-services/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type UserClient struct {
+	conn   *grpc.ClientConn
 	client proto.UserServiceClient
+	health healthpb.HealthClient
 }
 
 func NewUserClient(addr string) (*UserClient, error) {
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(forwardClientInfo),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to grpcs server: %v", err)
 	}
 
 	return &UserClient{
+		conn:   conn,
 		client: proto.NewUserServiceClient(conn),
+		health: healthpb.NewHealthClient(conn),
 	}, nil
 }
 
+// Close closes the connection to users-service; calls made afterwards fail.
+func (u *UserClient) Close() error {
+	return u.conn.Close()
+}
+
+// forwardClientInfo attaches the client details of the HTTP request to
+// every call made with a gin context, so handlers do not have to.
+func forwardClientInfo(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = pkg.WithClientInfo(c)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// CheckHealth asks users-service for its grpc.health.v1 status.
+func (u *UserClient) CheckHealth(c context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return u.health.Check(c, req)
+}
+
 func (u *UserClient) RegisterUser(ctx context.Context, req *proto.RegisterRequest) (*proto.UserResponse, error) {
 	return u.client.RegisterUser(ctx, req)
 }
@@ -31,6 +60,130 @@ func (u *UserClient) RegisterUser(ctx context.Context, req *proto.RegisterReques
 func (u *UserClient) LoginUser(c context.Context, req *proto.LoginRequest) (*proto.LoginResponse, error) {
 	return u.client.LoginUser(c, req)
 }
+func (u *UserClient) VerifyMFA(c context.Context, req *proto.VerifyMFARequest) (*proto.LoginResponse, error) {
+	return u.client.VerifyMFA(c, req)
+}
+
+func (u *UserClient) EnrollTOTP(c context.Context, req *proto.EnrollTOTPRequest) (*proto.EnrollTOTPResponse, error) {
+	return u.client.EnrollTOTP(c, req)
+}
+
+func (u *UserClient) ConfirmTOTP(c context.Context, req *proto.ConfirmTOTPRequest) (*proto.ConfirmTOTPResponse, error) {
+	return u.client.ConfirmTOTP(c, req)
+}
+
+func (u *UserClient) DisableTOTP(c context.Context, req *proto.DisableTOTPRequest) (*proto.DisableTOTPResponse, error) {
+	return u.client.DisableTOTP(c, req)
+}
+
 func (u *UserClient) FindMe(c context.Context, req *proto.FindMeRequest) (*proto.FindMeResponse, error) {
 	return u.client.FindMe(c, req)
 }
+
+func (u *UserClient) RefreshToken(c context.Context, req *proto.RefreshTokenRequest) (*proto.LoginResponse, error) {
+	return u.client.RefreshToken(c, req)
+}
+
+func (u *UserClient) Logout(c context.Context, req *proto.LogoutRequest) (*proto.LogoutResponse, error) {
+	return u.client.Logout(c, req)
+}
+
+func (u *UserClient) IsTokenRevoked(c context.Context, req *proto.IsTokenRevokedRequest) (*proto.IsTokenRevokedResponse, error) {
+	return u.client.IsTokenRevoked(c, req)
+}
+
+func (u *UserClient) GetJWKS(c context.Context, req *proto.GetJWKSRequest) (*proto.GetJWKSResponse, error) {
+	return u.client.GetJWKS(c, req)
+}
+
+func (u *UserClient) UpdateProfile(c context.Context, req *proto.UpdateProfileRequest) (*proto.FindMeResponse, error) {
+	return u.client.UpdateProfile(c, req)
+}
+
+func (u *UserClient) ChangePassword(c context.Context, req *proto.ChangePasswordRequest) (*proto.LoginResponse, error) {
+	return u.client.ChangePassword(c, req)
+}
+
+func (u *UserClient) CheckUsernameAvailability(c context.Context, req *proto.CheckUsernameAvailabilityRequest) (*proto.CheckUsernameAvailabilityResponse, error) {
+	return u.client.CheckUsernameAvailability(c, req)
+}
+
+func (u *UserClient) ChangeUsername(c context.Context, req *proto.ChangeUsernameRequest) (*proto.FindMeResponse, error) {
+	return u.client.ChangeUsername(c, req)
+}
+
+func (u *UserClient) DeleteAccount(c context.Context, req *proto.DeleteAccountRequest) (*proto.DeleteAccountResponse, error) {
+	return u.client.DeleteAccount(c, req)
+}
+
+func (u *UserClient) ListUsers(c context.Context, req *proto.ListUsersRequest) (*proto.ListUsersResponse, error) {
+	return u.client.ListUsers(c, req)
+}
+
+func (u *UserClient) RestoreUser(c context.Context, req *proto.RestoreUserRequest) (*proto.FindMeResponse, error) {
+	return u.client.RestoreUser(c, req)
+}
+
+func (u *UserClient) UnlockUser(c context.Context, req *proto.UnlockUserRequest) (*proto.UnlockUserResponse, error) {
+	return u.client.UnlockUser(c, req)
+}
+
+func (u *UserClient) ListRoles(c context.Context, req *proto.ListRolesRequest) (*proto.ListRolesResponse, error) {
+	return u.client.ListRoles(c, req)
+}
+
+func (u *UserClient) AssignRole(c context.Context, req *proto.AssignRoleRequest) (*proto.ListRolesResponse, error) {
+	return u.client.AssignRole(c, req)
+}
+
+func (u *UserClient) RevokeRole(c context.Context, req *proto.RevokeRoleRequest) (*proto.ListRolesResponse, error) {
+	return u.client.RevokeRole(c, req)
+}
+
+func (u *UserClient) RequestPasswordReset(c context.Context, req *proto.RequestPasswordResetRequest) (*proto.RequestPasswordResetResponse, error) {
+	return u.client.RequestPasswordReset(c, req)
+}
+
+func (u *UserClient) ResetPassword(c context.Context, req *proto.ResetPasswordRequest) (*proto.ResetPasswordResponse, error) {
+	return u.client.ResetPassword(c, req)
+}
+
+func (u *UserClient) VerifyEmail(c context.Context, req *proto.VerifyEmailRequest) (*proto.VerifyEmailResponse, error) {
+	return u.client.VerifyEmail(c, req)
+}
+
+func (u *UserClient) ResendVerification(c context.Context, req *proto.ResendVerificationRequest) (*proto.ResendVerificationResponse, error) {
+	return u.client.ResendVerification(c, req)
+}
+
+func (u *UserClient) LoginWithExternalIdentity(c context.Context, req *proto.LoginWithExternalIdentityRequest) (*proto.LoginResponse, error) {
+	return u.client.LoginWithExternalIdentity(c, req)
+}
+
+func (u *UserClient) LinkIdentity(c context.Context, req *proto.LinkIdentityRequest) (*proto.LinkIdentityResponse, error) {
+	return u.client.LinkIdentity(c, req)
+}
+
+func (u *UserClient) UnlinkIdentity(c context.Context, req *proto.UnlinkIdentityRequest) (*proto.UnlinkIdentityResponse, error) {
+	return u.client.UnlinkIdentity(c, req)
+}
+
+func (u *UserClient) ListIdentities(c context.Context, req *proto.ListIdentitiesRequest) (*proto.ListIdentitiesResponse, error) {
+	return u.client.ListIdentities(c, req)
+}
+
+func (u *UserClient) ListSessions(c context.Context, req *proto.ListSessionsRequest) (*proto.ListSessionsResponse, error) {
+	return u.client.ListSessions(c, req)
+}
+
+func (u *UserClient) RevokeSession(c context.Context, req *proto.RevokeSessionRequest) (*proto.RevokeSessionResponse, error) {
+	return u.client.RevokeSession(c, req)
+}
+
+func (u *UserClient) RevokeAllOtherSessions(c context.Context, req *proto.RevokeAllOtherSessionsRequest) (*proto.RevokeAllOtherSessionsResponse, error) {
+	return u.client.RevokeAllOtherSessions(c, req)
+}
+
+func (u *UserClient) ListAuditEvents(c context.Context, req *proto.ListAuditEventsRequest) (*proto.ListAuditEventsResponse, error) {
+	return u.client.ListAuditEvents(c, req)
+}
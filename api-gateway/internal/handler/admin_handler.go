@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/internal/client"
+	"github.com/wafi11/microservices/api-gateway/pkg"
+	"github.com/wafi11/microservices/users-services/proto"
+)
+
+type AdminHandler struct {
+	userClient *client.UserClient
+}
+
+func NewAdminHandler(userClient *client.UserClient) *AdminHandler {
+	return &AdminHandler{userClient: userClient}
+}
+
+// ListUsers pages through accounts. Every filter is an optional query
+// parameter; pass next_page_token back as page_token to get the next page.
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	req := proto.ListUsersRequest{
+		CreatedAfter:   c.Query("created_after"),
+		CreatedBefore:  c.Query("created_before"),
+		EmailPrefix:    c.Query("email_prefix"),
+		UsernamePrefix: c.Query("username_prefix"),
+		SortBy:         c.Query("sort_by"),
+		PageToken:      c.Query("page_token"),
+	}
+
+	for name, field := range map[string]**bool{"active": &req.Active, "deleted": &req.Deleted} {
+		raw, ok := c.GetQuery(name)
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", name+" must be true or false"))
+			return
+		}
+		*field = &value
+	}
+
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+	case "desc":
+		req.Descending = true
+	default:
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", "order must be asc or desc"))
+		return
+	}
+
+	if raw := c.Query("page_size"); raw != "" {
+		size, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", "page_size must be a number"))
+			return
+		}
+		req.PageSize = int32(size)
+	}
+
+	resp, err := h.userClient.ListUsers(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list users", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Users retrieved successfully", resp))
+}
+
+// ListAuditEvents pages through the security audit log, newest first.
+// user_id matches events the user did or that concern them, target_id only
+// the latter.
+func (h *AdminHandler) ListAuditEvents(c *gin.Context) {
+	req := proto.ListAuditEventsRequest{
+		EventType: c.Query("event_type"),
+		Outcome:   c.Query("outcome"),
+		Since:     c.Query("since"),
+		Until:     c.Query("until"),
+		PageToken: c.Query("page_token"),
+	}
+
+	for name, field := range map[string]*int32{"user_id": &req.UserId, "target_id": &req.TargetId, "page_size": &req.PageSize} {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", name+" must be a number"))
+			return
+		}
+		*field = int32(value)
+	}
+
+	resp, err := h.userClient.ListAuditEvents(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list audit events", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Audit events retrieved successfully", resp))
+}
+
+// userIDParam parses the :id path parameter, answering 400 when it is not a
+// user id.
+func userIDParam(c *gin.Context) (int32, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid path parameter", "id must be a user id"))
+		return 0, false
+	}
+	return int32(id), true
+}
+
+func (h *AdminHandler) RestoreUser(c *gin.Context) {
+	userId, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.RestoreUser(c, &proto.RestoreUserRequest{UserId: userId})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to restore user", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("User restored successfully", resp))
+}
+
+func (h *AdminHandler) UnlockUser(c *gin.Context) {
+	userId, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.userClient.UnlockUser(c, &proto.UnlockUserRequest{UserId: userId}); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to unlock user", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("User unlocked successfully", nil))
+}
+
+func (h *AdminHandler) ListRoles(c *gin.Context) {
+	resp, err := h.userClient.ListRoles(c, &proto.ListRolesRequest{})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list roles", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Roles retrieved successfully", resp))
+}
+
+func (h *AdminHandler) UserRoles(c *gin.Context) {
+	userId, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.ListRoles(c, &proto.ListRolesRequest{UserId: userId})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list roles", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Roles retrieved successfully", resp))
+}
+
+func (h *AdminHandler) AssignRole(c *gin.Context) {
+	userId, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req proto.AssignRoleRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	resp, err := h.userClient.AssignRole(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to assign role", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Role assigned successfully", resp))
+}
+
+func (h *AdminHandler) RevokeRole(c *gin.Context) {
+	userId, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.RevokeRole(c, &proto.RevokeRoleRequest{UserId: userId, Role: c.Param("role")})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to revoke role", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Role revoked successfully", resp))
+}
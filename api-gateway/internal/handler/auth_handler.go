@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/internal/client"
+	"github.com/wafi11/microservices/api-gateway/internal/oauth"
+	"github.com/wafi11/microservices/api-gateway/pkg"
+	"github.com/wafi11/microservices/users-services/proto"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStatePath   = "/api/auth"
+	oauthStateMaxAge = 10 * time.Minute
+)
+
+// oauthState is kept in an HttpOnly cookie between /start and /callback.
+// UserId is only set when linking and is checked against the access token
+// presented on the callback, never trusted on its own.
+type oauthState struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	UserId   string `json:"user_id,omitempty"`
+}
+
+// AuthHandler runs the OAuth2/OIDC authorization code flow against the
+// configured providers and hands the result to users-service.
+type AuthHandler struct {
+	userClient  *client.UserClient
+	providers   *oauth.Providers
+	keys        *pkg.JWKSCache
+	revocations *pkg.RevocationCache
+	cookies     pkg.Cookies
+	redirectURL string
+}
+
+func NewAuthHandler(userClient *client.UserClient, providers *oauth.Providers, keys *pkg.JWKSCache, revocations *pkg.RevocationCache, cookies pkg.Cookies, redirectURL string) *AuthHandler {
+	return &AuthHandler{
+		userClient:  userClient,
+		providers:   providers,
+		keys:        keys,
+		revocations: revocations,
+		cookies:     cookies,
+		redirectURL: redirectURL,
+	}
+}
+
+// Start redirects the browser to the provider. With ?link=1 the caller must
+// be logged in and the identity is linked to their account instead of
+// being used to log in.
+func (h *AuthHandler) Start(c *gin.Context) {
+	provider, err := h.providers.Get(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, pkg.ErrorResponse("Unknown provider", err.Error()))
+		return
+	}
+
+	st := oauthState{Provider: provider.Name(), Verifier: oauth2.GenerateVerifier()}
+	if st.State, err = randomState(); err != nil {
+		c.JSON(http.StatusInternalServerError, pkg.ErrorResponse("Failed to start login", err.Error()))
+		return
+	}
+	if c.Query("link") == "1" {
+		userId, err := h.authenticatedUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, pkg.ErrorResponse("Login required to link an account", err.Error()))
+			return
+		}
+		st.UserId = userId
+	}
+
+	authURL, err := provider.AuthCodeURL(c, st.State, st.Verifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, pkg.ErrorResponse("Provider unavailable", err.Error()))
+		return
+	}
+
+	raw, err := json.Marshal(st)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, pkg.ErrorResponse("Failed to start login", err.Error()))
+		return
+	}
+	c.SetCookie(oauthStateCookie, base64.RawURLEncoding.EncodeToString(raw), int(oauthStateMaxAge.Seconds()), oauthStatePath, h.cookies.Domain, h.cookies.Secure, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Callback finishes the flow and redirects to the frontend. Failures are
+// reported with an oauth_error query parameter; a login that still needs a
+// second factor passes mfa_token in the URL fragment.
+func (h *AuthHandler) Callback(c *gin.Context) {
+	st, err := h.takeState(c)
+	if err != nil {
+		h.redirect(c, url.Values{"oauth_error": {"invalid_state"}}, nil)
+		return
+	}
+	if providerErr := c.Query("error"); providerErr != "" {
+		h.redirect(c, url.Values{"oauth_error": {providerErr}}, nil)
+		return
+	}
+
+	provider, err := h.providers.Get(c.Param("provider"))
+	if err != nil || provider.Name() != st.Provider ||
+		subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(st.State)) != 1 {
+		h.redirect(c, url.Values{"oauth_error": {"invalid_state"}}, nil)
+		return
+	}
+
+	identity, err := provider.Exchange(c, c.Query("code"), st.Verifier)
+	if err != nil {
+		log.Printf("oauth %s: %v", provider.Name(), err)
+		h.redirect(c, url.Values{"oauth_error": {"exchange_failed"}}, nil)
+		return
+	}
+
+	if st.UserId != "" {
+		h.link(c, st, identity)
+		return
+	}
+
+	token, err := h.userClient.LoginWithExternalIdentity(c, &proto.LoginWithExternalIdentityRequest{
+		Provider:      provider.Name(),
+		Subject:       identity.Subject,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+		FullName:      identity.Name,
+	})
+	if err != nil {
+		h.redirect(c, url.Values{"oauth_error": {errorCode(err)}}, nil)
+		return
+	}
+	if token.MfaRequired {
+		h.redirect(c, nil, url.Values{"mfa_token": {token.MfaToken}})
+		return
+	}
+
+	h.cookies.SetTokenToCookie(c, "access_token", token.Token)
+	h.cookies.SetRefreshTokenCookie(c, token.RefreshToken, time.Unix(token.RefreshTokenExpiresAt, 0))
+	h.redirect(c, nil, nil)
+}
+
+func (h *AuthHandler) link(c *gin.Context, st *oauthState, identity *oauth.Identity) {
+	userId, err := h.authenticatedUser(c)
+	if err != nil || userId != st.UserId {
+		h.redirect(c, url.Values{"oauth_error": {"login_required"}}, nil)
+		return
+	}
+	id, err := strconv.ParseInt(userId, 10, 32)
+	if err != nil {
+		h.redirect(c, url.Values{"oauth_error": {"login_required"}}, nil)
+		return
+	}
+
+	_, err = h.userClient.LinkIdentity(c, &proto.LinkIdentityRequest{
+		UserId:   int32(id),
+		Provider: st.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		h.redirect(c, url.Values{"oauth_error": {errorCode(err)}}, nil)
+		return
+	}
+	h.redirect(c, url.Values{"linked": {st.Provider}}, nil)
+}
+
+// authenticatedUser verifies the access token sent with the request the
+// same way AuthMiddleware does.
+func (h *AuthHandler) authenticatedUser(c *gin.Context) (string, error) {
+	claims, err := pkg.VerifyToken(c, h.keys, pkg.TokenFromRequest(c))
+	if err != nil {
+		return "", err
+	}
+	revoked, err := h.revocations.IsRevoked(c, claims)
+	if err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", errors.New("token has been revoked")
+	}
+	return claims.UserId, nil
+}
+
+// takeState reads and clears the state cookie, so a callback URL cannot be
+// replayed.
+func (h *AuthHandler) takeState(c *gin.Context) (*oauthState, error) {
+	value, err := c.Cookie(oauthStateCookie)
+	c.SetCookie(oauthStateCookie, "", -1, oauthStatePath, h.cookies.Domain, h.cookies.Secure, true)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var st oauthState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, err
+	}
+	if st.State == "" || st.Verifier == "" {
+		return nil, errors.New("incomplete oauth state")
+	}
+	return &st, nil
+}
+
+func (h *AuthHandler) redirect(c *gin.Context, query, fragment url.Values) {
+	target, err := url.Parse(h.redirectURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, pkg.ErrorResponse("Invalid redirect URL", err.Error()))
+		return
+	}
+	if query != nil {
+		values := target.Query()
+		for key, value := range query {
+			values[key] = value
+		}
+		target.RawQuery = values.Encode()
+	}
+	if fragment != nil {
+		target.Fragment = fragment.Encode()
+	}
+	c.Redirect(http.StatusFound, target.String())
+}
+
+// errorCode turns a users-service error into a value for oauth_error, using
+// the ErrorInfo reason when there is one.
+func errorCode(err error) string {
+	if reason := pkg.ErrorReason(err); reason != "" {
+		return strings.ToLower(reason)
+	}
+	return strings.ToLower(status.Code(err).String())
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
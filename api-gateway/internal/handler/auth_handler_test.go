@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/internal/client"
+	"github.com/wafi11/microservices/api-gateway/internal/oauth"
+	"github.com/wafi11/microservices/api-gateway/internal/oauth/oauthtest"
+	"github.com/wafi11/microservices/api-gateway/pkg"
+	"github.com/wafi11/microservices/users-services/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const frontendURL = "http://app.test/login"
+
+// externalLogins stands in for users-service: it logs in every identity
+// with a verified email and refuses the others the way the service does.
+type externalLogins struct {
+	proto.UnimplementedUserServiceServer
+
+	mu       sync.Mutex
+	requests []*proto.LoginWithExternalIdentityRequest
+}
+
+func (s *externalLogins) LoginWithExternalIdentity(c context.Context, req *proto.LoginWithExternalIdentityRequest) (*proto.LoginResponse, error) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	if !req.GetEmailVerified() {
+		st, err := status.New(codes.FailedPrecondition, "the provider did not return a verified email").
+			WithDetails(&errdetails.ErrorInfo{Reason: "EXTERNAL_EMAIL_NOT_VERIFIED", Domain: "users-services"})
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	return &proto.LoginResponse{
+		Token:                 "access-token",
+		RefreshToken:          "refresh-token",
+		RefreshTokenExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, nil
+}
+
+func (s *externalLogins) calls() []*proto.LoginWithExternalIdentityRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// newOAuthRouter serves the OAuth routes with a provider named "mock" at
+// issuer, backed by a users-service stub listening on localhost.
+func newOAuthRouter(t *testing.T, issuer *oauthtest.Issuer) (*gin.Engine, *externalLogins) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &externalLogins{}
+	server := grpc.NewServer()
+	proto.RegisterUserServiceServer(server, users)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	userClient, err := client.NewUserClient(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { userClient.Close() })
+
+	path := filepath.Join(t.TempDir(), "providers.json")
+	config := `[{"name": "mock", "kind": "oidc", "issuer": "` + issuer.URL + `", "client_id": "gateway", "client_secret": "secret"}]`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := oauth.LoadProviders(path, "http://gateway.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewAuthHandler(userClient, providers, nil, nil, pkg.Cookies{}, frontendURL)
+	r := gin.New()
+	r.GET("/api/auth/:provider/start", h.Start)
+	r.GET("/api/auth/:provider/callback", h.Callback)
+	return r, users
+}
+
+// serve runs one request through r with the given cookies.
+func serve(r http.Handler, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// approve follows the provider redirect of a /start response the way the
+// browser would and returns the callback URL the issuer sends it back to.
+func approve(t *testing.T, start *httptest.ResponseRecorder) *url.URL {
+	t.Helper()
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatalf("issuer answered %s without redirecting", resp.Status)
+	}
+	return callback
+}
+
+func TestOAuthStart(t *testing.T) {
+	tests := []struct {
+		name       string
+		provider   string
+		mismatch   bool
+		wantStatus int
+	}{
+		{"redirects to the provider", "mock", false, http.StatusFound},
+		{"unknown provider", "other", false, http.StatusNotFound},
+		{"issuer mismatch", "mock", true, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oauthtest.NewIssuer()
+			defer issuer.Close()
+			if tt.mismatch {
+				issuer.SetDiscoveredIssuer("https://accounts.example.com")
+			}
+			r, _ := newOAuthRouter(t, issuer)
+
+			w := serve(r, "/api/auth/"+tt.provider+"/start")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			stateCookie := responseCookie(w, oauthStateCookie)
+			if tt.wantStatus != http.StatusFound {
+				if stateCookie != nil {
+					t.Error("state cookie set although the login did not start")
+				}
+				return
+			}
+
+			if !strings.HasPrefix(w.Header().Get("Location"), issuer.URL+"/authorize?") {
+				t.Errorf("Location = %s, want the authorization endpoint", w.Header().Get("Location"))
+			}
+			if stateCookie == nil || !stateCookie.HttpOnly || stateCookie.Path != oauthStatePath {
+				t.Fatalf("state cookie = %+v, want an HttpOnly cookie on %s", stateCookie, oauthStatePath)
+			}
+		})
+	}
+}
+
+func TestOAuthStartLinkRequiresLogin(t *testing.T) {
+	issuer := oauthtest.NewIssuer()
+	defer issuer.Close()
+	r, _ := newOAuthRouter(t, issuer)
+
+	if w := serve(r, "/api/auth/mock/start?link=1"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOAuthCallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		// tamper changes what the browser brings back to the callback.
+		tamper func(t *testing.T, st *oauthState, query url.Values)
+		// dropState sends the callback without the state cookie.
+		dropState bool
+		// wantError is the oauth_error passed to the frontend, empty when
+		// the login succeeds.
+		wantError string
+		// wantCalls is how often users-service was asked to log in.
+		wantCalls int
+	}{
+		{
+			name:      "logs in",
+			wantCalls: 1,
+		},
+		{
+			name:      "unverified email is refused",
+			claims:    map[string]any{"sub": "subject-1", "email": "user@example.com", "email_verified": false},
+			wantError: "external_email_not_verified",
+			wantCalls: 1,
+		},
+		{
+			name: "state does not match the cookie",
+			tamper: func(t *testing.T, st *oauthState, query url.Values) {
+				query.Set("state", "forged")
+			},
+			wantError: "invalid_state",
+		},
+		{
+			name:      "state cookie missing",
+			dropState: true,
+			wantError: "invalid_state",
+		},
+		{
+			name: "state cookie without PKCE verifier",
+			tamper: func(t *testing.T, st *oauthState, query url.Values) {
+				st.Verifier = ""
+			},
+			wantError: "invalid_state",
+		},
+		{
+			name: "PKCE verifier does not match the challenge",
+			tamper: func(t *testing.T, st *oauthState, query url.Values) {
+				st.Verifier = "not-the-verifier-the-challenge-was-derived-from"
+			},
+			wantError: "exchange_failed",
+		},
+		{
+			name: "state cookie for another provider",
+			tamper: func(t *testing.T, st *oauthState, query url.Values) {
+				st.Provider = "github"
+			},
+			wantError: "invalid_state",
+		},
+		{
+			name: "provider reports an error",
+			tamper: func(t *testing.T, st *oauthState, query url.Values) {
+				query.Del("code")
+				query.Set("error", "access_denied")
+			},
+			wantError: "access_denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oauthtest.NewIssuer()
+			defer issuer.Close()
+			if tt.claims != nil {
+				issuer.SetClaims(tt.claims)
+			}
+			r, users := newOAuthRouter(t, issuer)
+
+			start := serve(r, "/api/auth/mock/start")
+			if start.Code != http.StatusFound {
+				t.Fatalf("start status = %d: %s", start.Code, start.Body)
+			}
+			callback := approve(t, start)
+			stateCookie := responseCookie(start, oauthStateCookie)
+
+			if tt.tamper != nil {
+				raw, err := base64.RawURLEncoding.DecodeString(stateCookie.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var st oauthState
+				if err := json.Unmarshal(raw, &st); err != nil {
+					t.Fatal(err)
+				}
+				query := callback.Query()
+				tt.tamper(t, &st, query)
+				callback.RawQuery = query.Encode()
+				if raw, err = json.Marshal(st); err != nil {
+					t.Fatal(err)
+				}
+				stateCookie.Value = base64.RawURLEncoding.EncodeToString(raw)
+			}
+			var cookies []*http.Cookie
+			if !tt.dropState {
+				cookies = append(cookies, stateCookie)
+			}
+
+			w := serve(r, callback.RequestURI(), cookies...)
+			if w.Code != http.StatusFound {
+				t.Fatalf("status = %d, want a redirect to the frontend: %s", w.Code, w.Body)
+			}
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := location.Scheme + "://" + location.Host + location.Path; got != frontendURL {
+				t.Errorf("redirected to %s, want %s", got, frontendURL)
+			}
+			if got := location.Query().Get("oauth_error"); got != tt.wantError {
+				t.Errorf("oauth_error = %q, want %q", got, tt.wantError)
+			}
+			if cleared := responseCookie(w, oauthStateCookie); cleared == nil || cleared.MaxAge >= 0 {
+				t.Error("state cookie was not cleared")
+			}
+
+			calls := users.calls()
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("users-service got %d logins, want %d", len(calls), tt.wantCalls)
+			}
+			if tt.wantCalls > 0 && (calls[0].GetProvider() != "mock" || calls[0].GetSubject() != "subject-1") {
+				t.Errorf("users-service got %+v, want the identity at mock", calls[0])
+			}
+			accessToken := responseCookie(w, "access_token")
+			if loggedIn := accessToken != nil && accessToken.Value == "access-token"; loggedIn != (tt.wantError == "") {
+				t.Errorf("access token cookie = %+v, logged in = %v", accessToken, tt.wantError == "")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/pkg"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// HealthChecker is implemented by the clients of upstream services.
+type HealthChecker interface {
+	CheckHealth(c context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error)
+}
+
+// Upstream is a gRPC service the gateway needs to serve requests.
+type Upstream struct {
+	// Name is the key of the upstream in health responses.
+	Name string
+	// Service is the grpc.health.v1 service name to check.
+	Service string
+	Checker HealthChecker
+}
+
+type upstreamHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthHandler struct {
+	upstreams []Upstream
+	timeout   time.Duration
+	draining  atomic.Bool
+}
+
+func NewHealthHandler(timeout time.Duration, upstreams ...Upstream) *HealthHandler {
+	return &HealthHandler{upstreams: upstreams, timeout: timeout}
+}
+
+// Healthz is the liveness check: it answers 200 as long as the gateway
+// itself runs, since restarting it would not bring an upstream back. The
+// body still reports every upstream so one request shows the whole picture.
+func (h *HealthHandler) Healthz(c *gin.Context) {
+	upstreams, serving := h.check(c)
+	message := "ok"
+	if !serving {
+		message = "degraded"
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, pkg.SuccessResponse(message, upstreams))
+}
+
+// Readyz is the readiness check: it answers 503 unless every upstream
+// reports SERVING, so load balancers stop routing to a gateway that could
+// only return errors. It also answers 503 once the gateway is shutting down.
+func (h *HealthHandler) Readyz(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	if h.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, pkg.ErrorResponse("shutting down", nil))
+		return
+	}
+
+	upstreams, serving := h.check(c)
+	if !serving {
+		c.JSON(http.StatusServiceUnavailable, pkg.Response{Success: false, Message: "not ready", Data: upstreams})
+		return
+	}
+	c.JSON(http.StatusOK, pkg.SuccessResponse("ready", upstreams))
+}
+
+// Shutdown makes Readyz fail from now on, so load balancers take the
+// gateway out of rotation while it drains.
+func (h *HealthHandler) Shutdown() {
+	h.draining.Store(true)
+}
+
+// check asks every upstream for its status at the same time and reports
+// whether all of them are SERVING.
+func (h *HealthHandler) check(c context.Context) (map[string]upstreamHealth, bool) {
+	ctx, cancel := context.WithTimeout(c, h.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	upstreams := make(map[string]upstreamHealth, len(h.upstreams))
+	serving := true
+	for _, upstream := range h.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var health upstreamHealth
+			resp, err := upstream.Checker.CheckHealth(ctx, &healthpb.HealthCheckRequest{Service: upstream.Service})
+			if err != nil {
+				health = upstreamHealth{Status: "UNREACHABLE", Error: status.Convert(err).Message()}
+			} else {
+				health = upstreamHealth{Status: resp.GetStatus().String()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			upstreams[upstream.Name] = health
+			if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				serving = false
+			}
+		}()
+	}
+	wg.Wait()
+	return upstreams, serving
+}
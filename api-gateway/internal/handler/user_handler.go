@@ -2,20 +2,26 @@ package handler
 
 import (
 	"net/http"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/wafi11/microservices/api-gateway/internal/client"
 	"github.com/wafi11/microservices/api-gateway/pkg"
 	"github.com/wafi11/microservices/users-services/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 type UserHandler struct {
-	userClient *client.UserClient
+	userClient  *client.UserClient
+	keys        *pkg.JWKSCache
+	revocations *pkg.RevocationCache
+	cookies     pkg.Cookies
 }
 
-func NewUserHandler(userClient *client.UserClient) *UserHandler {
-	return &UserHandler{userClient: userClient}
+func NewUserHandler(userClient *client.UserClient, keys *pkg.JWKSCache, revocations *pkg.RevocationCache, cookies pkg.Cookies) *UserHandler {
+	return &UserHandler{userClient: userClient, keys: keys, revocations: revocations, cookies: cookies}
 }
 
 func (h *UserHandler) CreateUser(c *gin.Context) {
@@ -27,7 +33,7 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 
 	user, err := h.userClient.RegisterUser(c, &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, pkg.ErrorResponse("Failed to create user", err.Error()))
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to create user", err))
 		return
 	}
 
@@ -43,22 +49,100 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 
 	token, err := h.userClient.LoginUser(c, &req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, pkg.ErrorResponse("Failed to login user", err.Error()))
+		pkg.SetRetryAfter(c, err)
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to login user", err))
 		return
 	}
 
-	pkg.SetTokenToCookie(c, "access_token", token.Token, "localhost")
+	// The password was right but a second factor is needed; the client
+	// posts the code with mfa_token to /api/users/login/mfa.
+	if token.MfaRequired {
+		c.JSON(http.StatusOK, pkg.SuccessResponse("Two-factor authentication required", gin.H{
+			"mfa_required": true,
+			"mfa_token":    token.MfaToken,
+		}))
+		return
+	}
+
+	h.cookies.SetTokenToCookie(c, "access_token", token.Token)
+	h.cookies.SetRefreshTokenCookie(c, token.RefreshToken, time.Unix(token.RefreshTokenExpiresAt, 0))
 
 	c.JSON(http.StatusCreated, pkg.SuccessResponse("Login successfully", nil))
 }
 
-func (h *UserHandler) FindMe(c *gin.Context) {
+func (h *UserHandler) VerifyMFA(c *gin.Context) {
+	var req proto.VerifyMFARequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	token, err := h.userClient.VerifyMFA(c, &req)
+	if err != nil {
+		pkg.SetRetryAfter(c, err)
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to verify code", err))
+		return
+	}
+
+	h.cookies.SetTokenToCookie(c, "access_token", token.Token)
+	h.cookies.SetRefreshTokenCookie(c, token.RefreshToken, time.Unix(token.RefreshTokenExpiresAt, 0))
+
+	c.JSON(http.StatusCreated, pkg.SuccessResponse("Login successfully", nil))
+}
+
+func (h *UserHandler) RefreshToken(c *gin.Context) {
+	refreshToken, err := c.Cookie("refresh_token")
+	if err != nil || refreshToken == "" {
+		c.JSON(http.StatusUnauthorized, pkg.ErrorResponse("Failed to refresh token", "no refresh token provided"))
+		return
+	}
+
+	token, err := h.userClient.RefreshToken(c, &proto.RefreshTokenRequest{RefreshToken: refreshToken})
+	if err != nil {
+		code := pkg.HTTPStatusFromError(err)
+		if code == http.StatusUnauthorized {
+			h.cookies.ClearRefreshTokenCookie(c)
+		}
+		c.JSON(code, pkg.ErrorResponse("Failed to refresh token", err.Error()))
+		return
+	}
+
+	h.cookies.SetTokenToCookie(c, "access_token", token.Token)
+	h.cookies.SetRefreshTokenCookie(c, token.RefreshToken, time.Unix(token.RefreshTokenExpiresAt, 0))
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Token refreshed successfully", nil))
+}
+
+func (h *UserHandler) Logout(c *gin.Context) {
+	token := pkg.TokenFromRequest(c)
+	refreshToken, _ := c.Cookie("refresh_token")
+
+	if token != "" || refreshToken != "" {
+		_, err := h.userClient.Logout(c, &proto.LogoutRequest{Token: token, RefreshToken: refreshToken})
+		if err != nil {
+			c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to logout", err.Error()))
+			return
+		}
+		if claims, err := pkg.VerifyToken(c, h.keys, token); err == nil {
+			h.revocations.MarkRevoked(claims.ID, claims.Expiry.Time())
+		}
+	}
+
+	h.cookies.ClearTokenCookie(c, "access_token")
+	h.cookies.ClearRefreshTokenCookie(c)
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Logout successfully", nil))
+}
+
+// currentUserID returns the id AuthMiddleware stored for the request,
+// aborting with an error response when it is missing or malformed.
+func currentUserID(c *gin.Context) (int32, bool) {
 	userId, exists := c.Get("userId")
 	if !exists {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			"error": "unauthorized",
 		})
-		return
+		return 0, false
 	}
 
 	// Cast dari any ke string
@@ -67,18 +151,26 @@ func (h *UserHandler) FindMe(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 			"error": "invalid userId format",
 		})
-		return
+		return 0, false
 	}
 	userIdInt, err := strconv.Atoi(userIdStr)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": "invalid userId",
 		})
+		return 0, false
+	}
+	return int32(userIdInt), true
+}
+
+func (h *UserHandler) FindMe(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 
 	resp, err := h.userClient.FindMe(c, &proto.FindMeRequest{
-		UserId: int32(userIdInt),
+		UserId: userId,
 	})
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -89,3 +181,427 @@ func (h *UserHandler) FindMe(c *gin.Context) {
 
 	c.JSON(http.StatusOK, resp)
 }
+
+// UpdateMe applies a partial profile update. Only the keys present in the
+// JSON body are changed; a key set to null or "" clears optional fields.
+func (h *UserHandler) UpdateMe(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var body map[string]*string
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	req := &proto.UpdateProfileRequest{UserId: userId, UpdateMask: &fieldmaskpb.FieldMask{}}
+	fields := map[string]*string{
+		"full_name":     &req.FullName,
+		"phone_number":  &req.PhoneNumber,
+		"bio":           &req.Bio,
+		"avatar_url":    &req.AvatarUrl,
+		"locale":        &req.Locale,
+		"timezone":      &req.Timezone,
+		"date_of_birth": &req.DateOfBirth,
+	}
+	for key, value := range body {
+		field, ok := fields[key]
+		if !ok {
+			c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", "unknown field "+key))
+			return
+		}
+		if value != nil {
+			*field = *value
+		}
+		req.UpdateMask.Paths = append(req.UpdateMask.Paths, key)
+	}
+	if len(req.UpdateMask.Paths) == 0 {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", "no fields to update"))
+		return
+	}
+	sort.Strings(req.UpdateMask.Paths)
+
+	resp, err := h.userClient.UpdateProfile(c, req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to update profile", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Profile updated successfully", resp))
+}
+
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req proto.ChangePasswordRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	token, err := h.userClient.ChangePassword(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to change password", err))
+		return
+	}
+
+	// Every other session was logged out; keep this one signed in.
+	h.cookies.SetTokenToCookie(c, "access_token", token.Token)
+	h.cookies.SetRefreshTokenCookie(c, token.RefreshToken, time.Unix(token.RefreshTokenExpiresAt, 0))
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Password changed successfully", nil))
+}
+
+func (h *UserHandler) CheckUsername(c *gin.Context) {
+	username := c.Query("username")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", "username is required"))
+		return
+	}
+
+	resp, err := h.userClient.CheckUsernameAvailability(c, &proto.CheckUsernameAvailabilityRequest{Username: username})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to check username", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Username checked successfully", resp))
+}
+
+func (h *UserHandler) ChangeUsername(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req proto.ChangeUsernameRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	resp, err := h.userClient.ChangeUsername(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to change username", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Username changed successfully", resp))
+}
+
+func (h *UserHandler) EnrollTOTP(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.EnrollTOTP(c, &proto.EnrollTOTPRequest{UserId: userId})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to enroll two-factor authentication", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Scan the secret with an authenticator app, then confirm a code", resp))
+}
+
+// ConfirmTOTP answers with the recovery codes, which cannot be shown again.
+func (h *UserHandler) ConfirmTOTP(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req proto.ConfirmTOTPRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	resp, err := h.userClient.ConfirmTOTP(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to confirm two-factor authentication", err.Error()))
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Two-factor authentication enabled", resp))
+}
+
+// DisableTOTP needs the password, so like DeleteMe it answers
+// PASSWORD_NOT_SET until the account has one.
+func (h *UserHandler) DisableTOTP(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req proto.DisableTOTPRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	if _, err := h.userClient.DisableTOTP(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to disable two-factor authentication", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Two-factor authentication disabled", nil))
+}
+
+func (h *UserHandler) ListIdentities(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.ListIdentities(c, &proto.ListIdentitiesRequest{UserId: userId})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list linked accounts", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Linked accounts", resp))
+}
+
+// UnlinkIdentity refuses to remove the last way to log in; the user has to
+// set a password through the reset flow first.
+func (h *UserHandler) UnlinkIdentity(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	_, err := h.userClient.UnlinkIdentity(c, &proto.UnlinkIdentityRequest{
+		UserId:   userId,
+		Provider: c.Param("provider"),
+	})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to unlink account", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Account unlinked", nil))
+}
+
+// Activity lists the security events concerning the current user, newest
+// first. Pass next_page_token back as page_token for older events.
+func (h *UserHandler) Activity(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	req := proto.ListAuditEventsRequest{TargetId: userId, PageSize: 20, PageToken: c.Query("page_token")}
+	if raw := c.Query("page_size"); raw != "" {
+		size, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil || size <= 0 || size > 100 {
+			c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid query parameter", "page_size must be between 1 and 100"))
+			return
+		}
+		req.PageSize = int32(size)
+	}
+
+	resp, err := h.userClient.ListAuditEvents(c, &req)
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to load activity", err.Error()))
+		return
+	}
+
+	// The actor of events such as role changes is an admin whose id is not
+	// the user's business, and request ids are for operators.
+	for _, event := range resp.Events {
+		if event.ActorId != userId {
+			event.ActorId = 0
+		}
+		event.RequestId = ""
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Recent activity", resp))
+}
+
+// ListSessions shows where the user is logged in, marking the session of
+// the calling token as current.
+func (h *UserHandler) ListSessions(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.userClient.ListSessions(c, &proto.ListSessionsRequest{
+		UserId:           userId,
+		CurrentSessionId: c.GetString("sessionId"),
+	})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to list sessions", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Active sessions", resp))
+}
+
+// RevokeSession logs out one device. Revoking the current session also
+// clears the caller's cookies. Other gateways notice the revocation once
+// their cached check for the session's access tokens expires.
+func (h *UserHandler) RevokeSession(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	sessionId := c.Param("id")
+	_, err := h.userClient.RevokeSession(c, &proto.RevokeSessionRequest{UserId: userId, SessionId: sessionId})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to revoke session", err.Error()))
+		return
+	}
+
+	if sessionId == c.GetString("sessionId") {
+		if claims, err := pkg.VerifyToken(c, h.keys, pkg.TokenFromRequest(c)); err == nil {
+			h.revocations.MarkRevoked(claims.ID, claims.Expiry.Time())
+		}
+		h.cookies.ClearTokenCookie(c, "access_token")
+		h.cookies.ClearRefreshTokenCookie(c)
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Session revoked", nil))
+}
+
+// RevokeOtherSessions logs out every device except the caller's.
+func (h *UserHandler) RevokeOtherSessions(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	sessionId := c.GetString("sessionId")
+	if sessionId == "" {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Failed to revoke sessions", "token is not tied to a session, log in again"))
+		return
+	}
+
+	resp, err := h.userClient.RevokeAllOtherSessions(c, &proto.RevokeAllOtherSessionsRequest{
+		UserId:           userId,
+		CurrentSessionId: sessionId,
+	})
+	if err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to revoke sessions", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Other sessions revoked", resp))
+}
+
+// DeleteMe deletes the current account after the password is confirmed and
+// signs the caller out. Accounts created through a provider get the
+// PASSWORD_NOT_SET code and have to set a password first.
+func (h *UserHandler) DeleteMe(c *gin.Context) {
+	userId, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+
+	var req proto.DeleteAccountRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+	req.UserId = userId
+
+	if _, err := h.userClient.DeleteAccount(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to delete account", err))
+		return
+	}
+
+	if claims, err := pkg.VerifyToken(c, h.keys, pkg.TokenFromRequest(c)); err == nil {
+		h.revocations.MarkRevoked(claims.ID, claims.Expiry.Time())
+	}
+	h.cookies.ClearTokenCookie(c, "access_token")
+	h.cookies.ClearRefreshTokenCookie(c)
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Account deleted successfully", nil))
+}
+
+// ForgotPassword always answers 202 for a well-formed email so callers
+// cannot probe which addresses have an account.
+func (h *UserHandler) ForgotPassword(c *gin.Context) {
+	var req proto.RequestPasswordResetRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if _, err := h.userClient.RequestPasswordReset(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.ErrorResponse("Failed to request password reset", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, pkg.SuccessResponse("If the email is registered, a password reset link has been sent", nil))
+}
+
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var req proto.ResetPasswordRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if _, err := h.userClient.ResetPassword(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to reset password", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Password reset successfully", nil))
+}
+
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+	var req proto.VerifyEmailRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if _, err := h.userClient.VerifyEmail(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to verify email", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg.SuccessResponse("Email verified successfully", nil))
+}
+
+// ResendVerification answers 202 like ForgotPassword, whether or not the
+// address belongs to an unverified account.
+func (h *UserHandler) ResendVerification(c *gin.Context) {
+	var req proto.ResendVerificationRequest
+	if err := c.ShouldBindBodyWithJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, pkg.ErrorResponse("Invalid request body", err.Error()))
+		return
+	}
+
+	if _, err := h.userClient.ResendVerification(c, &req); err != nil {
+		c.JSON(pkg.HTTPStatusFromError(err), pkg.GRPCErrorResponse("Failed to resend verification email", err))
+		return
+	}
+
+	c.JSON(http.StatusAccepted, pkg.SuccessResponse("If the account still needs verification, a new link has been sent", nil))
+}
+
+func (h *UserHandler) JWKS(c *gin.Context) {
+	raw, err := h.keys.Raw(c)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, pkg.ErrorResponse("Failed to load signing keys", err.Error()))
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, "application/jwk-set+json", raw)
+}
@@ -0,0 +1,153 @@
+// Package oauthtest provides a mock OpenID Connect issuer for tests of the
+// authorization code flow.
+package oauthtest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Issuer is an OIDC provider running on a local httptest server. It
+// implements discovery, the authorization endpoint, which approves every
+// request straight away, the token endpoint with PKCE (S256 only) and the
+// userinfo endpoint.
+type Issuer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// claims is what the userinfo endpoint returns.
+	claims map[string]any
+	// discoveredIssuer overrides the issuer named in the discovery
+	// document when set.
+	discoveredIssuer string
+	// challenges holds the PKCE challenge of every code not yet redeemed.
+	challenges map[string]string
+	tokens     map[string]bool
+}
+
+// NewIssuer starts an issuer whose userinfo endpoint returns a verified
+// user. Close it when done.
+func NewIssuer() *Issuer {
+	issuer := &Issuer{
+		claims: map[string]any{
+			"sub":            "subject-1",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"name":           "Jane Doe",
+		},
+		challenges: make(map[string]string),
+		tokens:     make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("GET /authorize", issuer.authorize)
+	mux.HandleFunc("POST /token", issuer.token)
+	mux.HandleFunc("GET /userinfo", issuer.userInfo)
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+// SetClaims replaces the claims returned from the userinfo endpoint.
+func (i *Issuer) SetClaims(claims map[string]any) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.claims = claims
+}
+
+// SetDiscoveredIssuer makes discovery name issuer instead of the server
+// URL, as a misconfigured or impersonated provider would.
+func (i *Issuer) SetDiscoveredIssuer(issuer string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.discoveredIssuer = issuer
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	issuer := i.discoveredIssuer
+	i.mu.Unlock()
+	if issuer == "" {
+		issuer = i.URL
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"userinfo_endpoint":      i.URL + "/userinfo",
+	})
+}
+
+// authorize approves the request and redirects back with a code bound to
+// the PKCE challenge.
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("response_type") != "code" || query.Get("client_id") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	code := rand.Text()
+	i.mu.Lock()
+	i.challenges[code] = query.Get("code_challenge")
+	i.mu.Unlock()
+
+	values := redirectURI.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems a code once, if the verifier matches its challenge.
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	code, verifier := r.PostForm.Get("code"), r.PostForm.Get("code_verifier")
+
+	i.mu.Lock()
+	challenge, ok := i.challenges[code]
+	delete(i.challenges, code)
+	i.mu.Unlock()
+	sum := sha256.Sum256([]byte(verifier))
+	if !ok || verifier == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := rand.Text()
+	i.mu.Lock()
+	i.tokens[token] = true
+	i.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+}
+
+func (i *Issuer) userInfo(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.tokens[token] {
+		http.Error(w, "invalid access token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, i.claims)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
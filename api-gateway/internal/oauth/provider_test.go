@@ -0,0 +1,194 @@
+package oauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wafi11/microservices/api-gateway/internal/oauth/oauthtest"
+	"golang.org/x/oauth2"
+)
+
+// loadProvider configures a single OIDC provider named "mock" against
+// issuer through a providers file, as the gateway does.
+func loadProvider(t *testing.T, issuer *oauthtest.Issuer) *Provider {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "providers.json")
+	config := `[{"name": "mock", "kind": "oidc", "issuer": "` + issuer.URL + `", "client_id": "gateway", "client_secret": "$MOCK_CLIENT_SECRET"}]`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MOCK_CLIENT_SECRET", "secret")
+
+	providers, err := LoadProviders(path, "http://gateway.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := providers.Get("mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// authorize sends the browser to the provider and returns the code it
+// comes back with.
+func authorize(t *testing.T, provider *Provider, verifier string) string {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("authorization endpoint answered %s without redirecting", resp.Status)
+	}
+	return location.Query().Get("code")
+}
+
+func TestProviderDiscovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// discovered returns the issuer named by the discovery document
+		// given the issuer URL, or nil for the URL itself.
+		discovered func(issuer string) string
+		wantErr    string
+	}{
+		{"issuer matches", nil, ""},
+		{"trailing slash is ignored", func(issuer string) string { return issuer + "/" }, ""},
+		{"issuer mismatch", func(string) string { return "https://accounts.example.com" }, "issuer mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oauthtest.NewIssuer()
+			defer issuer.Close()
+			if tt.discovered != nil {
+				issuer.SetDiscoveredIssuer(tt.discovered(issuer.URL))
+			}
+			provider := loadProvider(t, issuer)
+
+			authURL, err := provider.AuthCodeURL(context.Background(), "state-1", oauth2.GenerateVerifier())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AuthCodeURL() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if got := u.Scheme + "://" + u.Host + u.Path; got != issuer.URL+"/authorize" {
+				t.Errorf("authorization endpoint = %s, want %s/authorize", got, issuer.URL)
+			}
+			if query.Get("redirect_uri") != "http://gateway.test/api/auth/mock/callback" {
+				t.Errorf("redirect_uri = %q", query.Get("redirect_uri"))
+			}
+			if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+				t.Errorf("authorization URL %s carries no S256 challenge", authURL)
+			}
+			if query.Get("scope") != "openid email profile" {
+				t.Errorf("scope = %q, want the OIDC defaults", query.Get("scope"))
+			}
+		})
+	}
+}
+
+func TestProviderDiscoveryUnavailable(t *testing.T) {
+	issuer := oauthtest.NewIssuer()
+	provider := loadProvider(t, issuer)
+	issuer.Close()
+
+	if _, err := provider.AuthCodeURL(context.Background(), "state-1", oauth2.GenerateVerifier()); err == nil {
+		t.Fatal("AuthCodeURL() succeeded without a reachable issuer")
+	}
+}
+
+func TestProviderExchange(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		// verifier is presented on exchange instead of the one the
+		// challenge was derived from, when set.
+		verifier string
+		want     *Identity
+		wantErr  string
+	}{
+		{
+			name:   "verified email",
+			claims: map[string]any{"sub": "1", "email": "jane@example.com", "email_verified": true, "name": "Jane"},
+			want:   &Identity{Subject: "1", Email: "jane@example.com", EmailVerified: true, Name: "Jane"},
+		},
+		{
+			name:   "email_verified as a string",
+			claims: map[string]any{"sub": "1", "email": "jane@example.com", "email_verified": "true"},
+			want:   &Identity{Subject: "1", Email: "jane@example.com", EmailVerified: true},
+		},
+		{
+			name:   "unverified email",
+			claims: map[string]any{"sub": "1", "email": "jane@example.com", "email_verified": false},
+			want:   &Identity{Subject: "1", Email: "jane@example.com"},
+		},
+		{
+			name:   "email_verified missing",
+			claims: map[string]any{"sub": "1", "email": "jane@example.com"},
+			want:   &Identity{Subject: "1", Email: "jane@example.com"},
+		},
+		{
+			name:    "no subject",
+			claims:  map[string]any{"email": "jane@example.com", "email_verified": true},
+			wantErr: "no sub claim",
+		},
+		{
+			name:     "wrong PKCE verifier",
+			claims:   map[string]any{"sub": "1"},
+			verifier: oauth2.GenerateVerifier(),
+			wantErr:  "could not exchange code",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oauthtest.NewIssuer()
+			defer issuer.Close()
+			issuer.SetClaims(tt.claims)
+			provider := loadProvider(t, issuer)
+
+			verifier := oauth2.GenerateVerifier()
+			code := authorize(t, provider, verifier)
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+
+			identity, err := provider.Exchange(context.Background(), code, verifier)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *identity != *tt.want {
+				t.Errorf("Exchange() = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,20 +13,29 @@ import (
 )
 
 type JwtToken struct {
-	UserId string `json:"userId"`
+	UserId      string   `json:"userId"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	SessionId   string   `json:"sid,omitempty"`
 	jwt.Claims
 }
 
-func VerifyToken(tokenString string) (*JwtToken, error) {
-	secrets := []byte("f1404c536dbe0eb9b7ef959b09490eb0")
-
-	tok, err := jwt.ParseSigned(tokenString, []jose.SignatureAlgorithm{jose.HS256})
+// VerifyToken checks an access token signed by users-service. The same keys
+// also sign email verification and MFA challenge tokens, which carry an
+// audience and their own typ header and are rejected here.
+func VerifyToken(c context.Context, keys *JWKSCache, tokenString string) (*JwtToken, error) {
+	tok, err := jwt.ParseSigned(tokenString, []jose.SignatureAlgorithm{jose.EdDSA, jose.RS256})
 	if err != nil {
 		return nil, fmt.Errorf("could not parse token: %v", err)
 	}
 
+	key, err := keys.Key(c, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify token: %v", err)
+	}
+
 	claims := &JwtToken{}
-	if err := tok.Claims(secrets, claims); err != nil {
+	if err := tok.Claims(key.Key, claims); err != nil {
 		return nil, fmt.Errorf("could not verify token: %v", err)
 	}
 
@@ -35,27 +45,33 @@ func VerifyToken(tokenString string) (*JwtToken, error) {
 	}); err != nil {
 		return nil, fmt.Errorf("token invalid: %v", err)
 	}
+	if typ, _ := tok.Headers[0].ExtraHeaders[jose.HeaderType].(string); len(claims.Audience) > 0 || typ != "JWT" {
+		return nil, fmt.Errorf("token invalid: not an access token")
+	}
 
 	return claims, nil
 }
 
-func AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var tokenString string
+// TokenFromRequest returns the access token from the Authorization header,
+// falling back to the access_token cookie.
+func TokenFromRequest(c *gin.Context) string {
+	// 1. Baca dari Authorization header
+	authHeader := c.GetHeader("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
 
-		// 1. Baca dari Authorization header
-		authHeader := c.GetHeader("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
-		}
+	// 2. Fallback: baca dari cookie jika header tidak ada
+	cookie, err := c.Cookie("access_token")
+	if err == nil {
+		return cookie
+	}
+	return ""
+}
 
-		// 2. Fallback: baca dari cookie jika header tidak ada
-		if tokenString == "" {
-			cookie, err := c.Cookie("access_token")
-			if err == nil {
-				tokenString = cookie
-			}
-		}
+func AuthMiddleware(keys *JWKSCache, revocations *RevocationCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := TokenFromRequest(c)
 
 		// 3. Tidak ada token sama sekali
 		if tokenString == "" {
@@ -66,7 +82,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		// 4. Verifikasi token
-		claims, err := VerifyToken(tokenString)
+		claims, err := VerifyToken(c, keys, tokenString)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "unauthorized: " + err.Error(),
@@ -74,8 +90,26 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 5. Simpan claims ke context untuk dipakai di handler
+		// 5. Tolak token yang sudah di-revoke (logout)
+		revoked, err := revocations.IsRevoked(c, claims)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "could not check token revocation: " + err.Error(),
+			})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "unauthorized: token has been revoked",
+			})
+			return
+		}
+
+		// 6. Simpan claims ke context untuk dipakai di handler
 		c.Set("userId", claims.UserId)
+		c.Set("roles", claims.Roles)
+		c.Set("permissions", claims.Permissions)
+		c.Set("sessionId", claims.SessionId)
 		c.Next()
 	}
 }
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+// WithClientInfo forwards the address, user agent and a device label of
+// the caller to users-service, which would otherwise only see the gateway,
+// along with the request id and the authenticated user for the audit log.
+// Clients may name the device themselves with an X-Device-Label header.
+func WithClientInfo(c *gin.Context) context.Context {
+	label := strings.TrimSpace(c.GetHeader("X-Device-Label"))
+	if label == "" {
+		label = DeviceLabel(c.Request.UserAgent())
+	}
+	kv := []string{
+		"x-client-ip", c.ClientIP(),
+		"x-client-user-agent", c.Request.UserAgent(),
+		"x-device-label", label,
+	}
+	if requestId := c.GetString("requestId"); requestId != "" {
+		kv = append(kv, "x-request-id", requestId)
+	}
+	if userId := c.GetString("userId"); userId != "" {
+		kv = append(kv, "x-actor-id", userId)
+	}
+	return metadata.AppendToOutgoingContext(c, kv...)
+}
+
+// DeviceLabel turns a User-Agent header into a short description such as
+// "Chrome on macOS". Order matters: Edge and Opera also claim to be Chrome,
+// and Chrome also claims to be Safari.
+func DeviceLabel(userAgent string) string {
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	os := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			os = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return ""
+	}
+}
@@ -6,6 +6,28 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetTokenToCookie(c *gin.Context, name, token, origin string) {
-	c.SetCookie(name, token, int(time.Duration(15*time.Minute)), "/", "localhost", false, false)
+// Cookies writes the auth cookies using the domain and Secure flag the
+// gateway is configured with.
+type Cookies struct {
+	Domain string
+	Secure bool
+}
+
+func (ck Cookies) SetTokenToCookie(c *gin.Context, name, token string) {
+	c.SetCookie(name, token, int((15 * time.Minute).Seconds()), "/", ck.Domain, ck.Secure, false)
+}
+
+func (ck Cookies) ClearTokenCookie(c *gin.Context, name string) {
+	c.SetCookie(name, "", -1, "/", ck.Domain, ck.Secure, false)
+}
+
+// SetRefreshTokenCookie stores the refresh token in an HttpOnly cookie scoped
+// to the users API so it is never readable from JavaScript.
+func (ck Cookies) SetRefreshTokenCookie(c *gin.Context, token string, expiresAt time.Time) {
+	maxAge := int(time.Until(expiresAt).Seconds())
+	c.SetCookie("refresh_token", token, maxAge, "/api/users", ck.Domain, ck.Secure, true)
+}
+
+func (ck Cookies) ClearRefreshTokenCookie(c *gin.Context) {
+	c.SetCookie("refresh_token", "", -1, "/api/users", ck.Domain, ck.Secure, true)
 }
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// reasonStatus overrides the code based mapping for errors whose ErrorInfo
+// reason calls for a more specific HTTP status.
+var reasonStatus = map[string]int{
+	"EMAIL_NOT_VERIFIED": http.StatusForbidden,
+	"PASSWORD_EXPIRED":   http.StatusForbidden,
+}
+
+// ErrorReason returns the ErrorInfo reason attached to a gRPC error, or ""
+// when the upstream service did not send one.
+func ErrorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.GetReason()
+		}
+	}
+	return ""
+}
+
+// FieldErrors collects the BadRequest field violations of a gRPC error by
+// field name, or returns nil when there are none.
+func FieldErrors(err error) map[string][]string {
+	var fields map[string][]string
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				if fields == nil {
+					fields = make(map[string][]string)
+				}
+				fields[violation.GetField()] = append(fields[violation.GetField()], violation.GetDescription())
+			}
+		}
+	}
+	return fields
+}
+
+// SetRetryAfter copies the RetryInfo delay of a gRPC error into a
+// Retry-After header, rounded up to whole seconds.
+func SetRetryAfter(c *gin.Context, err error) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := int(math.Ceil(info.GetRetryDelay().AsDuration().Seconds()))
+			c.Header("Retry-After", strconv.Itoa(max(seconds, 1)))
+			return
+		}
+	}
+}
+
+// HTTPStatusFromError maps a gRPC error returned by an upstream service to
+// the HTTP status code the gateway should answer with.
+func HTTPStatusFromError(err error) int {
+	if code, ok := reasonStatus[ErrorReason(err)]; ok {
+		return code
+	}
+	switch status.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/wafi11/microservices/users-services/proto"
+	"golang.org/x/sync/singleflight"
+)
+
+// minJWKSRefresh limits how often the set may be refetched, so tokens with
+// made-up kids cannot hammer users-service and an outage is not retried on
+// every request.
+const minJWKSRefresh = 10 * time.Second
+
+// jwksFetchTimeout bounds a fetch. It is shared by every caller waiting on
+// it, so it does not follow the context of the one that started it.
+const jwksFetchTimeout = 5 * time.Second
+
+type JWKSFetcher interface {
+	GetJWKS(c context.Context, req *proto.GetJWKSRequest) (*proto.GetJWKSResponse, error)
+}
+
+// JWKSCache keeps the signing keys published by users-service. The set is
+// refreshed every ttl, and early when a token names a key id that is not in
+// the cached set yet (the signing key was rotated).
+type JWKSCache struct {
+	fetcher JWKSFetcher
+	ttl     time.Duration
+	// refreshes collapses concurrent refreshes into a single fetch.
+	refreshes singleflight.Group
+
+	mu        sync.RWMutex
+	raw       []byte
+	set       jose.JSONWebKeySet
+	fetchedAt time.Time
+	// attemptedAt and lastErr describe the latest fetch, failed or not.
+	attemptedAt time.Time
+	lastErr     error
+}
+
+func NewJWKSCache(fetcher JWKSFetcher, ttl time.Duration) *JWKSCache {
+	return &JWKSCache{fetcher: fetcher, ttl: ttl}
+}
+
+// Raw returns the cached JWKS document, fetching it when stale.
+func (jc *JWKSCache) Raw(c context.Context) ([]byte, error) {
+	jc.mu.RLock()
+	raw, fresh := jc.raw, time.Since(jc.fetchedAt) < jc.ttl
+	jc.mu.RUnlock()
+	if raw != nil && fresh {
+		return raw, nil
+	}
+
+	if err := jc.refresh(c); err != nil {
+		if raw != nil {
+			return raw, nil
+		}
+		return nil, err
+	}
+
+	jc.mu.RLock()
+	defer jc.mu.RUnlock()
+	return jc.raw, nil
+}
+
+// Key returns the public key for kid.
+func (jc *JWKSCache) Key(c context.Context, kid string) (*jose.JSONWebKey, error) {
+	jc.mu.RLock()
+	keys, fetchedAt := jc.set.Key(kid), jc.fetchedAt
+	jc.mu.RUnlock()
+
+	if len(keys) == 0 || time.Since(fetchedAt) >= jc.ttl {
+		// A failed refresh keeps serving the keys we already know about.
+		if err := jc.refresh(c); err != nil && len(keys) == 0 {
+			return nil, err
+		} else if err == nil {
+			jc.mu.RLock()
+			keys = jc.set.Key(kid)
+			jc.mu.RUnlock()
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return &keys[0], nil
+}
+
+// refresh fetches the set unless a fetch was attempted less than
+// minJWKSRefresh ago, in which case it reports how that one went.
+func (jc *JWKSCache) refresh(c context.Context) error {
+	_, err, _ := jc.refreshes.Do("jwks", func() (any, error) {
+		jc.mu.RLock()
+		recent, lastErr := time.Since(jc.attemptedAt) < minJWKSRefresh, jc.lastErr
+		jc.mu.RUnlock()
+		if recent {
+			return nil, lastErr
+		}
+
+		c, cancel := context.WithTimeout(context.WithoutCancel(c), jwksFetchTimeout)
+		defer cancel()
+		raw, set, err := jc.fetch(c)
+
+		jc.mu.Lock()
+		defer jc.mu.Unlock()
+		jc.attemptedAt, jc.lastErr = time.Now(), err
+		if err == nil {
+			jc.raw, jc.set, jc.fetchedAt = raw, set, jc.attemptedAt
+		}
+		return nil, err
+	})
+	return err
+}
+
+func (jc *JWKSCache) fetch(c context.Context) ([]byte, jose.JSONWebKeySet, error) {
+	resp, err := jc.fetcher.GetJWKS(c, &proto.GetJWKSRequest{})
+	if err != nil {
+		return nil, jose.JSONWebKeySet{}, fmt.Errorf("could not fetch jwks: %v", err)
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal([]byte(resp.GetJwks()), &set); err != nil {
+		return nil, jose.JSONWebKeySet{}, fmt.Errorf("could not parse jwks: %v", err)
+	}
+	return []byte(resp.GetJwks()), set, nil
+}
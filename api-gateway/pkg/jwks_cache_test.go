@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/wafi11/microservices/users-services/proto"
+)
+
+// fakeJWKS serves a set with one key, or err when set. Like a gRPC call it
+// fails once the context is done, and it blocks while gate is non-nil and
+// open.
+type fakeJWKS struct {
+	jwks  string
+	err   error
+	gate  chan struct{}
+	calls atomic.Int32
+}
+
+func (f *fakeJWKS) GetJWKS(c context.Context, req *proto.GetJWKSRequest) (*proto.GetJWKSResponse, error) {
+	f.calls.Add(1)
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &proto.GetJWKSResponse{Jwks: f.jwks}, nil
+}
+
+func newFakeJWKS(t *testing.T, kid string) *fakeJWKS {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: public, KeyID: kid, Algorithm: string(jose.EdDSA), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeJWKS{jwks: string(raw)}
+}
+
+func TestJWKSCacheKey(t *testing.T) {
+	tests := []struct {
+		name string
+		// failing makes users-service unavailable.
+		failing bool
+		// lookups are the key ids looked up in turn.
+		lookups   []string
+		wantErr   []bool
+		wantCalls int32
+	}{
+		{"known key is cached", false, []string{"k1", "k1", "k1"}, []bool{false, false, false}, 1},
+		{"unknown key does not refetch right away", false, []string{"k1", "k2", "k2", "k1"}, []bool{false, true, true, false}, 1},
+		{"failed fetch is not retried right away", true, []string{"k1", "k1", "k2"}, []bool{true, true, true}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newFakeJWKS(t, "k1")
+			if tt.failing {
+				fetcher.err = errors.New("users-service unavailable")
+			}
+			cache := NewJWKSCache(fetcher, time.Hour)
+
+			for i, kid := range tt.lookups {
+				key, err := cache.Key(context.Background(), kid)
+				if (err != nil) != tt.wantErr[i] {
+					t.Fatalf("lookup %d of %s: error = %v, want error %v", i, kid, err, tt.wantErr[i])
+				}
+				if err == nil && key.KeyID != kid {
+					t.Fatalf("lookup %d returned key %s, want %s", i, key.KeyID, kid)
+				}
+			}
+			if calls := fetcher.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("fetched %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheConcurrentRefresh(t *testing.T) {
+	fetcher := newFakeJWKS(t, "k1")
+	fetcher.gate = make(chan struct{})
+	cache := NewJWKSCache(fetcher, time.Hour)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range cap(errs) {
+		wg.Go(func() {
+			_, err := cache.Key(context.Background(), "k1")
+			errs <- err
+		})
+	}
+	// Let the callers pile up on the first fetch before it returns.
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Key() = %v", err)
+		}
+	}
+	if calls := fetcher.calls.Load(); calls != 1 {
+		t.Errorf("fetched %d times, want 1", calls)
+	}
+}
+
+func TestJWKSCacheCancelledCaller(t *testing.T) {
+	fetcher := newFakeJWKS(t, "k1")
+	cache := NewJWKSCache(fetcher, time.Hour)
+
+	// The fetch is shared with other callers, so one that already gave up
+	// does not fail it.
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.Key(c, "k1"); err != nil {
+		t.Errorf("Key() = %v", err)
+	}
+}
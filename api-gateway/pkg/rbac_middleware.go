@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole lets a request through when the token carries at least one of
+// roles. It has to run after AuthMiddleware, which stores the claims.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return requireClaim("roles", roles, "forbidden: missing role")
+}
+
+// RequirePermission lets a request through when the token carries at least
+// one of permissions. It has to run after AuthMiddleware.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return requireClaim("permissions", permissions, "forbidden: missing permission")
+}
+
+func requireClaim(key string, allowed []string, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := c.GetStringSlice(key)
+		for _, want := range allowed {
+			if slices.Contains(granted, want) {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": message,
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID tags every request with an id, reusing a well-formed
+// X-Request-ID from the caller or a proxy in front of the gateway. The id
+// is echoed in the response and forwarded to users-service.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set("requestId", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
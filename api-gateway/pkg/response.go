@@ -1,8 +1,11 @@
 package pkg
 
+import "google.golang.org/grpc/status"
+
 type Response struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 	Errors  interface{} `json:"errors,omitempty"`
 }
@@ -22,3 +25,15 @@ func ErrorResponse(message string, errors interface{}) Response {
 		Errors:  errors,
 	}
 }
+
+// GRPCErrorResponse builds an error response for a failed upstream call,
+// exposing the ErrorInfo reason as a stable code clients can branch on.
+// Field violations are returned per field so forms can show them in place.
+func GRPCErrorResponse(message string, err error) Response {
+	resp := ErrorResponse(message, status.Convert(err).Message())
+	if fields := FieldErrors(err); fields != nil {
+		resp.Errors = fields
+	}
+	resp.Code = ErrorReason(err)
+	return resp
+}
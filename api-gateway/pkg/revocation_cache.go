@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wafi11/microservices/users-services/proto"
+)
+
+type RevocationChecker interface {
+	IsTokenRevoked(c context.Context, req *proto.IsTokenRevokedRequest) (*proto.IsTokenRevokedResponse, error)
+}
+
+type revocationEntry struct {
+	revoked   bool
+	expiresAt time.Time
+}
+
+// RevocationCache asks users-service whether a token was revoked and keeps
+// the answer in memory. Revoked tokens are remembered until they expire;
+// valid ones are re-checked after ttl, which bounds how long a revoked token
+// keeps working on this gateway.
+type RevocationCache struct {
+	checker RevocationChecker
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]revocationEntry
+	lastSweep time.Time
+}
+
+func NewRevocationCache(checker RevocationChecker, ttl time.Duration) *RevocationCache {
+	return &RevocationCache{
+		checker:   checker,
+		ttl:       ttl,
+		entries:   make(map[string]revocationEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rc *RevocationCache) IsRevoked(c context.Context, claims *JwtToken) (bool, error) {
+	if claims.ID == "" {
+		return true, nil
+	}
+
+	now := time.Now()
+	rc.mu.Lock()
+	entry, ok := rc.entries[claims.ID]
+	rc.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.revoked, nil
+	}
+
+	userId, err := strconv.Atoi(claims.UserId)
+	if err != nil {
+		return true, nil
+	}
+
+	resp, err := rc.checker.IsTokenRevoked(c, &proto.IsTokenRevokedRequest{
+		Jti:       claims.ID,
+		SessionId: claims.SessionId,
+		UserId:    int32(userId),
+		IssuedAt:  claims.IssuedAt.Time().Unix(),
+		ExpiresAt: claims.Expiry.Time().Unix(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if resp.GetRevoked() {
+		rc.MarkRevoked(claims.ID, claims.Expiry.Time())
+	} else {
+		rc.store(claims.ID, revocationEntry{revoked: false, expiresAt: now.Add(rc.ttl)})
+	}
+	return resp.GetRevoked(), nil
+}
+
+// MarkRevoked records a revocation made through this gateway so it takes
+// effect immediately instead of after the cached entry expires.
+func (rc *RevocationCache) MarkRevoked(jti string, until time.Time) {
+	rc.store(jti, revocationEntry{revoked: true, expiresAt: until})
+}
+
+func (rc *RevocationCache) store(jti string, entry revocationEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rc.lastSweep) > rc.ttl {
+		for key, e := range rc.entries {
+			if now.After(e.expiresAt) {
+				delete(rc.entries, key)
+			}
+		}
+		rc.lastSweep = now
+	}
+	rc.entries[jti] = entry
+}
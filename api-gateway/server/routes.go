@@ -2,20 +2,81 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/wafi11/microservices/api-gateway/config"
 	"github.com/wafi11/microservices/api-gateway/internal/client"
 	"github.com/wafi11/microservices/api-gateway/internal/handler"
+	"github.com/wafi11/microservices/api-gateway/internal/oauth"
 	"github.com/wafi11/microservices/api-gateway/pkg"
 )
 
-func Routes(r *gin.Engine) {
-	userClient, _ := client.NewUserClient("localhost:50051")
-	userHandler := handler.NewUserHandler(userClient)
+// Routes registers every endpoint of the gateway. The caller owns
+// userClient and health so it can drain and close them on shutdown.
+func Routes(r *gin.Engine, cfg *config.Config, userClient *client.UserClient, health *handler.HealthHandler) error {
+	keys := pkg.NewJWKSCache(userClient, cfg.JWKSCacheTTL)
+	revocations := pkg.NewRevocationCache(userClient, cfg.RevocationCacheTTL)
+	cookies := pkg.Cookies{Domain: cfg.Cookie.Domain, Secure: cfg.Cookie.Secure}
+	userHandler := handler.NewUserHandler(userClient, keys, revocations, cookies)
+	adminHandler := handler.NewAdminHandler(userClient)
+	providers, err := oauth.LoadProviders(cfg.OAuth.ProvidersFile, cfg.OAuth.PublicURL)
+	if err != nil {
+		return err
+	}
+	authHandler := handler.NewAuthHandler(userClient, providers, keys, revocations, cookies, cfg.OAuth.RedirectURL)
+
+	r.GET("/healthz", health.Healthz)
+	r.GET("/readyz", health.Readyz)
+	r.GET("/.well-known/jwks.json", userHandler.JWKS)
+
+	auth := pkg.AuthMiddleware(keys, revocations)
+
+	// Public endpoints: registration, login and recovery.
+	public := r.Group("/api")
+	{
+		public.POST("/users", userHandler.CreateUser)
+		public.POST("/users/login", userHandler.LoginUser)
+		public.POST("/users/login/mfa", userHandler.VerifyMFA)
+		public.POST("/users/refresh", userHandler.RefreshToken)
+		public.POST("/users/logout", userHandler.Logout)
+		public.POST("/users/password/forgot", userHandler.ForgotPassword)
+		public.POST("/users/password/reset", userHandler.ResetPassword)
+		public.POST("/users/verify-email", userHandler.VerifyEmail)
+		public.POST("/users/verify-email/resend", userHandler.ResendVerification)
+		public.GET("/users/username-availability", userHandler.CheckUsername)
+		public.GET("/auth/:provider/start", authHandler.Start)
+		public.GET("/auth/:provider/callback", authHandler.Callback)
+	}
+
+	// Endpoints of the logged in user.
+	me := r.Group("/api/users/me", auth)
+	{
+		me.GET("", userHandler.FindMe)
+		me.PATCH("", userHandler.UpdateMe)
+		me.DELETE("", userHandler.DeleteMe)
+		me.PUT("/password", userHandler.ChangePassword)
+		me.PUT("/username", userHandler.ChangeUsername)
+		me.POST("/mfa", userHandler.EnrollTOTP)
+		me.POST("/mfa/confirm", userHandler.ConfirmTOTP)
+		me.DELETE("/mfa", userHandler.DisableTOTP)
+		me.GET("/identities", userHandler.ListIdentities)
+		me.DELETE("/identities/:provider", userHandler.UnlinkIdentity)
+		me.GET("/activity", userHandler.Activity)
+		me.GET("/sessions", userHandler.ListSessions)
+		me.DELETE("/sessions", userHandler.RevokeOtherSessions)
+		me.DELETE("/sessions/:id", userHandler.RevokeSession)
+	}
 
-	api := r.Group("/api")
+	// Admin endpoints need a role on top of a valid token, and each one the
+	// permission for what it does.
+	admin := r.Group("/api/admin", auth, pkg.RequireRole("admin", "support"))
 	{
-		api.POST("/users", userHandler.CreateUser)
-		api.POST("/users/login", userHandler.LoginUser)
-		users := api.Use(pkg.AuthMiddleware())
-		users.GET("/users/me", userHandler.FindMe)
+		admin.GET("/users", pkg.RequirePermission("users:read"), adminHandler.ListUsers)
+		admin.POST("/users/:id/restore", pkg.RequirePermission("users:write"), adminHandler.RestoreUser)
+		admin.POST("/users/:id/unlock", pkg.RequirePermission("users:write"), adminHandler.UnlockUser)
+		admin.GET("/audit-events", pkg.RequirePermission("audit:read"), adminHandler.ListAuditEvents)
+		admin.GET("/roles", pkg.RequirePermission("roles:manage"), adminHandler.ListRoles)
+		admin.GET("/users/:id/roles", pkg.RequirePermission("roles:manage"), adminHandler.UserRoles)
+		admin.POST("/users/:id/roles", pkg.RequirePermission("roles:manage"), adminHandler.AssignRole)
+		admin.DELETE("/users/:id/roles/:role", pkg.RequirePermission("roles:manage"), adminHandler.RevokeRole)
 	}
+	return nil
 }
@@ -1,38 +1,275 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/wafi11/microservices/users-services/config"
 	"github.com/wafi11/microservices/users-services/internal"
+	"github.com/wafi11/microservices/users-services/migrations"
 	"github.com/wafi11/microservices/users-services/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	db := config.NewDatabaseConfig()
-	conn, err := db.Connect()
+	cfg, args, err := config.Load(os.Args[1:])
 	if err != nil {
-		fmt.Println(err)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+
+	conn, err := openDatabase(cfg.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(cfg.Database, conn, args[1:]); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
+	if len(args) > 0 && args[0] != "roles" {
+		log.Fatalf("unknown command %q", args[0])
+	}
+
+	if cfg.Database.AutoMigrate && conn != nil {
+		migrator, err := newMigrator(cfg.Database, conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := migrator.Up(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	keys, err := internal.LoadKeySet(cfg.JWT.KeysDir, cfg.JWT.SigningKeyID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// setup dependencies
-	repo := internal.NewUserRepository(conn)
-	service := internal.NewUserService(repo)
+	repo := newRepository(cfg.Database, conn, newPasswordHasher(cfg.Password))
+	service := internal.NewUserService(repo, keys, newMailer(cfg.Mail), cfg.AppBaseURL, cfg.Deletion.GracePeriod, internal.LoginThrottle{
+		MaxAccountFailures: cfg.Login.MaxAccountFailures,
+		MaxIPFailures:      cfg.Login.MaxIPFailures,
+		BaseDelay:          cfg.Login.BaseDelay,
+		MaxDelay:           cfg.Login.MaxDelay,
+		LockoutDuration:    cfg.Login.LockoutDuration,
+		FailureWindow:      cfg.Login.FailureWindow,
+	}, internal.PasswordPolicy{
+		MinLength:           cfg.Password.MinLength,
+		MaxLength:           cfg.Password.MaxLength,
+		MinCharacterClasses: cfg.Password.MinCharacterClasses,
+		RejectCommon:        cfg.Password.RejectCommon,
+		HistorySize:         cfg.Password.HistorySize,
+		MaxAge:              cfg.Password.MaxAge,
+	})
+
+	if len(args) > 0 && args[0] == "roles" {
+		if err := runRoles(service, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Background work stops with the first SIGINT or SIGTERM; the gRPC
+	// server keeps draining in-flight calls until shutdown is done.
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
+
+	publisher := newPublisher(cfg.Events)
+	relay := internal.NewOutboxRelay(repo, publisher, cfg.Events.PollInterval, cfg.Events.BatchSize)
+	workers.Go(func() { relay.Run(c) })
+	workers.Go(func() { runMaintenance(c, repo, cfg) })
 
 	// gRPC server
-	lis, err := net.Listen("tcp", ":50051")
+	lis, err := net.Listen("tcp", cfg.GRPCAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	grpcServer := grpc.NewServer()
+	methodTimeouts, err := cfg.Calls.MethodTimeoutMap()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(internal.ServerOptions(internal.CallTimeouts{
+		Default: cfg.Calls.Timeout,
+		Methods: methodTimeouts,
+	})...)
 	proto.RegisterUserServiceServer(grpcServer, internal.NewGrpcServer(service))
 
-	log.Println("gRPC running on :50051")
-	if err := grpcServer.Serve(lis); err != nil {
+	// The memory driver has no database that could go away, so the default
+	// SERVING status of a new health server stays as it is.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(proto.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	if conn != nil {
+		monitor := internal.NewHealthMonitor(healthServer, conn, cfg.Database.HealthCheckInterval, cfg.Database.HealthCheckTimeout, proto.UserService_ServiceDesc.ServiceName)
+		workers.Go(func() { monitor.Run(c) })
+	}
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	served := make(chan error, 1)
+	go func() { served <- grpcServer.Serve(lis) }()
+	log.Printf("gRPC running on %s", cfg.GRPCAddr)
+
+	select {
+	case err := <-served:
 		log.Fatal(err)
+	case <-c.Done():
+	}
+	// A second signal kills the process instead of waiting for the drain.
+	stop()
+	log.Println("shutting down")
+
+	// Report NOT_SERVING before draining so health checking clients stop
+	// sending new calls. Shutdown also ignores the status updates the health
+	// monitor may still make.
+	healthServer.Shutdown()
+	drainGRPC(grpcServer, cfg.ShutdownTimeout)
+
+	workers.Wait()
+	if closer, ok := publisher.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("could not close publisher: %v", err)
+		}
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			log.Printf("could not close database: %v", err)
+		}
+	}
+	log.Println("shutdown complete")
+}
+
+// drainGRPC stops accepting connections and waits for in-flight calls, up
+// to timeout, before closing whatever is still open.
+func drainGRPC(server *grpc.Server, timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Printf("in-flight calls did not finish within %s, closing them", timeout)
+		server.Stop()
+		<-drained
+	}
+}
+
+// runMaintenance prunes expired rows and purges deleted accounts every hour
+// until c is cancelled.
+func runMaintenance(c context.Context, repo internal.Repository, cfg *config.Config) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := repo.PruneRevokedTokens(c); err != nil {
+			log.Println(err)
+		}
+		if err := repo.PruneLoginFailures(c, cfg.Login.FailureWindow); err != nil {
+			log.Println(err)
+		}
+		if n, err := repo.PurgeDeletedUsers(c, cfg.Deletion.Retention); err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted users", n)
+		}
+		if err := repo.PruneOutbox(c, cfg.Events.Retention); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// openDatabase connects to the database of the configured driver. The memory
+// driver needs none and gets a nil *sql.DB.
+func openDatabase(cfg config.DatabaseConfig) (*sql.DB, error) {
+	switch cfg.Driver {
+	case "sqlite":
+		return internal.OpenSQLite(cfg.SQLitePath)
+	case "memory":
+		return nil, nil
+	default:
+		return cfg.Connect()
+	}
+}
+
+func newMigrator(cfg config.DatabaseConfig, conn *sql.DB) (*migrations.Migrator, error) {
+	switch cfg.Driver {
+	case "sqlite":
+		return migrations.NewSQLiteMigrator(conn)
+	case "memory":
+		return nil, errors.New("DB_DRIVER memory has no schema to migrate")
+	default:
+		return migrations.NewMigrator(conn)
+	}
+}
+
+func newRepository(cfg config.DatabaseConfig, conn *sql.DB, hasher internal.PasswordHasher) internal.Repository {
+	switch cfg.Driver {
+	case "sqlite":
+		return internal.NewSQLiteRepository(conn, hasher)
+	case "memory":
+		return internal.NewMemoryRepository(hasher)
+	default:
+		return internal.NewUserRepository(conn, hasher)
+	}
+}
+
+func newMailer(cfg config.MailConfig) internal.Mailer {
+	switch cfg.Driver {
+	case "smtp":
+		return internal.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.From)
+	case "memory":
+		return internal.NewMemoryMailer()
+	default:
+		return internal.NewFileMailer(cfg.Dir, cfg.From)
+	}
+}
+
+func newPasswordHasher(cfg config.PasswordConfig) internal.PasswordHasher {
+	if cfg.Hasher == "bcrypt" {
+		return internal.NewBcryptHasher(cfg.BcryptCost)
+	}
+	params := internal.DefaultArgon2Params
+	params.Memory = uint32(cfg.Argon2Memory)
+	params.Iterations = uint32(cfg.Argon2Iterations)
+	params.Parallelism = uint8(cfg.Argon2Parallelism)
+	return internal.NewArgon2idHasher(params)
+}
+
+func newPublisher(cfg config.EventsConfig) internal.Publisher {
+	switch cfg.Driver {
+	case "kafka":
+		return internal.NewKafkaPublisher(cfg.BrokerList(), cfg.Topic)
+	case "memory":
+		return internal.NewMemoryPublisher()
+	default:
+		return internal.LogPublisher{}
 	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wafi11/microservices/users-services/internal"
+)
+
+const rolesUsage = "usage: roles list [USER_ID] | assign USER_ID ROLE | revoke USER_ID ROLE"
+
+// runRoles manages roles from the command line, which is how the first admin
+// gets their role before anyone can use the admin endpoints.
+func runRoles(service *internal.UserService, args []string) error {
+	if len(args) == 0 {
+		return errors.New(rolesUsage)
+	}
+
+	var userId int32
+	if len(args) > 1 {
+		id, err := strconv.ParseInt(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid user id %q", args[1])
+		}
+		userId = int32(id)
+	}
+
+	c := context.Background()
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		roles, err := service.ListRoles(c, userId)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ROLE\tPERMISSIONS\tDESCRIPTION")
+		for _, role := range roles {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", role.Name, strings.Join(role.Permissions, ","), role.Description)
+		}
+		return w.Flush()
+	case args[0] == "assign" && len(args) == 3:
+		return service.AssignRole(c, userId, args[2])
+	case args[0] == "revoke" && len(args) == 3:
+		return service.RevokeRole(c, userId, args[2])
+	default:
+		return errors.New(rolesUsage)
+	}
+}
@@ -0,0 +1,382 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wafi11/microservices/users-services/proto"
+)
+
+type Config struct {
+	GRPCAddr   string
+	AppBaseURL string
+	// ShutdownTimeout is how long in-flight calls may take to finish after
+	// SIGINT or SIGTERM before they are cut off.
+	ShutdownTimeout time.Duration
+	Calls           CallConfig
+	Database        DatabaseConfig
+	JWT             JWTConfig
+	Mail            MailConfig
+	Deletion        DeletionConfig
+	Login           LoginConfig
+	Password        PasswordConfig
+	Events          EventsConfig
+}
+
+// CallConfig limits how long one gRPC call may run, so a stuck database
+// query cannot hold a request forever.
+type CallConfig struct {
+	// Timeout applies to every method without an entry in MethodTimeouts.
+	Timeout time.Duration
+	// MethodTimeouts is a comma separated list of Method=duration pairs,
+	// such as "ListUsers=30s,LoginUser=5s".
+	MethodTimeouts string
+}
+
+// MethodTimeoutMap parses MethodTimeouts, keyed by method name.
+func (cfg CallConfig) MethodTimeoutMap() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range strings.Split(cfg.MethodTimeouts, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		method, raw, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not Method=duration", entry)
+		}
+		method = strings.TrimSpace(method)
+		if !knownMethod(method) {
+			return nil, fmt.Errorf("unknown method %q", method)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", method, raw)
+		}
+		timeouts[method] = timeout
+	}
+	return timeouts, nil
+}
+
+func knownMethod(name string) bool {
+	for _, method := range proto.UserService_ServiceDesc.Methods {
+		if method.MethodName == name {
+			return true
+		}
+	}
+	return false
+}
+
+type PasswordConfig struct {
+	MinLength           int
+	MaxLength           int
+	MinCharacterClasses int
+	RejectCommon        bool
+	// HistorySize is how many previous passwords cannot be reused; 0
+	// disables the check.
+	HistorySize int
+	// MaxAge makes passwords expire; 0 disables expiry.
+	MaxAge time.Duration
+
+	// Hasher is argon2id or bcrypt. Hashes of the other kind keep working
+	// and are upgraded on the next login.
+	Hasher            string
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+	BcryptCost        int
+}
+
+type EventsConfig struct {
+	// Driver is kafka, log or memory.
+	Driver string
+	// Brokers is a comma separated list of Kafka bootstrap addresses.
+	Brokers      string
+	Topic        string
+	PollInterval time.Duration
+	BatchSize    int
+	// Retention is how long published events stay in the outbox.
+	Retention time.Duration
+}
+
+// BrokerList splits Brokers into addresses, ignoring empty entries.
+func (cfg EventsConfig) BrokerList() []string {
+	var brokers []string
+	for _, broker := range strings.Split(cfg.Brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+type LoginConfig struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	LockoutDuration    time.Duration
+	FailureWindow      time.Duration
+}
+
+type DeletionConfig struct {
+	// GracePeriod is how long a deleted account can be restored.
+	GracePeriod time.Duration
+	// Retention is how long a deleted account is kept before its personal
+	// data is purged.
+	Retention time.Duration
+}
+
+type JWTConfig struct {
+	KeysDir      string
+	SigningKeyID string
+}
+
+type MailConfig struct {
+	// Driver is smtp, file or memory.
+	Driver       string
+	From         string
+	Dir          string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// Load builds the service configuration from defaults, the env file,
+// environment variables and command-line flags, and validates the result.
+// Positional arguments left after the flags are returned for subcommands.
+func Load(args []string) (*Config, []string, error) {
+	cfg := &Config{}
+	l := newLoader("users-services")
+
+	l.stringVar(&cfg.GRPCAddr, "grpc-addr", "GRPC_ADDR", ":50051", "address the gRPC server listens on")
+	l.durationVar(&cfg.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", 15*time.Second, "how long in-flight calls may run after a shutdown signal")
+	l.durationVar(&cfg.Calls.Timeout, "grpc-timeout", "GRPC_TIMEOUT", 10*time.Second, "how long a gRPC call may run")
+	l.stringVar(&cfg.Calls.MethodTimeouts, "grpc-method-timeouts", "GRPC_METHOD_TIMEOUTS", "", "comma separated Method=duration overrides of GRPC_TIMEOUT")
+	l.stringVar(&cfg.AppBaseURL, "app-base-url", "APP_BASE_URL", "http://localhost:3000", "public URL of the frontend, used in emailed links")
+
+	l.stringVar(&cfg.Database.Driver, "db-driver", "DB_DRIVER", "postgres", "where users are stored: postgres, sqlite or memory")
+	l.stringVar(&cfg.Database.SQLitePath, "sqlite-path", "SQLITE_PATH", "users.db", "sqlite database file, created if missing")
+	l.stringVar(&cfg.Database.Host, "db-host", "DB_HOST", "localhost", "postgres host")
+	l.intVar(&cfg.Database.Port, "db-port", "DB_PORT", 5432, "postgres port")
+	l.stringVar(&cfg.Database.Database, "db-name", "DB_NAME", "microservices", "postgres database name")
+	l.stringVar(&cfg.Database.Username, "db-username", "DB_USERNAME", "postgres", "postgres user")
+	l.stringVar(&cfg.Database.Password, "db-password", "DB_PASSWORD", "", "postgres password")
+	l.stringVar(&cfg.Database.SSLMode, "db-sslmode", "DB_SSLMODE", "require", "postgres sslmode (disable, require, verify-ca, verify-full)")
+	l.boolVar(&cfg.Database.AutoMigrate, "db-auto-migrate", "DB_AUTO_MIGRATE", false, "apply pending migrations before serving")
+	l.durationVar(&cfg.Database.HealthCheckInterval, "db-health-check-interval", "DB_HEALTH_CHECK_INTERVAL", 5*time.Second, "how often the database is pinged for the gRPC health status")
+	l.durationVar(&cfg.Database.HealthCheckTimeout, "db-health-check-timeout", "DB_HEALTH_CHECK_TIMEOUT", 2*time.Second, "how long a database ping may take before the service reports NOT_SERVING")
+
+	l.stringVar(&cfg.JWT.KeysDir, "jwt-keys-dir", "JWT_KEYS_DIR", "", "directory with PEM encoded signing keys")
+	l.stringVar(&cfg.JWT.SigningKeyID, "jwt-signing-key-id", "JWT_SIGNING_KEY_ID", "", "key id used to sign new tokens, defaults to the newest key")
+
+	l.stringVar(&cfg.Mail.Driver, "mail-driver", "MAIL_DRIVER", "file", "how emails are delivered: smtp, file or memory")
+	l.stringVar(&cfg.Mail.From, "mail-from", "MAIL_FROM", "no-reply@localhost", "sender address of outgoing emails")
+	l.stringVar(&cfg.Mail.Dir, "mail-dir", "MAIL_DIR", "mail", "directory the file mail driver writes to")
+	l.stringVar(&cfg.Mail.SMTPHost, "smtp-host", "SMTP_HOST", "", "SMTP relay host")
+	l.intVar(&cfg.Mail.SMTPPort, "smtp-port", "SMTP_PORT", 587, "SMTP relay port")
+	l.stringVar(&cfg.Mail.SMTPUsername, "smtp-username", "SMTP_USERNAME", "", "SMTP username")
+	l.stringVar(&cfg.Mail.SMTPPassword, "smtp-password", "SMTP_PASSWORD", "", "SMTP password")
+
+	l.durationVar(&cfg.Deletion.GracePeriod, "deletion-grace-period", "DELETION_GRACE_PERIOD", 14*24*time.Hour, "how long a deleted account can be restored")
+	l.durationVar(&cfg.Deletion.Retention, "deletion-retention", "DELETION_RETENTION", 30*24*time.Hour, "how long a deleted account is kept before it is anonymised")
+
+	l.intVar(&cfg.Login.MaxAccountFailures, "login-max-account-failures", "LOGIN_MAX_ACCOUNT_FAILURES", 5, "failed logins on one account before it is locked")
+	l.intVar(&cfg.Login.MaxIPFailures, "login-max-ip-failures", "LOGIN_MAX_IP_FAILURES", 20, "failed logins from one client address before it is locked")
+	l.durationVar(&cfg.Login.BaseDelay, "login-base-delay", "LOGIN_BASE_DELAY", time.Second, "wait after the first failed login, doubled on every further failure")
+	l.durationVar(&cfg.Login.MaxDelay, "login-max-delay", "LOGIN_MAX_DELAY", 30*time.Second, "upper bound of the wait between failed logins")
+	l.durationVar(&cfg.Login.LockoutDuration, "login-lockout-duration", "LOGIN_LOCKOUT_DURATION", 15*time.Minute, "how long an account or address stays locked")
+	l.durationVar(&cfg.Login.FailureWindow, "login-failure-window", "LOGIN_FAILURE_WINDOW", 15*time.Minute, "how long a failed login counts towards a lockout")
+
+	l.intVar(&cfg.Password.MinLength, "password-min-length", "PASSWORD_MIN_LENGTH", 8, "shortest password users may choose, in characters")
+	l.intVar(&cfg.Password.MaxLength, "password-max-length", "PASSWORD_MAX_LENGTH", 128, "longest password users may choose, in bytes")
+	l.intVar(&cfg.Password.MinCharacterClasses, "password-min-character-classes", "PASSWORD_MIN_CHARACTER_CLASSES", 1, "how many of lower case, upper case, digits and symbols a password must mix")
+	l.boolVar(&cfg.Password.RejectCommon, "password-reject-common", "PASSWORD_REJECT_COMMON", true, "reject passwords from the bundled list of common passwords")
+	l.intVar(&cfg.Password.HistorySize, "password-history-size", "PASSWORD_HISTORY_SIZE", 0, "how many previous passwords cannot be reused, 0 to allow reuse")
+	l.durationVar(&cfg.Password.MaxAge, "password-max-age", "PASSWORD_MAX_AGE", 0, "how long a password is valid before it must be reset, 0 to never expire")
+	l.stringVar(&cfg.Password.Hasher, "password-hasher", "PASSWORD_HASHER", "argon2id", "algorithm for new password hashes: argon2id or bcrypt")
+	l.intVar(&cfg.Password.Argon2Memory, "argon2-memory", "ARGON2_MEMORY", 64*1024, "argon2id memory cost in KiB")
+	l.intVar(&cfg.Password.Argon2Iterations, "argon2-iterations", "ARGON2_ITERATIONS", 3, "argon2id time cost")
+	l.intVar(&cfg.Password.Argon2Parallelism, "argon2-parallelism", "ARGON2_PARALLELISM", 4, "argon2id lanes")
+	l.intVar(&cfg.Password.BcryptCost, "bcrypt-cost", "BCRYPT_COST", 12, "bcrypt cost when PASSWORD_HASHER is bcrypt")
+
+	l.stringVar(&cfg.Events.Driver, "events-driver", "EVENTS_DRIVER", "log", "where user lifecycle events are published: kafka, log or memory")
+	l.stringVar(&cfg.Events.Brokers, "kafka-brokers", "KAFKA_BROKERS", "localhost:9092", "comma separated Kafka bootstrap brokers")
+	l.stringVar(&cfg.Events.Topic, "kafka-user-events-topic", "KAFKA_USER_EVENTS_TOPIC", "users.events", "Kafka topic user lifecycle events are published to")
+	l.durationVar(&cfg.Events.PollInterval, "outbox-poll-interval", "OUTBOX_POLL_INTERVAL", time.Second, "how often the outbox is checked for new events")
+	l.intVar(&cfg.Events.BatchSize, "outbox-batch-size", "OUTBOX_BATCH_SIZE", 100, "events published per outbox round trip")
+	l.durationVar(&cfg.Events.Retention, "outbox-retention", "OUTBOX_RETENTION", 7*24*time.Hour, "how long published events are kept in the outbox")
+
+	rest, err := l.parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(cfg.GRPCAddr); err != nil {
+		errs = append(errs, fmt.Errorf("GRPC_ADDR: %v", err))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT: must be positive"))
+	}
+	if cfg.Calls.Timeout <= 0 {
+		errs = append(errs, errors.New("GRPC_TIMEOUT: must be positive"))
+	}
+	if _, err := cfg.Calls.MethodTimeoutMap(); err != nil {
+		errs = append(errs, fmt.Errorf("GRPC_METHOD_TIMEOUTS: %v", err))
+	}
+	if u, err := url.Parse(cfg.AppBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("APP_BASE_URL: %q is not an absolute URL", cfg.AppBaseURL))
+	}
+	switch cfg.Database.Driver {
+	case "postgres":
+		if cfg.Database.Host == "" {
+			errs = append(errs, errors.New("DB_HOST: must not be empty"))
+		}
+		if cfg.Database.Port < 1 || cfg.Database.Port > 65535 {
+			errs = append(errs, fmt.Errorf("DB_PORT: %d is not a valid port", cfg.Database.Port))
+		}
+		if cfg.Database.Database == "" {
+			errs = append(errs, errors.New("DB_NAME: must not be empty"))
+		}
+		if cfg.Database.Username == "" {
+			errs = append(errs, errors.New("DB_USERNAME: must not be empty"))
+		}
+		switch cfg.Database.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			errs = append(errs, fmt.Errorf("DB_SSLMODE: unknown mode %q", cfg.Database.SSLMode))
+		}
+	case "sqlite":
+		if cfg.Database.SQLitePath == "" {
+			errs = append(errs, errors.New("SQLITE_PATH: required when DB_DRIVER is sqlite"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("DB_DRIVER: unknown driver %q", cfg.Database.Driver))
+	}
+	if cfg.Database.HealthCheckInterval <= 0 {
+		errs = append(errs, errors.New("DB_HEALTH_CHECK_INTERVAL: must be positive"))
+	}
+	if cfg.Database.HealthCheckTimeout <= 0 {
+		errs = append(errs, errors.New("DB_HEALTH_CHECK_TIMEOUT: must be positive"))
+	}
+	if cfg.JWT.SigningKeyID != "" && cfg.JWT.KeysDir == "" {
+		errs = append(errs, errors.New("JWT_SIGNING_KEY_ID: requires JWT_KEYS_DIR"))
+	}
+
+	switch cfg.Mail.Driver {
+	case "smtp":
+		if cfg.Mail.SMTPHost == "" {
+			errs = append(errs, errors.New("SMTP_HOST: required when MAIL_DRIVER is smtp"))
+		}
+	case "file":
+		if cfg.Mail.Dir == "" {
+			errs = append(errs, errors.New("MAIL_DIR: required when MAIL_DRIVER is file"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("MAIL_DRIVER: unknown driver %q", cfg.Mail.Driver))
+	}
+
+	if cfg.Deletion.GracePeriod < 0 {
+		errs = append(errs, errors.New("DELETION_GRACE_PERIOD: must not be negative"))
+	}
+	if cfg.Deletion.Retention < cfg.Deletion.GracePeriod {
+		errs = append(errs, errors.New("DELETION_RETENTION: must not be shorter than DELETION_GRACE_PERIOD"))
+	}
+
+	if cfg.Login.MaxAccountFailures < 1 {
+		errs = append(errs, errors.New("LOGIN_MAX_ACCOUNT_FAILURES: must be positive"))
+	}
+	if cfg.Login.MaxIPFailures < 1 {
+		errs = append(errs, errors.New("LOGIN_MAX_IP_FAILURES: must be positive"))
+	}
+	if cfg.Login.BaseDelay < 0 || cfg.Login.MaxDelay < cfg.Login.BaseDelay {
+		errs = append(errs, errors.New("LOGIN_MAX_DELAY: must not be shorter than LOGIN_BASE_DELAY"))
+	}
+	if cfg.Login.LockoutDuration <= 0 {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_DURATION: must be positive"))
+	}
+	if cfg.Login.FailureWindow <= 0 {
+		errs = append(errs, errors.New("LOGIN_FAILURE_WINDOW: must be positive"))
+	}
+
+	if cfg.Password.MinLength < 1 {
+		errs = append(errs, errors.New("PASSWORD_MIN_LENGTH: must be positive"))
+	}
+	// bcrypt silently ignores everything after 72 bytes; with argon2id the
+	// bound only keeps hashing cheap enough.
+	maxLength := 1024
+	if cfg.Password.Hasher == "bcrypt" {
+		maxLength = 72
+	}
+	if cfg.Password.MaxLength < cfg.Password.MinLength || cfg.Password.MaxLength > maxLength {
+		errs = append(errs, fmt.Errorf("PASSWORD_MAX_LENGTH: must be between PASSWORD_MIN_LENGTH and %d", maxLength))
+	}
+	if cfg.Password.MinCharacterClasses < 1 || cfg.Password.MinCharacterClasses > 4 {
+		errs = append(errs, errors.New("PASSWORD_MIN_CHARACTER_CLASSES: must be between 1 and 4"))
+	}
+	if cfg.Password.HistorySize < 0 {
+		errs = append(errs, errors.New("PASSWORD_HISTORY_SIZE: must not be negative"))
+	}
+	if cfg.Password.MaxAge < 0 {
+		errs = append(errs, errors.New("PASSWORD_MAX_AGE: must not be negative"))
+	}
+	switch cfg.Password.Hasher {
+	case "argon2id":
+		if cfg.Password.Argon2Memory < 8*cfg.Password.Argon2Parallelism {
+			errs = append(errs, errors.New("ARGON2_MEMORY: must be at least 8 KiB per lane"))
+		}
+		if cfg.Password.Argon2Iterations < 1 {
+			errs = append(errs, errors.New("ARGON2_ITERATIONS: must be positive"))
+		}
+		if cfg.Password.Argon2Parallelism < 1 || cfg.Password.Argon2Parallelism > 255 {
+			errs = append(errs, errors.New("ARGON2_PARALLELISM: must be between 1 and 255"))
+		}
+	case "bcrypt":
+		if cfg.Password.BcryptCost < 10 || cfg.Password.BcryptCost > 31 {
+			errs = append(errs, errors.New("BCRYPT_COST: must be between 10 and 31"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("PASSWORD_HASHER: unknown hasher %q", cfg.Password.Hasher))
+	}
+
+	switch cfg.Events.Driver {
+	case "kafka":
+		if len(cfg.Events.BrokerList()) == 0 {
+			errs = append(errs, errors.New("KAFKA_BROKERS: required when EVENTS_DRIVER is kafka"))
+		}
+		if cfg.Events.Topic == "" {
+			errs = append(errs, errors.New("KAFKA_USER_EVENTS_TOPIC: required when EVENTS_DRIVER is kafka"))
+		}
+	case "log", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("EVENTS_DRIVER: unknown driver %q", cfg.Events.Driver))
+	}
+	if cfg.Events.PollInterval <= 0 {
+		errs = append(errs, errors.New("OUTBOX_POLL_INTERVAL: must be positive"))
+	}
+	if cfg.Events.BatchSize < 1 {
+		errs = append(errs, errors.New("OUTBOX_BATCH_SIZE: must be positive"))
+	}
+	if cfg.Events.Retention <= 0 {
+		errs = append(errs, errors.New("OUTBOX_RETENTION: must be positive"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
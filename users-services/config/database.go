@@ -4,39 +4,52 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type DatabaseConfig struct {
+	// Driver is postgres, sqlite or memory. Postgres is the only one meant
+	// for more than one instance; memory keeps nothing across restarts.
+	Driver     string
+	SQLitePath string
+
 	Host     string
 	Port     int
 	Username string
 	Password string
 	Database string
+	SSLMode  string
+
+	// AutoMigrate applies pending migrations on startup.
+	AutoMigrate bool
+
+	// HealthCheckInterval is how often the database is pinged to keep the
+	// gRPC health status current; a ping slower than HealthCheckTimeout
+	// counts as a failure.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
 }
 
-func NewDatabaseConfig() *DatabaseConfig {
-	return &DatabaseConfig{
-		Host:     "192.168.1.20",
-		Port:     5432,
-		Username: "postgres",
-		Password: "password",
-		Database: "microservices",
+// DSN returns the postgres connection URL. Building it as a URL escapes
+// every part, so passwords may contain spaces, quotes or '@'.
+func (dbs *DatabaseConfig) DSN() string {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(dbs.Username, dbs.Password),
+		Host:     net.JoinHostPort(dbs.Host, strconv.Itoa(dbs.Port)),
+		Path:     "/" + dbs.Database,
+		RawQuery: url.Values{"sslmode": {dbs.SSLMode}}.Encode(),
 	}
+	return dsn.String()
 }
 
 func (dbs *DatabaseConfig) Connect() (*sql.DB, error) {
-	dsn := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=require",
-		dbs.Host,
-		dbs.Port,
-		dbs.Username,
-		dbs.Password,
-		dbs.Database,
-	)
-
-	db, err := sql.Open("postgres", dsn)
+	db, err := sql.Open("postgres", dbs.DSN())
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestDatabaseDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DatabaseConfig
+		want string
+	}{
+		{
+			name: "plain values",
+			cfg:  DatabaseConfig{Host: "localhost", Port: 5432, Username: "postgres", Password: "secret", Database: "microservices", SSLMode: "require"},
+			want: "dbname='microservices' host='localhost' password='secret' port='5432' sslmode='require' user='postgres'",
+		},
+		{
+			name: "password with spaces and quotes",
+			cfg:  DatabaseConfig{Host: "db", Port: 5432, Username: "users", Password: `it's a "pass" word`, Database: "microservices", SSLMode: "disable"},
+			want: `dbname='microservices' host='db' password='it\'s a "pass" word' port='5432' sslmode='disable' user='users'`,
+		},
+		{
+			name: "password that looks like other keys",
+			cfg:  DatabaseConfig{Host: "db", Port: 5432, Username: "users", Password: "x sslmode=disable host=evil", Database: "microservices", SSLMode: "verify-full"},
+			want: "dbname='microservices' host='db' password='x sslmode=disable host=evil' port='5432' sslmode='verify-full' user='users'",
+		},
+		{
+			name: "URL delimiters",
+			cfg:  DatabaseConfig{Host: "db", Port: 6432, Username: "us@er", Password: "p@ss/w:rd?#%", Database: "users db", SSLMode: "require"},
+			want: "dbname='users db' host='db' password='p@ss/w:rd?#%' port='6432' sslmode='require' user='us@er'",
+		},
+		{
+			name: "IPv6 host",
+			cfg:  DatabaseConfig{Host: "::1", Port: 5432, Username: "postgres", Password: "secret", Database: "microservices", SSLMode: "disable"},
+			want: "dbname='microservices' host='::1' password='secret' port='5432' sslmode='disable' user='postgres'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// ParseURL turns the URL into the key=value form lib/pq uses.
+			got, err := pq.ParseURL(tt.cfg.DSN())
+			if err != nil {
+				t.Fatalf("ParseURL(%q) = %v", tt.cfg.DSN(), err)
+			}
+			if got != tt.want {
+				t.Errorf("DSN() = %q\nparses to %s\nwant      %s", tt.cfg.DSN(), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrRestoreWindowExpired = errors.New("account can no longer be restored")
+
+// DeleteAccount soft deletes the user after checking their password and
+// revokes every token issued to them.
+func (r *UserRepository) DeleteAccount(c context.Context, userID int32, password string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var hashedPassword string
+	err = tx.QueryRowContext(c, `
+		SELECT coalesce(password, '') FROM users WHERE id = $1 AND is_deleted = false FOR UPDATE;
+	`, userID).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("could not query user: %v", err)
+	}
+
+	if hashedPassword == "" {
+		return ErrPasswordNotSet
+	}
+	if err := r.hasher.Verify(hashedPassword, password); err != nil {
+		return ErrIncorrectPassword
+	}
+
+	now := time.Now()
+	if _, err := tx.ExecContext(c, `
+		UPDATE users SET is_deleted = true, deleted_at = $2, updated_at = $2 WHERE id = $1;
+	`, userID, now); err != nil {
+		return fmt.Errorf("could not delete user: %v", err)
+	}
+	if err := enqueueUserDeleted(c, tx, userID, now, false); err != nil {
+		return err
+	}
+
+	if err := revokeUserTokens(c, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// RestoreUser undoes a soft delete made less than gracePeriod ago. Tokens
+// stay revoked, so the user has to log in again.
+func (r *UserRepository) RestoreUser(c context.Context, userID int32, gracePeriod time.Duration) (*User, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET is_deleted = false, deleted_at = NULL, updated_at = $2
+		WHERE id = $1
+		AND is_deleted = true
+		AND purged_at IS NULL
+		AND deleted_at > $3
+		RETURNING ` + userColumns + `;
+    `
+	now := time.Now()
+	user, err := scanUser(tx.QueryRowContext(c, query, userID, now, now.Add(-gracePeriod)))
+	if err == nil {
+		if err := enqueueUserEvent(c, tx, EventUserUpdated, user); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("could not commit transaction: %v", err)
+		}
+		return user, nil
+	}
+	if uerr := uniqueViolation(err); uerr != nil {
+		// Someone registered the email while the account was deleted.
+		return nil, uerr
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("could not restore user: %v", err)
+	}
+
+	var deleted bool
+	err = tx.QueryRowContext(c, `SELECT is_deleted FROM users WHERE id = $1;`, userID).Scan(&deleted)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("could not query user: %v", err)
+	}
+	if !deleted {
+		return nil, ErrUserNotFound
+	}
+	return nil, ErrRestoreWindowExpired
+}
+
+// PurgeDeletedUsers anonymises accounts deleted more than retention ago.
+// The row is kept so ids referenced elsewhere stay valid, but every piece of
+// personal data is cleared and the credentials are dropped for good. The
+// user's audit events lose their client address, user agent and any names.
+func (r *UserRepository) PurgeDeletedUsers(c context.Context, retention time.Duration) (int64, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.QueryContext(c, `
+		UPDATE users SET
+		    full_name = NULL,
+		    username = NULL,
+		    email = NULL,
+		    password = NULL,
+		    password_changed_at = NULL,
+		    phone_number = NULL,
+		    bio = NULL,
+		    avatar_url = NULL,
+		    locale = NULL,
+		    timezone = NULL,
+		    date_of_birth = NULL,
+		    purged_at = $1,
+		    updated_at = $1
+		WHERE is_deleted = true
+		AND purged_at IS NULL
+		AND deleted_at < $2
+		RETURNING id, deleted_at;
+	`, now, now.Add(-retention))
+	if err != nil {
+		return 0, fmt.Errorf("could not purge users: %v", err)
+	}
+	var ids []int32
+	deletedAt := make(map[int32]time.Time)
+	for rows.Next() {
+		var id int32
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan purged user: %v", err)
+		}
+		ids = append(ids, id)
+		deletedAt[id] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not purge users: %v", err)
+	}
+
+	redactedAuditDetails := `details - array['email', 'username']`
+	if r.sqlite {
+		redactedAuditDetails = `json_remove(details, '$.email', '$.username')`
+	}
+	for _, id := range ids {
+		// Deleting the sessions takes their refresh tokens with them.
+		if _, err := tx.ExecContext(c, `DELETE FROM sessions WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge sessions: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM identities WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge identities: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM password_resets WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge password resets: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM password_history WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge password history: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM username_history WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge username history: %v", err)
+		}
+		// The user row is kept, so the cascade from users never removes the
+		// second factor.
+		if _, err := tx.ExecContext(c, `DELETE FROM user_totp WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge totp secret: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM recovery_codes WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge recovery codes: %v", err)
+		}
+		if _, err := tx.ExecContext(c, `DELETE FROM user_roles WHERE user_id = $1;`, id); err != nil {
+			return 0, fmt.Errorf("could not purge roles: %v", err)
+		}
+		// Audit events are kept, but only the ids may still point at the
+		// user; the append-only trigger allows exactly this update.
+		if _, err := tx.ExecContext(c, `
+			UPDATE audit_events SET ip_address = NULL, user_agent = NULL, details = `+redactedAuditDetails+`
+			WHERE actor_id = $1 OR target_id = $1;
+		`, id); err != nil {
+			return 0, fmt.Errorf("could not redact audit events: %v", err)
+		}
+		if err := enqueueUserDeleted(c, tx, id, deletedAt[id], true); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return int64(len(ids)), nil
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		password := "correct horse battery staple"
+		var ids []int32
+		for i, email := range []string{"purged@example.com", "kept@example.com"} {
+			user, err := repo.RegisterUser(c, UserRegister{FullName: "Deleted", Username: fmt.Sprintf("deleted%d", i), Email: email, Password: &password, PhoneNumber: fmt.Sprintf("+62819000000%d", i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.AssignRole(c, user.ID, "support"); err != nil {
+				t.Fatal(err)
+			}
+			// Events written before emails were kept out of details.
+			if err := repo.InsertAuditEvent(c, AuditEvent{
+				Type:      AuditUserRegistered,
+				ActorID:   user.ID,
+				TargetID:  user.ID,
+				IPAddress: "203.0.113.7",
+				UserAgent: "curl/8.0",
+				Outcome:   AuditSuccess,
+				Details:   map[string]string{"email": email, "username": user.Username, "method": "password"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, user.ID)
+		}
+		purged, kept := ids[0], ids[1]
+
+		if err := repo.DeleteAccount(c, purged, password); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		n, err := repo.PurgeDeletedUsers(c, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("PurgeDeletedUsers() = %d, want 1", n)
+		}
+
+		tests := []struct {
+			name      string
+			userId    int32
+			wantRoles int
+			wantIP    string
+			wantAgent string
+			wantEmail bool
+		}{
+			{"purged user", purged, 0, "", "", false},
+			{"other user", kept, 1, "203.0.113.7", "curl/8.0", true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				roles, err := repo.ListRoles(c, tt.userId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(roles) != tt.wantRoles {
+					t.Errorf("ListRoles() = %v, want %d roles", roles, tt.wantRoles)
+				}
+
+				page, err := repo.ListAuditEvents(c, AuditFilter{UserID: tt.userId, Type: AuditUserRegistered, PageSize: 10})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Events) != 1 {
+					t.Fatalf("ListAuditEvents() = %+v, want one event", page.Events)
+				}
+				event := page.Events[0]
+				if event.ActorID != tt.userId || event.TargetID != tt.userId {
+					t.Errorf("event ids = %d/%d, want %d", event.ActorID, event.TargetID, tt.userId)
+				}
+				if event.IPAddress != tt.wantIP || event.UserAgent != tt.wantAgent {
+					t.Errorf("event client = %q/%q, want %q/%q", event.IPAddress, event.UserAgent, tt.wantIP, tt.wantAgent)
+				}
+				_, hasEmail := event.Details["email"]
+				_, hasUsername := event.Details["username"]
+				if hasEmail != tt.wantEmail || hasUsername != tt.wantEmail {
+					t.Errorf("event details = %v, names kept = %v", event.Details, tt.wantEmail)
+				}
+				if event.Details["method"] != "password" {
+					t.Errorf("event details = %v, want the method kept", event.Details)
+				}
+			})
+		}
+	})
+}
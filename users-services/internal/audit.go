@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Audit event types. They are stored as plain strings, so existing values
+// must never be renamed.
+const (
+	AuditUserRegistered   = "user.registered"
+	AuditEmailVerified    = "user.email_verified"
+	AuditLogin            = "user.login"
+	AuditLoginMFA         = "user.login_mfa"
+	AuditProfileUpdated   = "user.profile_updated"
+	AuditUsernameChanged  = "user.username_changed"
+	AuditPasswordChanged  = "user.password_changed"
+	AuditPasswordReset    = "user.password_reset"
+	AuditResetRequested   = "user.password_reset_requested"
+	AuditAccountDeleted   = "user.deleted"
+	AuditAccountRestored  = "user.restored"
+	AuditAccountUnlocked  = "user.unlocked"
+	AuditMFAEnabled       = "mfa.enabled"
+	AuditMFADisabled      = "mfa.disabled"
+	AuditIdentityLinked   = "identity.linked"
+	AuditIdentityUnlinked = "identity.unlinked"
+	AuditRoleAssigned     = "role.assigned"
+	AuditRoleRevoked      = "role.revoked"
+	AuditSessionRevoked   = "session.revoked"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Metadata set by the gateway for the audit log: the authenticated caller
+// and the id of the HTTP request that led to the call. Calls without a
+// request id get one from the request id interceptor.
+const (
+	actorMetadataKey     = "x-actor-id"
+	requestIDMetadataKey = "x-request-id"
+)
+
+// AuditEvent is one entry of the append-only audit log. ActorID is who did
+// it and TargetID whose account it concerns; zero means unknown. Details
+// must not name people, by email or otherwise: the ids are enough, and
+// events outlive purged accounts.
+type AuditEvent struct {
+	ID         int64             `json:"id"`
+	OccurredAt time.Time         `json:"occurredAt"`
+	Type       string            `json:"type"`
+	ActorID    int32             `json:"actorId,omitempty"`
+	TargetID   int32             `json:"targetId,omitempty"`
+	IPAddress  string            `json:"ipAddress,omitempty"`
+	UserAgent  string            `json:"userAgent,omitempty"`
+	Outcome    string            `json:"outcome"`
+	RequestID  string            `json:"requestId,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditFilter narrows down ListAuditEvents. Empty fields do not filter.
+type AuditFilter struct {
+	// UserID matches events where the user is either actor or target.
+	UserID    int32
+	TargetID  int32
+	Type      string
+	Outcome   string
+	Since     *time.Time
+	Until     *time.Time
+	PageSize  int
+	PageToken string
+}
+
+type AuditPage struct {
+	Events        []AuditEvent
+	NextPageToken string
+}
+
+func (f *AuditFilter) Validate() error {
+	if f.Outcome != "" && f.Outcome != AuditSuccess && f.Outcome != AuditFailure {
+		return errors.New("outcome must be success or failure")
+	}
+	if f.PageSize < 0 {
+		return errors.New("page_size must not be negative")
+	}
+	if f.PageSize == 0 {
+		f.PageSize = defaultPageSize
+	}
+	if f.PageSize > maxPageSize {
+		f.PageSize = maxPageSize
+	}
+	if f.Since != nil && f.Until != nil && !f.Since.Before(*f.Until) {
+		return errors.New("since must be before until")
+	}
+	return nil
+}
+
+// audit records event, completing it with the client details the gateway
+// forwarded. The audit log must not break the action it describes, so
+// failures are only logged.
+func (service *UserService) audit(c context.Context, event AuditEvent) {
+	client := clientInfo(c)
+	event.IPAddress, event.UserAgent = client.IP, client.UserAgent
+	event.RequestID = RequestID(c)
+	if md, ok := metadata.FromIncomingContext(c); ok {
+		if values := md.Get(actorMetadataKey); len(values) > 0 && event.ActorID == 0 {
+			if actor, err := strconv.Atoi(values[0]); err == nil {
+				event.ActorID = int32(actor)
+			}
+		}
+	}
+	if event.Outcome == "" {
+		event.Outcome = AuditSuccess
+	}
+
+	// The caller may already be cancelled, e.g. after a failed login the
+	// client hung up; the event should be written regardless.
+	c, cancel := context.WithTimeout(context.WithoutCancel(c), 5*time.Second)
+	defer cancel()
+	if err := service.Repo.InsertAuditEvent(c, event); err != nil {
+		log.Printf("could not write audit event %s: %v", event.Type, err)
+	}
+}
+
+// auditResult records event as a success when err is nil, or as a failure
+// when err is one of failures. Other errors are outages rather than
+// security events and are not recorded.
+func (service *UserService) auditResult(c context.Context, event AuditEvent, err error, failures ...error) {
+	if err == nil {
+		service.audit(c, event)
+		return
+	}
+	for _, failure := range failures {
+		if errors.Is(err, failure) {
+			event.Outcome = AuditFailure
+			if event.Details == nil {
+				event.Details = make(map[string]string)
+			}
+			event.Details["reason"] = err.Error()
+			service.audit(c, event)
+			return
+		}
+	}
+}
+
+func (r *UserRepository) InsertAuditEvent(c context.Context, event AuditEvent) error {
+	var details []byte
+	if len(event.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(event.Details); err != nil {
+			return fmt.Errorf("could not marshal audit details: %v", err)
+		}
+	}
+
+	query := `
+		insert into audit_events (
+		    occurred_at,
+		    event_type,
+		    actor_id,
+		    target_id,
+		    ip_address,
+		    user_agent,
+		    outcome,
+		    request_id,
+		    details
+		) values (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9
+		)
+    `
+	_, err := r.db.ExecContext(c, query,
+		time.Now(),
+		event.Type,
+		sql.NullInt32{Int32: event.ActorID, Valid: event.ActorID != 0},
+		sql.NullInt32{Int32: event.TargetID, Valid: event.TargetID != 0},
+		nullIfEmpty(truncate(event.IPAddress, 64)),
+		nullIfEmpty(truncate(event.UserAgent, 512)),
+		event.Outcome,
+		nullIfEmpty(truncate(event.RequestID, 64)),
+		nullIfEmpty(string(details)),
+	)
+	if err != nil {
+		return fmt.Errorf("could not insert audit event: %v", err)
+	}
+	return nil
+}
+
+func encodeAuditPageToken(lastId int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(lastId, 10)))
+}
+
+func decodeAuditPageToken(token string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidPageToken
+	}
+	lastId, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidPageToken
+	}
+	return lastId, nil
+}
+
+// ListAuditEvents returns one page of events, newest first. The page token
+// is the id of the last event returned.
+func (r *UserRepository) ListAuditEvents(c context.Context, filter AuditFilter) (*AuditPage, error) {
+	var where []string
+	var args []any
+	cond := func(format string, value any) {
+		args = append(args, value)
+		where = append(where, strings.ReplaceAll(format, "$?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	if filter.UserID != 0 {
+		cond("(actor_id = $? OR target_id = $?)", filter.UserID)
+	}
+	if filter.TargetID != 0 {
+		cond("target_id = $?", filter.TargetID)
+	}
+	if filter.Type != "" {
+		cond("event_type = $?", filter.Type)
+	}
+	if filter.Outcome != "" {
+		cond("outcome = $?", filter.Outcome)
+	}
+	if filter.Since != nil {
+		cond("occurred_at >= $?", *filter.Since)
+	}
+	if filter.Until != nil {
+		cond("occurred_at < $?", *filter.Until)
+	}
+	if filter.PageToken != "" {
+		lastId, err := decodeAuditPageToken(filter.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		cond("id < $?", lastId)
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	// One extra row tells whether there is a next page.
+	args = append(args, filter.PageSize+1)
+	query := fmt.Sprintf(`
+		SELECT id, occurred_at, event_type, coalesce(actor_id, 0), coalesce(target_id, 0),
+		       coalesce(ip_address, ''), coalesce(user_agent, ''), outcome,
+		       coalesce(request_id, ''), details
+		FROM audit_events %s
+		ORDER BY id DESC
+		LIMIT $%d;
+	`, whereClause, len(args))
+
+	rows, err := r.db.QueryContext(c, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list audit events: %v", err)
+	}
+	defer rows.Close()
+
+	page := &AuditPage{Events: []AuditEvent{}}
+	for rows.Next() {
+		var event AuditEvent
+		var details []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.OccurredAt,
+			&event.Type,
+			&event.ActorID,
+			&event.TargetID,
+			&event.IPAddress,
+			&event.UserAgent,
+			&event.Outcome,
+			&event.RequestID,
+			&details,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan audit event: %v", err)
+		}
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &event.Details); err != nil {
+				return nil, fmt.Errorf("could not parse audit details: %v", err)
+			}
+		}
+		page.Events = append(page.Events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not list audit events: %v", err)
+	}
+
+	if len(page.Events) > filter.PageSize {
+		page.Events = page.Events[:filter.PageSize]
+		page.NextPageToken = encodeAuditPageToken(page.Events[len(page.Events)-1].ID)
+	}
+	return page, nil
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAuditEventsHoldNoEmail(t *testing.T) {
+	const email = "audited@example.com"
+
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		keys, err := LoadKeySet("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := NewUserService(repo, keys, NewMemoryMailer(), "http://localhost", 0, LoginThrottle{}, PasswordPolicy{})
+
+		password := "correct horse battery staple"
+		if _, err := service.RegisterUser(c, UserRegister{FullName: "Audited", Email: email, Password: &password, PhoneNumber: "+628180000001"}); err != nil {
+			t.Fatal(err)
+		}
+		service.LoginUser(c, email, "wrong password", ClientInfo{})
+		service.LoginUser(c, "nobody@example.com", "wrong password", ClientInfo{})
+
+		page, err := service.ListAuditEvents(c, AuditFilter{PageSize: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Events) == 0 {
+			t.Fatal("no audit events were written")
+		}
+		for _, event := range page.Events {
+			for key, value := range event.Details {
+				if strings.Contains(value, "@") {
+					t.Errorf("%s event holds %s=%q", event.Type, key, value)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Pinger is the part of *sql.DB HealthMonitor needs.
+type Pinger interface {
+	PingContext(c context.Context) error
+}
+
+// HealthMonitor keeps the grpc.health.v1 status of users-service in line
+// with its database. While the database does not answer, the overall status
+// and that of every monitored service is NOT_SERVING, so load balancers and
+// the gateway stop sending requests that could only fail.
+type HealthMonitor struct {
+	server   *health.Server
+	db       Pinger
+	interval time.Duration
+	timeout  time.Duration
+	services []string
+	status   healthpb.HealthCheckResponse_ServingStatus
+}
+
+// NewHealthMonitor monitors db for the overall status ("") and for services.
+func NewHealthMonitor(server *health.Server, db Pinger, interval, timeout time.Duration, services ...string) *HealthMonitor {
+	return &HealthMonitor{
+		server:   server,
+		db:       db,
+		interval: interval,
+		timeout:  timeout,
+		services: append([]string{""}, services...),
+	}
+}
+
+// Run pings the database right away and then every interval until c is
+// cancelled.
+func (m *HealthMonitor) Run(c context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(c)
+
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *HealthMonitor) check(c context.Context) {
+	ctx, cancel := context.WithTimeout(c, m.timeout)
+	err := m.db.PingContext(ctx)
+	cancel()
+	if c.Err() != nil {
+		return
+	}
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if status == m.status {
+		return
+	}
+	if err != nil {
+		log.Printf("database is unreachable, reporting NOT_SERVING: %v", err)
+	} else if m.status != healthpb.HealthCheckResponse_UNKNOWN {
+		log.Println("database is reachable again, reporting SERVING")
+	}
+	m.status = status
+	for _, service := range m.services {
+		m.server.SetServingStatus(service, status)
+	}
+}
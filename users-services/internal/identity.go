@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrIdentityTaken         = errors.New("identity is already linked to another account")
+	ErrIdentityNotFound      = errors.New("identity not found")
+	ErrExternalEmailRequired = errors.New("the provider did not return a verified email")
+	ErrLastLoginMethod       = errors.New("cannot unlink the only way to log in; set a password first")
+)
+
+// ExternalIdentity is a user as asserted by an OAuth2/OIDC provider after
+// the gateway completed the authorization code flow.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FullName      string
+}
+
+type Identity struct {
+	Provider    string     `json:"provider"`
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+}
+
+// FindOrCreateExternalUser returns the user an external identity belongs
+// to. Unknown identities are linked to the account with the same verified
+// email, or get a new account.
+func (r *UserRepository) FindOrCreateExternalUser(c context.Context, ext ExternalIdentity) (int32, error) {
+	for attempt := 1; ; attempt++ {
+		userId, err := r.findOrCreateExternalUser(c, ext)
+		if errors.Is(err, ErrUsernameTaken) && attempt < usernameAttempts {
+			// Someone took the derived name in the meantime.
+			continue
+		}
+		return userId, err
+	}
+}
+
+func (r *UserRepository) findOrCreateExternalUser(c context.Context, ext ExternalIdentity) (int32, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userId int32
+	err = tx.QueryRowContext(c, `
+		UPDATE identities SET last_login_at = $3
+		WHERE provider = $1 AND subject = $2
+		AND user_id IN (SELECT id FROM users WHERE is_deleted = false)
+		RETURNING user_id;
+	`, ext.Provider, ext.Subject, now).Scan(&userId)
+	if err == nil {
+		return userId, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("could not query identity: %v", err)
+	}
+
+	if ext.Email == "" || !ext.EmailVerified {
+		return 0, ErrExternalEmailRequired
+	}
+
+	var isActive bool
+	err = tx.QueryRowContext(c, `
+		SELECT id, coalesce(is_active, false) FROM users
+		WHERE email = $1 AND is_deleted = false
+		FOR UPDATE;
+	`, ext.Email).Scan(&userId, &isActive)
+	switch {
+	case err == nil:
+		if !isActive {
+			// Nobody proved they own this email before the provider did, so
+			// whoever registered it may not be its owner. Drop their password
+			// to keep them from getting into the now verified account.
+			if _, err := tx.ExecContext(c, `
+				UPDATE users SET is_active = true, password = NULL, password_changed_at = NULL, updated_at = $2 WHERE id = $1;
+			`, userId, now); err != nil {
+				return 0, fmt.Errorf("could not activate user: %v", err)
+			}
+			if err := enqueueUserChange(c, tx, EventUserUpdated, userId); err != nil {
+				return 0, err
+			}
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		username, err := r.pickUsername(c, usernameFromEmail(ext.Email))
+		if err != nil {
+			return 0, err
+		}
+		err = tx.QueryRowContext(c, `
+			insert into users (
+			    full_name,
+			    username,
+			    email,
+			    is_active
+			) values (
+				$1, $2, $3, true
+			) RETURNING id
+		`, nullIfEmpty(strings.TrimSpace(ext.FullName)), username, ext.Email).Scan(&userId)
+		if err != nil {
+			if uerr := uniqueViolation(err); uerr != nil {
+				return 0, uerr
+			}
+			return 0, fmt.Errorf("could not insert user: %v", err)
+		}
+		if err := enqueueUserChange(c, tx, EventUserRegistered, userId); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("could not query user: %v", err)
+	}
+
+	if err := insertIdentity(c, tx, userId, ext, &now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return userId, nil
+}
+
+func insertIdentity(c context.Context, tx *sql.Tx, userId int32, ext ExternalIdentity, lastLoginAt *time.Time) error {
+	_, err := tx.ExecContext(c, `
+		INSERT INTO identities (user_id, provider, subject, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`, userId, ext.Provider, ext.Subject, nullIfEmpty(ext.Email), time.Now(), lastLoginAt)
+	if err != nil {
+		if _, ok := uniqueConstraint(err); ok {
+			return ErrIdentityTaken
+		}
+		return fmt.Errorf("could not insert identity: %v", err)
+	}
+	return nil
+}
+
+// LinkIdentity attaches an external identity to a logged in user. Linking
+// the same identity again is a no-op.
+func (r *UserRepository) LinkIdentity(c context.Context, userId int32, ext ExternalIdentity) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var owner int32
+	err = tx.QueryRowContext(c, `
+		SELECT user_id FROM identities WHERE provider = $1 AND subject = $2;
+	`, ext.Provider, ext.Subject).Scan(&owner)
+	switch {
+	case err == nil && owner == userId:
+		return nil
+	case err == nil:
+		return ErrIdentityTaken
+	case !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("could not query identity: %v", err)
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(c, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND is_deleted = false);
+	`, userId).Scan(&exists); err != nil {
+		return fmt.Errorf("could not query user: %v", err)
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	if err := insertIdentity(c, tx, userId, ext, nil); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// UnlinkIdentity removes the user's identity at provider, unless it is the
+// only way left to log in.
+func (r *UserRepository) UnlinkIdentity(c context.Context, userId int32, provider string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var hasPassword, linked bool
+	var identities int
+	err = tx.QueryRowContext(c, `
+		SELECT coalesce(u.password, '') <> '',
+		       EXISTS (SELECT 1 FROM identities WHERE user_id = u.id AND provider = $2),
+		       (SELECT count(*) FROM identities WHERE user_id = u.id)
+		FROM users u
+		WHERE u.id = $1 AND u.is_deleted = false
+		FOR UPDATE OF u;
+	`, userId, provider).Scan(&hasPassword, &linked, &identities)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("could not query user: %v", err)
+	}
+	if !linked {
+		return ErrIdentityNotFound
+	}
+	if !hasPassword && identities <= 1 {
+		return ErrLastLoginMethod
+	}
+
+	if _, err := tx.ExecContext(c, `DELETE FROM identities WHERE user_id = $1 AND provider = $2;`, userId, provider); err != nil {
+		return fmt.Errorf("could not delete identity: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) ListIdentities(c context.Context, userId int32) ([]Identity, error) {
+	rows, err := r.db.QueryContext(c, `
+		SELECT provider, coalesce(email, ''), created_at, last_login_at
+		FROM identities WHERE user_id = $1
+		ORDER BY provider;
+	`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("could not query identities: %v", err)
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		var lastLoginAt sql.NullTime
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt, &lastLoginAt); err != nil {
+			return nil, fmt.Errorf("could not scan identity: %v", err)
+		}
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = &lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not query identities: %v", err)
+	}
+	return identities, nil
+}
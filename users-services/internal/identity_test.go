@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// newExternalUser signs a user up through provider, so the account has no
+// password.
+func newExternalUser(t *testing.T, repo Repository, provider string) int32 {
+	t.Helper()
+	userId, err := repo.FindOrCreateExternalUser(context.Background(), ExternalIdentity{
+		Provider:      provider,
+		Subject:       "subject-1",
+		Email:         "external@example.com",
+		EmailVerified: true,
+		FullName:      "External",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userId
+}
+
+func TestPasswordNotSet(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(c context.Context, repo Repository, userId int32) error
+	}{
+		{"delete account", func(c context.Context, repo Repository, userId int32) error {
+			return repo.DeleteAccount(c, userId, "")
+		}},
+		{"disable two-factor authentication", func(c context.Context, repo Repository, userId int32) error {
+			return repo.DisableTOTP(c, userId, "")
+		}},
+		{"change password", func(c context.Context, repo Repository, userId int32) error {
+			return repo.ChangePassword(c, userId, "", "correct horse battery staple", 0)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				userId := newExternalUser(t, repo, "google")
+				if err := tt.call(c, repo, userId); !errors.Is(err, ErrPasswordNotSet) {
+					t.Errorf("got error %v, want %v", err, ErrPasswordNotSet)
+				}
+			})
+		})
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		// link is a second provider linked before unlinking, if any.
+		link      string
+		unlink    string
+		wantErr   error
+		wantLinks int
+	}{
+		{"last login method is kept", "", "google", ErrLastLoginMethod, 1},
+		{"unknown provider", "", "github", ErrIdentityNotFound, 1},
+		{"unknown provider with others linked", "github", "gitlab", ErrIdentityNotFound, 2},
+		{"another identity is left", "github", "google", nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				userId := newExternalUser(t, repo, "google")
+				if tt.link != "" {
+					if err := repo.LinkIdentity(c, userId, ExternalIdentity{Provider: tt.link, Subject: "subject-2", Email: "external@example.com", EmailVerified: true}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := repo.UnlinkIdentity(c, userId, tt.unlink); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("UnlinkIdentity() error = %v, want %v", err, tt.wantErr)
+				}
+				identities, err := repo.ListIdentities(c, userId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(identities) != tt.wantLinks {
+					t.Errorf("ListIdentities() = %+v, want %d identities", identities, tt.wantLinks)
+				}
+			})
+		})
+	}
+}
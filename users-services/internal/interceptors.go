@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDPattern matches the ids the gateway hands out; anything else in
+// the x-request-id metadata is replaced rather than logged as is.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// RequestID returns the id of the call c belongs to, as set by the request
+// id interceptor.
+func RequestID(c context.Context) string {
+	id, _ := c.Value(requestIDKey{}).(string)
+	return id
+}
+
+// CallTimeouts limits how long a unary call may run. Methods are named
+// without their service, like "LoginUser"; the others get Default.
+type CallTimeouts struct {
+	Default time.Duration
+	Methods map[string]time.Duration
+}
+
+// ServerOptions returns the interceptor chain of the users-service gRPC
+// server. In order, every call:
+//
+//   - gets a request id, from the x-request-id metadata or a new one, which
+//     is also sent back as a response header;
+//   - is logged with its method, status code and duration once done;
+//   - has panics turned into codes.Internal instead of crashing the process;
+//   - is cancelled after its timeout, for unary calls only, since streams
+//     such as the health Watch are meant to stay open.
+func ServerOptions(timeouts CallTimeouts) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(requestIDUnary, accessLogUnary, recoverUnary, timeouts.unary),
+		grpc.ChainStreamInterceptor(requestIDStream, accessLogStream, recoverStream),
+	}
+}
+
+// wrappedStream replaces the context of a server stream.
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *wrappedStream) Context() context.Context {
+	return s.ctx
+}
+
+// withRequestID stores the request id of the incoming call in c.
+func withRequestID(c context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(c); ok {
+		if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	if !requestIDPattern.MatchString(id) {
+		var err error
+		if id, err = generateTokenID(); err != nil {
+			log.Println(err)
+			return c
+		}
+	}
+	grpc.SetHeader(c, metadata.Pairs(requestIDMetadataKey, id))
+	return context.WithValue(c, requestIDKey{}, id)
+}
+
+func requestIDUnary(c context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(withRequestID(c), req)
+}
+
+func requestIDStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &wrappedStream{ServerStream: ss, ctx: withRequestID(ss.Context())})
+}
+
+// logCall writes the access log line of a finished call. Health checks are
+// logged at debug level, as load balancers poll them every few seconds.
+func logCall(c context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch {
+	case strings.HasPrefix(method, "/grpc.health.v1.Health/"):
+		level = slog.LevelDebug
+	case code == codes.Internal || code == codes.Unknown || code == codes.DataLoss:
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("request_id", RequestID(c)),
+		slog.String("peer", clientIP(c)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	slog.LogAttrs(c, level, "grpc call", attrs...)
+}
+
+func accessLogUnary(c context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(c, req)
+	logCall(c, info.FullMethod, start, err)
+	return resp, err
+}
+
+func accessLogStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logCall(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+// recovered turns a panic into codes.Internal, logging the stack so the
+// bug can be found. The panic value stays out of the response.
+func recovered(c context.Context, method string, p any) error {
+	slog.ErrorContext(c, "panic in grpc handler",
+		slog.String("method", method),
+		slog.String("request_id", RequestID(c)),
+		slog.Any("panic", p),
+		slog.String("stack", string(debug.Stack())),
+	)
+	return status.Error(codes.Internal, "internal error")
+}
+
+func recoverUnary(c context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			resp, err = nil, recovered(c, info.FullMethod, p)
+		}
+	}()
+	return handler(c, req)
+}
+
+func recoverStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recovered(ss.Context(), info.FullMethod, p)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// unary cancels the call context once the method's timeout passed. An
+// earlier deadline set by the client still wins. The repository wraps the
+// context errors it runs into, so a call that ran out of time is reported
+// as DeadlineExceeded here rather than as whatever it failed with.
+func (t CallTimeouts) unary(c context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	timeout, ok := t.Methods[path.Base(info.FullMethod)]
+	if !ok {
+		timeout = t.Default
+	}
+	if timeout <= 0 {
+		return handler(c, req)
+	}
+
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+	resp, err := handler(c, req)
+	if err != nil && c.Err() == context.DeadlineExceeded {
+		return nil, status.Error(codes.DeadlineExceeded, "request timed out")
+	}
+	return resp, err
+}
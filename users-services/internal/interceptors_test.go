@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecoverUnary(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.UserService/FindMe"}
+
+	tests := []struct {
+		name     string
+		handler  grpc.UnaryHandler
+		wantResp any
+		wantCode codes.Code
+	}{
+		{
+			name:     "response passes through",
+			handler:  func(c context.Context, req any) (any, error) { return "ok", nil },
+			wantResp: "ok",
+			wantCode: codes.OK,
+		},
+		{
+			name: "error passes through",
+			handler: func(c context.Context, req any) (any, error) {
+				return nil, status.Error(codes.NotFound, "user not found")
+			},
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "panic becomes Internal",
+			handler:  func(c context.Context, req any) (any, error) { panic("boom") },
+			wantCode: codes.Internal,
+		},
+		{
+			name: "nil pointer dereference becomes Internal",
+			handler: func(c context.Context, req any) (any, error) {
+				var user *User
+				return user.Email, nil
+			},
+			wantCode: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := recoverUnary(context.Background(), nil, info, tt.handler)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s (error %v)", code, tt.wantCode, err)
+			}
+			if resp != tt.wantResp {
+				t.Errorf("response = %v, want %v", resp, tt.wantResp)
+			}
+			if tt.wantCode == codes.Internal && status.Convert(err).Message() != "internal error" {
+				t.Errorf("message = %q, the panic must not reach the client", status.Convert(err).Message())
+			}
+		})
+	}
+}
+
+func TestCallTimeouts(t *testing.T) {
+	// slow waits for the call context like a database query would, and
+	// wraps the error the way the repository does.
+	slow := func(c context.Context, req any) (any, error) {
+		select {
+		case <-c.Done():
+			return nil, fmt.Errorf("could not query user: %v", c.Err())
+		case <-time.After(200 * time.Millisecond):
+			return "done", nil
+		}
+	}
+	failing := func(c context.Context, req any) (any, error) {
+		return nil, errors.New("could not query user")
+	}
+	short := 20 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		timeouts CallTimeouts
+		method   string
+		handler  grpc.UnaryHandler
+		wantCode codes.Code
+	}{
+		{"default timeout", CallTimeouts{Default: short}, "FindMe", slow, codes.DeadlineExceeded},
+		{"method timeout wins", CallTimeouts{Default: time.Minute, Methods: map[string]time.Duration{"FindMe": short}}, "FindMe", slow, codes.DeadlineExceeded},
+		{"other methods keep the default", CallTimeouts{Default: time.Minute, Methods: map[string]time.Duration{"LoginUser": short}}, "FindMe", slow, codes.OK},
+		{"zero disables the timeout", CallTimeouts{Default: short, Methods: map[string]time.Duration{"FindMe": 0}}, "FindMe", slow, codes.OK},
+		{"no timeouts", CallTimeouts{}, "FindMe", slow, codes.OK},
+		{"errors in time pass through", CallTimeouts{Default: time.Minute}, "FindMe", failing, codes.Unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &grpc.UnaryServerInfo{FullMethod: "/users.UserService/" + tt.method}
+			_, err := tt.timeouts.unary(context.Background(), nil, info, tt.handler)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("code = %s, want %s (error %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
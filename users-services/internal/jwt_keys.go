@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+var verificationAlgorithms = []jose.SignatureAlgorithm{jose.EdDSA, jose.RS256}
+
+type signingKey struct {
+	id        string
+	algorithm jose.SignatureAlgorithm
+	private   crypto.Signer
+}
+
+// KeySet holds every key the service currently publishes. Exactly one of them
+// signs new tokens; the others stay in the JWKS so tokens signed before a
+// rotation keep verifying until they expire.
+type KeySet struct {
+	keys   []signingKey
+	active signingKey
+}
+
+// LoadKeySet reads PEM encoded Ed25519 or RSA private keys from dir, using
+// each file name (without extension) as the key id. activeKid selects the
+// signing key; when empty the last key in name order is used, so naming
+// files by date rotates to the newest key automatically. Without any key
+// files an ephemeral Ed25519 key is generated, which is only suitable for
+// local development.
+func LoadKeySet(dir string, activeKid string) (*KeySet, error) {
+	var keys []signingKey
+
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("could not list signing keys: %v", err)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			key, err := loadSigningKey(file)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		key, err := generateEphemeralKey()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("no signing keys found in %q, using ephemeral key %s", dir, key.id)
+		keys = append(keys, key)
+	}
+
+	ks := &KeySet{keys: keys, active: keys[len(keys)-1]}
+	if activeKid != "" {
+		key, ok := ks.find(activeKid)
+		if !ok {
+			return nil, fmt.Errorf("signing key %q not found in %q", activeKid, dir)
+		}
+		ks.active = key
+	}
+	return ks, nil
+}
+
+func loadSigningKey(file string) (signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("could not read signing key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("could not decode signing key %s: no PEM block", file)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("could not parse signing key %s: %v", file, err)
+	}
+
+	id := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	switch key := parsed.(type) {
+	case ed25519.PrivateKey:
+		return signingKey{id: id, algorithm: jose.EdDSA, private: key}, nil
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return signingKey{}, fmt.Errorf("signing key %s: RSA keys must be at least 2048 bits", file)
+		}
+		return signingKey{id: id, algorithm: jose.RS256, private: key}, nil
+	default:
+		return signingKey{}, fmt.Errorf("signing key %s: unsupported key type %T", file, parsed)
+	}
+}
+
+func generateEphemeralKey() (signingKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("could not generate signing key: %v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return signingKey{}, fmt.Errorf("could not generate signing key: %v", err)
+	}
+	return signingKey{id: "ephemeral-" + hex.EncodeToString(suffix), algorithm: jose.EdDSA, private: private}, nil
+}
+
+func (ks *KeySet) find(kid string) (signingKey, bool) {
+	for _, key := range ks.keys {
+		if key.id == kid {
+			return key, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// JWKS returns the public half of every key as a JSON Web Key Set document.
+func (ks *KeySet) JWKS() ([]byte, error) {
+	set := jose.JSONWebKeySet{}
+	for _, key := range ks.keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       key.private.Public(),
+			KeyID:     key.id,
+			Algorithm: string(key.algorithm),
+			Use:       "sig",
+		})
+	}
+
+	raw, err := json.Marshal(set)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal jwks: %v", err)
+	}
+	return raw, nil
+}
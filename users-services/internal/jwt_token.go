@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-jose/go-jose/v4"
@@ -9,55 +12,107 @@ import (
 )
 
 type JwtToken struct {
-	UserId string `json:"userId"`
+	UserId      string   `json:"userId"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// SessionId names the login the token was issued for, so logging that
+	// session out also rejects its access tokens.
+	SessionId string `json:"sid,omitempty"`
 	jwt.Claims
 }
 
-func NewJwtToken(userId string) *JwtToken {
+func NewJwtToken(userId, sessionId string, access UserAccess) (*JwtToken, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
 	return &JwtToken{
-		UserId: userId,
+		UserId:      userId,
+		Roles:       access.Roles,
+		Permissions: access.Permissions,
+		SessionId:   sessionId,
 		Claims: jwt.Claims{
+			ID:        jti,
 			Issuer:    "wafiuddin",
 			Subject:   userId,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			Expiry:    jwt.NewNumericDate(now.Add(15 * time.Minute)),
 		},
+	}, nil
+}
+
+func generateTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate token id: %v", err)
 	}
+	return hex.EncodeToString(b), nil
 }
 
-func GenerateToken(userId string) (string, error) {
-	secret := []byte("f1404c536dbe0eb9b7ef959b09490eb0")
+// Token types set in the typ header. Purpose-specific tokens are signed
+// with the same key and issuer as access tokens, so anything verifying
+// access tokens with the published JWKS must be able to tell them apart
+// without knowing each audience.
+const (
+	accessTokenType            = "JWT"
+	emailVerificationTokenType = "email-verification+jwt"
+	mfaChallengeTokenType      = "mfa-challenge+jwt"
+)
 
+// sign serializes claims as a JWT of the given type signed with the active
+// key.
+func (ks *KeySet) sign(claims any, typ jose.ContentType) (string, error) {
 	sig, err := jose.NewSigner(
-		jose.SigningKey{Algorithm: jose.HS256, Key: secret},
-		(&jose.SignerOptions{}).WithType("JWT"),
+		jose.SigningKey{Algorithm: ks.active.algorithm, Key: jose.JSONWebKey{Key: ks.active.private, KeyID: ks.active.id}},
+		(&jose.SignerOptions{}).WithType(typ),
 	)
 	if err != nil {
 		return "", fmt.Errorf("could not create signer: %v", err)
 	}
 
-	token := NewJwtToken(userId)
-	raw, err := jwt.Signed(sig).Claims(token).Serialize()
+	raw, err := jwt.Signed(sig).Claims(claims).Serialize()
 	if err != nil {
 		return "", fmt.Errorf("could not serialize token: %v", err)
 	}
-
 	return raw, nil
 }
 
-func VerifyToken(tokenString string) (*JwtToken, error) {
-	secret := []byte("f1404c536dbe0eb9b7ef959b09490eb0")
+// parse verifies the signature of tokenString with the key named in its
+// header, decodes the payload into claims and returns the token type.
+func (ks *KeySet) parse(tokenString string, claims any) (string, error) {
+	tok, err := jwt.ParseSigned(tokenString, verificationAlgorithms)
+	if err != nil {
+		return "", fmt.Errorf("could not parse token: %v", err)
+	}
+
+	key, ok := ks.find(tok.Headers[0].KeyID)
+	if !ok {
+		return "", fmt.Errorf("could not verify token: unknown key id %q", tok.Headers[0].KeyID)
+	}
 
-	tok, err := jwt.ParseSigned(tokenString, []jose.SignatureAlgorithm{jose.HS256})
+	if err := tok.Claims(key.private.Public(), claims); err != nil {
+		return "", fmt.Errorf("could not verify token: %v", err)
+	}
+	typ, _ := tok.Headers[0].ExtraHeaders[jose.HeaderType].(string)
+	return typ, nil
+}
+
+func (ks *KeySet) GenerateToken(userId, sessionId string, access UserAccess) (string, error) {
+	token, err := NewJwtToken(userId, sessionId, access)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse token: %v", err)
+		return "", err
 	}
+	return ks.sign(token, accessTokenType)
+}
 
+func (ks *KeySet) VerifyToken(tokenString string) (*JwtToken, error) {
 	claims := &JwtToken{}
-	if err := tok.Claims(secret, claims); err != nil {
-		return nil, fmt.Errorf("could not verify token: %v", err)
+	typ, err := ks.parse(tokenString, claims)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := claims.Validate(jwt.Expected{
@@ -66,6 +121,97 @@ func VerifyToken(tokenString string) (*JwtToken, error) {
 	}); err != nil {
 		return nil, fmt.Errorf("token invalid: %v", err)
 	}
+	// Access tokens carry no audience; anything else is a purpose-specific
+	// token (email verification, ...) that must not grant API access.
+	if len(claims.Audience) > 0 || typ != accessTokenType {
+		return nil, fmt.Errorf("token invalid: not an access token")
+	}
+
+	return claims, nil
+}
+
+const (
+	emailVerificationAudience = "email-verification"
+	emailVerificationTTL      = 24 * time.Hour
+)
+
+type EmailVerificationToken struct {
+	Email string `json:"email"`
+	jwt.Claims
+}
+
+// GenerateEmailVerificationToken signs a token proving control of email.
+// The email is part of the claims so the link stops working if the address
+// changes before it is used.
+func (ks *KeySet) GenerateEmailVerificationToken(userId int32, email string) (string, error) {
+	now := time.Now()
+	return ks.sign(&EmailVerificationToken{
+		Email: email,
+		Claims: jwt.Claims{
+			Issuer:    "wafiuddin",
+			Subject:   strconv.Itoa(int(userId)),
+			Audience:  jwt.Audience{emailVerificationAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(emailVerificationTTL)),
+		},
+	}, emailVerificationTokenType)
+}
+
+func (ks *KeySet) VerifyEmailVerificationToken(tokenString string) (*EmailVerificationToken, error) {
+	claims := &EmailVerificationToken{}
+	if _, err := ks.parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer:      "wafiuddin",
+		AnyAudience: jwt.Audience{emailVerificationAudience},
+		Time:        time.Now(),
+	}); err != nil {
+		return nil, fmt.Errorf("token invalid: %v", err)
+	}
+
+	return claims, nil
+}
+
+const (
+	mfaChallengeAudience = "mfa-challenge"
+	mfaChallengeTTL      = 5 * time.Minute
+)
+
+// GenerateMFAChallengeToken proves that the password of userId was checked.
+// It is traded for real tokens by VerifyMFA together with a second factor.
+func (ks *KeySet) GenerateMFAChallengeToken(userId int32) (string, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return ks.sign(&jwt.Claims{
+		ID:        jti,
+		Issuer:    "wafiuddin",
+		Subject:   strconv.Itoa(int(userId)),
+		Audience:  jwt.Audience{mfaChallengeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(mfaChallengeTTL)),
+	}, mfaChallengeTokenType)
+}
+
+func (ks *KeySet) VerifyMFAChallengeToken(tokenString string) (*jwt.Claims, error) {
+	claims := &jwt.Claims{}
+	if _, err := ks.parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer:      "wafiuddin",
+		AnyAudience: jwt.Audience{mfaChallengeAudience},
+		Time:        time.Now(),
+	}); err != nil {
+		return nil, fmt.Errorf("token invalid: %v", err)
+	}
 
 	return claims, nil
 }
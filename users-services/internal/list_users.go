@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// userSortColumns maps the sort options of ListUsers to the expressions the
+// listing indexes are built on.
+var userSortColumns = map[string]string{
+	"created_at": "created_at",
+	"email":      "coalesce(email, '')",
+	"username":   "coalesce(username, '')",
+}
+
+// UserFilter narrows down ListUsers. Nil or empty fields do not filter.
+type UserFilter struct {
+	Active         *bool
+	Deleted        *bool
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	EmailPrefix    string
+	UsernamePrefix string
+	// SortBy is created_at, email or username; ties are broken by id so the
+	// order is stable.
+	SortBy     string
+	Descending bool
+	PageSize   int
+	PageToken  string
+}
+
+type UserPage struct {
+	Users         []User
+	NextPageToken string
+	TotalCount    int64
+}
+
+// pageCursor points at the last row of a page. It carries the sort options
+// it was issued for so a token cannot be replayed against another order.
+type pageCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         int32  `json:"i"`
+}
+
+func (f *UserFilter) Validate() error {
+	if f.SortBy == "" {
+		f.SortBy = "created_at"
+	}
+	if _, ok := userSortColumns[f.SortBy]; !ok {
+		return fmt.Errorf("sort_by must be one of created_at, email or username")
+	}
+	if f.PageSize < 0 {
+		return errors.New("page_size must not be negative")
+	}
+	if f.PageSize == 0 {
+		f.PageSize = defaultPageSize
+	}
+	if f.PageSize > maxPageSize {
+		f.PageSize = maxPageSize
+	}
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && !f.CreatedAfter.Before(*f.CreatedBefore) {
+		return errors.New("created_after must be before created_before")
+	}
+	return nil
+}
+
+func encodePageToken(cursor pageCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePageToken(token string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	return &cursor, nil
+}
+
+// userPageToken returns the token of the page after the one ending with
+// last.
+func userPageToken(filter UserFilter, last User) string {
+	cursor := pageCursor{SortBy: filter.SortBy, Descending: filter.Descending, ID: last.ID}
+	switch filter.SortBy {
+	case "email":
+		cursor.Value = last.Email
+	case "username":
+		cursor.Value = last.Username
+	default:
+		cursor.Value = last.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return encodePageToken(cursor)
+}
+
+// decodeUserPageToken returns the sort value and id of the last user of the
+// previous page. The value is a time.Time when sorting by created_at.
+func decodeUserPageToken(filter UserFilter) (any, int32, error) {
+	cursor, err := decodePageToken(filter.PageToken)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cursor.SortBy != filter.SortBy || cursor.Descending != filter.Descending {
+		return nil, 0, ErrInvalidPageToken
+	}
+	if filter.SortBy == "created_at" {
+		createdAt, err := time.Parse(time.RFC3339Nano, cursor.Value)
+		if err != nil {
+			return nil, 0, ErrInvalidPageToken
+		}
+		return createdAt, cursor.ID, nil
+	}
+	return cursor.Value, cursor.ID, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied prefix.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListUsers returns one page of users using keyset pagination on
+// (sort key, id), so deep pages cost the same as the first one.
+func (r *UserRepository) ListUsers(c context.Context, filter UserFilter) (*UserPage, error) {
+	var where []string
+	var args []any
+	cond := func(format string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(format, len(args)))
+	}
+
+	if filter.Active != nil {
+		cond("coalesce(is_active, false) = $%d", *filter.Active)
+	}
+	if filter.Deleted != nil {
+		cond("coalesce(is_deleted, false) = $%d", *filter.Deleted)
+	}
+	if filter.CreatedAfter != nil {
+		cond("created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		cond("created_at < $%d", *filter.CreatedBefore)
+	}
+	if filter.EmailPrefix != "" {
+		cond("lower(email) LIKE $%d ESCAPE '\\'", strings.ToLower(escapeLike(filter.EmailPrefix))+"%")
+	}
+	if filter.UsernamePrefix != "" {
+		cond("lower(username) LIKE $%d ESCAPE '\\'", strings.ToLower(escapeLike(filter.UsernamePrefix))+"%")
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int64
+	if err := r.db.QueryRowContext(c, `SELECT count(*) FROM users `+whereClause, args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("could not count users: %v", err)
+	}
+
+	sortColumn := userSortColumns[filter.SortBy]
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if filter.PageToken != "" {
+		value, lastId, err := decodeUserPageToken(filter)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value, lastId)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sortColumn, comparison, len(args)-1, len(args)))
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	// One extra row tells whether there is a next page.
+	args = append(args, filter.PageSize+1)
+	query := fmt.Sprintf(`SELECT %s
+		FROM users %s
+		ORDER BY %s %s, id %s
+		LIMIT $%d;
+    `, userColumns, whereClause, sortColumn, direction, direction, len(args))
+
+	rows, err := r.db.QueryContext(c, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list users: %v", err)
+	}
+	defer rows.Close()
+
+	page := &UserPage{TotalCount: total}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan user: %v", err)
+		}
+		page.Users = append(page.Users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not list users: %v", err)
+	}
+
+	if len(page.Users) > filter.PageSize {
+		page.Users = page.Users[:filter.PageSize]
+		page.NextPageToken = userPageToken(filter, page.Users[len(page.Users)-1])
+	}
+	return page, nil
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// listUsers is registered by newListFixture in this order. Emails and
+// usernames sort differently from each other and from registration.
+var listUsers = []struct {
+	username, email string
+	verified        bool
+	deleted         bool
+}{
+	{"mallory", "bob@example.com", true, false},
+	{"al_ex", "carol@example.com", false, false},
+	{"alice", "alice@example.com", true, false},
+	{"zed", "al_ex@example.com", true, true},
+	{"bobby", "dave@example.com", true, false},
+}
+
+// listFixture holds the users of listUsers as ListUsers returns them, by
+// index into listUsers.
+type listFixture struct {
+	users []User
+}
+
+func newListFixture(t *testing.T, repo Repository) *listFixture {
+	t.Helper()
+	c := context.Background()
+	password := "correct horse battery staple"
+	var ids []int32
+	for i, u := range listUsers {
+		user, err := repo.RegisterUser(c, UserRegister{
+			FullName:    u.username,
+			Username:    u.username,
+			Email:       u.email,
+			Password:    &password,
+			PhoneNumber: fmt.Sprintf("+62820000000%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.verified {
+			if err := repo.VerifyEmail(c, user.ID, user.Email); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if u.deleted {
+			if err := repo.DeleteAccount(c, user.ID, password); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, user.ID)
+		// Keep creation times apart so created_at bounds fall between users.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	page, err := repo.ListUsers(c, UserFilter{SortBy: "created_at", PageSize: len(ids)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &listFixture{users: make([]User, len(ids))}
+	for _, user := range page.Users {
+		for i, id := range ids {
+			if user.ID == id {
+				f.users[i] = user
+			}
+		}
+	}
+	return f
+}
+
+// indexes maps users back to their index into listUsers.
+func (f *listFixture) indexes(users []User) []int {
+	got := []int{}
+	for _, user := range users {
+		for i, u := range f.users {
+			if user.ID == u.ID {
+				got = append(got, i)
+			}
+		}
+	}
+	return got
+}
+
+func TestListUsersFilters(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		filter func(f *listFixture) UserFilter
+		want   []int
+	}{
+		{"no filter", func(*listFixture) UserFilter { return UserFilter{} }, []int{0, 1, 2, 3, 4}},
+		{"active", func(*listFixture) UserFilter { return UserFilter{Active: &yes} }, []int{0, 2, 3, 4}},
+		{"inactive", func(*listFixture) UserFilter { return UserFilter{Active: &no} }, []int{1}},
+		{"deleted", func(*listFixture) UserFilter { return UserFilter{Deleted: &yes} }, []int{3}},
+		{"active and not deleted", func(*listFixture) UserFilter { return UserFilter{Active: &yes, Deleted: &no} }, []int{0, 2, 4}},
+		{"email prefix ignores case", func(*listFixture) UserFilter { return UserFilter{EmailPrefix: "AL"} }, []int{2, 3}},
+		{"email prefix underscore is literal", func(*listFixture) UserFilter { return UserFilter{EmailPrefix: "al_"} }, []int{3}},
+		{"username prefix ignores case", func(*listFixture) UserFilter { return UserFilter{UsernamePrefix: "ALI"} }, []int{2}},
+		{"username prefix underscore is literal", func(*listFixture) UserFilter { return UserFilter{UsernamePrefix: "al_"} }, []int{1}},
+		{"username prefix percent is literal", func(*listFixture) UserFilter { return UserFilter{UsernamePrefix: "al%"} }, []int{}},
+		{"created after is inclusive", func(f *listFixture) UserFilter {
+			return UserFilter{CreatedAfter: &f.users[2].CreatedAt}
+		}, []int{2, 3, 4}},
+		{"created before is exclusive", func(f *listFixture) UserFilter {
+			return UserFilter{CreatedBefore: &f.users[2].CreatedAt}
+		}, []int{0, 1}},
+		{"created between", func(f *listFixture) UserFilter {
+			return UserFilter{CreatedAfter: &f.users[1].CreatedAt, CreatedBefore: &f.users[3].CreatedAt}
+		}, []int{1, 2}},
+		{"filters combine", func(f *listFixture) UserFilter {
+			return UserFilter{Active: &yes, CreatedBefore: &f.users[3].CreatedAt, EmailPrefix: "a"}
+		}, []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				f := newListFixture(t, repo)
+				filter := tt.filter(f)
+				if err := filter.Validate(); err != nil {
+					t.Fatal(err)
+				}
+
+				page, err := repo.ListUsers(context.Background(), filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := f.indexes(page.Users); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("ListUsers() = %v, want %v", got, tt.want)
+				}
+				if page.TotalCount != int64(len(tt.want)) || page.NextPageToken != "" {
+					t.Errorf("total = %d, next page = %q; want %d and no next page", page.TotalCount, page.NextPageToken, len(tt.want))
+				}
+			})
+		})
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	tests := []struct {
+		sortBy     string
+		descending bool
+		want       []int
+	}{
+		{"created_at", false, []int{0, 1, 2, 3, 4}},
+		{"created_at", true, []int{4, 3, 2, 1, 0}},
+		{"email", false, []int{3, 2, 0, 1, 4}},
+		{"email", true, []int{4, 1, 0, 2, 3}},
+		{"username", false, []int{1, 2, 4, 0, 3}},
+		{"username", true, []int{3, 0, 4, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		name := tt.sortBy
+		if tt.descending {
+			name += " descending"
+		}
+		t.Run(name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				f := newListFixture(t, repo)
+				filter := UserFilter{SortBy: tt.sortBy, Descending: tt.descending, PageSize: 2}
+				if err := filter.Validate(); err != nil {
+					t.Fatal(err)
+				}
+
+				// Pages of two follow each other without gaps or repeats.
+				var got []int
+				var tokens []string
+				for pages := 0; ; pages++ {
+					if pages == len(tt.want) {
+						t.Fatal("paging does not end")
+					}
+					page, err := repo.ListUsers(c, filter)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if page.TotalCount != int64(len(tt.want)) {
+						t.Errorf("page %d total = %d, want %d", pages, page.TotalCount, len(tt.want))
+					}
+					got = append(got, f.indexes(page.Users)...)
+					if page.NextPageToken == "" {
+						break
+					}
+					tokens = append(tokens, page.NextPageToken)
+					filter.PageToken = page.NextPageToken
+				}
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("pages = %v, want %v", got, tt.want)
+				}
+				if len(tokens) != 2 {
+					t.Errorf("got %d next page tokens, want 2", len(tokens))
+				}
+
+				// A token only continues the order it was issued for.
+				other := UserFilter{SortBy: tt.sortBy, Descending: !tt.descending, PageSize: 2, PageToken: tokens[0]}
+				if _, err := repo.ListUsers(c, other); !errors.Is(err, ErrInvalidPageToken) {
+					t.Errorf("token replayed in the other direction: error %v, want %v", err, ErrInvalidPageToken)
+				}
+				other = UserFilter{SortBy: "created_at", Descending: tt.descending, PageSize: 2, PageToken: tokens[0]}
+				if tt.sortBy == "created_at" {
+					other.SortBy = "email"
+				}
+				if _, err := repo.ListUsers(c, other); !errors.Is(err, ErrInvalidPageToken) {
+					t.Errorf("token replayed with another sort: error %v, want %v", err, ErrInvalidPageToken)
+				}
+			})
+		})
+	}
+}
+
+func TestListUsersInvalidPageToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "not a token!"},
+		{"not json", "bm90IGpzb24"},
+		{"bad time", encodePageToken(pageCursor{SortBy: "created_at", Value: "yesterday", ID: 1})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				filter := UserFilter{SortBy: "created_at", PageSize: 2, PageToken: tt.token}
+				if _, err := repo.ListUsers(context.Background(), filter); !errors.Is(err, ErrInvalidPageToken) {
+					t.Errorf("ListUsers() error = %v, want %v", err, ErrInvalidPageToken)
+				}
+			})
+		})
+	}
+}
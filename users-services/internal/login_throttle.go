@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginThrottle limits password guessing. Failed logins are counted per
+// account and per client address; every failure makes the next attempt wait
+// twice as long, and reaching a threshold locks the key for LockoutDuration.
+// Counters are forgotten FailureWindow after the last failure.
+type LoginThrottle struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	LockoutDuration    time.Duration
+	FailureWindow      time.Duration
+}
+
+// ThrottledError is returned while a login is delayed or locked out.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// mfaThrottleKey counts wrong second factors of the user with the given id.
+func mfaThrottleKey(userId string) string {
+	return "mfa:" + userId
+}
+
+// delay is how long to wait after the given number of failures.
+func (t LoginThrottle) delay(failures int) time.Duration {
+	if failures <= 0 || t.BaseDelay <= 0 {
+		return 0
+	}
+	d := t.BaseDelay
+	for i := 1; i < failures && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, t.MaxDelay)
+}
+
+// ReserveLoginAttempt counts an attempt against key before the credentials
+// are checked, or returns a *ThrottledError without counting it when key is
+// locked or still inside its progressive delay. Reading and updating the
+// counter happen under one row lock, so concurrent guesses queue up instead
+// of all passing the check before any failure is recorded. Reaching limit
+// attempts within the failure window locks key. An attempt that turns out
+// not to be a failure is handed back with ReleaseLoginAttempt.
+func (r *UserRepository) ReserveLoginAttempt(c context.Context, throttle LoginThrottle, key string, limit int) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The row has to exist for FOR UPDATE to have something to lock; a
+	// rejected attempt rolls it back again.
+	now := time.Now()
+	if _, err := tx.ExecContext(c, `
+		INSERT INTO login_failures (key, failures, last_failed_at) VALUES ($1, 0, $2)
+		ON CONFLICT (key) DO NOTHING;
+	`, key, now); err != nil {
+		return fmt.Errorf("could not reserve login attempt: %v", err)
+	}
+
+	var failures int
+	var lastFailedAt time.Time
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(c, `
+		SELECT failures, last_failed_at, locked_until FROM login_failures WHERE key = $1 FOR UPDATE;
+	`, key).Scan(&failures, &lastFailedAt, &lockedUntil)
+	if err != nil {
+		return fmt.Errorf("could not query login failures: %v", err)
+	}
+
+	var wait time.Duration
+	if lockedUntil.Valid {
+		wait = lockedUntil.Time.Sub(now)
+	}
+	if !lastFailedAt.After(now.Add(-throttle.FailureWindow)) {
+		failures = 0
+	}
+	wait = max(wait, lastFailedAt.Add(throttle.delay(failures)).Sub(now))
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	failures++
+	if failures >= limit {
+		lockedUntil = sql.NullTime{Time: now.Add(throttle.LockoutDuration), Valid: true}
+	}
+	if _, err := tx.ExecContext(c, `
+		UPDATE login_failures SET failures = $2, last_failed_at = $3, locked_until = $4 WHERE key = $1;
+	`, key, failures, now, lockedUntil); err != nil {
+		return fmt.Errorf("could not reserve login attempt: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// ReleaseLoginAttempt takes back an attempt reserved on key that did not
+// fail, lifting the lockout it caused if it was the one reaching limit.
+func (r *UserRepository) ReleaseLoginAttempt(c context.Context, key string, limit int) error {
+	if _, err := r.db.ExecContext(c, `
+		UPDATE login_failures SET
+		    failures = failures - 1,
+		    locked_until = CASE WHEN failures - 1 < $2 THEN NULL ELSE locked_until END
+		WHERE key = $1 AND failures > 0;
+	`, key, limit); err != nil {
+		return fmt.Errorf("could not release login attempt: %v", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) ClearLoginFailures(c context.Context, key string) error {
+	if _, err := r.db.ExecContext(c, `DELETE FROM login_failures WHERE key = $1;`, key); err != nil {
+		return fmt.Errorf("could not clear login failures: %v", err)
+	}
+	return nil
+}
+
+// UnlockUser lifts the lockout of the user's account, from wrong passwords
+// and from wrong second factors. Locks on client addresses are left alone.
+func (r *UserRepository) UnlockUser(c context.Context, userID int32) error {
+	var email sql.NullString
+	err := r.db.QueryRowContext(c, `SELECT email FROM users WHERE id = $1 AND is_deleted = false;`, userID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("could not query user: %v", err)
+	}
+	if _, err := r.db.ExecContext(c, `DELETE FROM login_failures WHERE key IN ($1, $2);`,
+		accountThrottleKey(email.String), mfaThrottleKey(strconv.Itoa(int(userID)))); err != nil {
+		return fmt.Errorf("could not clear login failures: %v", err)
+	}
+	return nil
+}
+
+// PruneLoginFailures forgets counters that can no longer delay or lock a
+// login.
+func (r *UserRepository) PruneLoginFailures(c context.Context, window time.Duration) error {
+	now := time.Now()
+	if _, err := r.db.ExecContext(c, `
+		DELETE FROM login_failures
+		WHERE last_failed_at < $1 AND (locked_until IS NULL OR locked_until < $2);
+	`, now.Add(-window), now); err != nil {
+		return fmt.Errorf("could not prune login failures: %v", err)
+	}
+	return nil
+}
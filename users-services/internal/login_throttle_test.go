@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := LoginThrottle{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	tests := []struct {
+		name     string
+		throttle LoginThrottle
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", throttle, 0, 0},
+		{"first failure", throttle, 1, time.Second},
+		{"doubles", throttle, 2, 2 * time.Second},
+		{"doubles again", throttle, 3, 4 * time.Second},
+		{"capped", throttle, 4, 5 * time.Second},
+		{"stays capped", throttle, 50, 5 * time.Second},
+		{"disabled", LoginThrottle{MaxDelay: time.Minute}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.throttle.delay(tt.failures); got != tt.want {
+				t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+// newThrottleFixture returns a service with throttle on repo and registers
+// an active account for every email, all with throttlePassword.
+func newThrottleFixture(t *testing.T, repo Repository, throttle LoginThrottle, emails ...string) (*UserService, map[string]int32) {
+	t.Helper()
+	c := context.Background()
+	keys, err := LoadKeySet("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewUserService(repo, keys, NewMemoryMailer(), "http://localhost", 0, throttle, PasswordPolicy{})
+
+	ids := make(map[string]int32)
+	for i, email := range emails {
+		password := throttlePassword
+		user, err := repo.RegisterUser(c, UserRegister{FullName: "Throttled", Email: email, Password: &password, PhoneNumber: fmt.Sprintf("+62814000000%02d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.VerifyEmail(c, user.ID, email); err != nil {
+			t.Fatal(err)
+		}
+		ids[email] = user.ID
+	}
+	return service, ids
+}
+
+const throttlePassword = "correct horse battery staple"
+
+// loginStep is one login attempt, or an admin unlocking the account when
+// unlock is set.
+type loginStep struct {
+	email    string
+	password string
+	ip       string
+	unlock   bool
+	want     loginOutcome
+}
+
+type loginOutcome int
+
+const (
+	loggedIn loginOutcome = iota
+	wrongPassword
+	throttled
+)
+
+func (o loginOutcome) String() string {
+	return [...]string{"logged in", "wrong password", "throttled"}[o]
+}
+
+func outcomeOf(err error) (loginOutcome, bool) {
+	var throttledErr *ThrottledError
+	switch {
+	case err == nil:
+		return loggedIn, true
+	case errors.Is(err, ErrInvalidCredentials):
+		return wrongPassword, true
+	case errors.As(err, &throttledErr):
+		return throttled, true
+	}
+	return 0, false
+}
+
+func TestLoginThrottle(t *testing.T) {
+	lockout := LoginThrottle{
+		MaxAccountFailures: 3,
+		MaxIPFailures:      100,
+		LockoutDuration:    time.Hour,
+		FailureWindow:      time.Hour,
+	}
+	ipLockout := lockout
+	ipLockout.MaxAccountFailures = 100
+	ipLockout.MaxIPFailures = 2
+	delayed := lockout
+	delayed.MaxAccountFailures = 100
+	delayed.BaseDelay = time.Hour
+	delayed.MaxDelay = time.Hour
+
+	const (
+		alice = "alice@example.com"
+		bob   = "bob@example.com"
+		ip    = "203.0.113.7"
+		wrong = "wrong password"
+	)
+
+	tests := []struct {
+		name     string
+		throttle LoginThrottle
+		steps    []loginStep
+	}{
+		{
+			name:     "account locks after too many failures",
+			throttle: lockout,
+			steps: []loginStep{
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: throttlePassword, want: throttled},
+				{email: bob, password: throttlePassword, want: loggedIn},
+			},
+		},
+		{
+			name:     "unlock lifts the lockout",
+			throttle: lockout,
+			steps: []loginStep{
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, unlock: true},
+				{email: alice, password: throttlePassword, want: loggedIn},
+			},
+		},
+		{
+			name:     "successful login resets the account counter",
+			throttle: lockout,
+			steps: []loginStep{
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: throttlePassword, want: loggedIn},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: throttlePassword, want: loggedIn},
+			},
+		},
+		{
+			name:     "failures delay the next attempt",
+			throttle: delayed,
+			steps: []loginStep{
+				{email: alice, password: wrong, want: wrongPassword},
+				{email: alice, password: throttlePassword, want: throttled},
+				{email: bob, password: throttlePassword, want: loggedIn},
+			},
+		},
+		{
+			name:     "address locks across accounts",
+			throttle: ipLockout,
+			steps: []loginStep{
+				{email: alice, password: wrong, ip: ip, want: wrongPassword},
+				{email: bob, password: wrong, ip: ip, want: wrongPassword},
+				{email: alice, password: throttlePassword, ip: ip, want: throttled},
+				{email: alice, password: throttlePassword, ip: "198.51.100.1", want: loggedIn},
+			},
+		},
+		{
+			name:     "successful logins do not count against the address",
+			throttle: ipLockout,
+			steps: []loginStep{
+				{email: alice, password: throttlePassword, ip: ip, want: loggedIn},
+				{email: bob, password: throttlePassword, ip: ip, want: loggedIn},
+				{email: alice, password: throttlePassword, ip: ip, want: loggedIn},
+			},
+		},
+		{
+			name:     "unknown accounts count too",
+			throttle: lockout,
+			steps: []loginStep{
+				{email: "nobody@example.com", password: wrong, want: wrongPassword},
+				{email: "nobody@example.com", password: wrong, want: wrongPassword},
+				{email: "nobody@example.com", password: wrong, want: wrongPassword},
+				{email: "nobody@example.com", password: wrong, want: throttled},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				service, users := newThrottleFixture(t, repo, tt.throttle, alice, bob)
+
+				for i, step := range tt.steps {
+					if step.unlock {
+						if err := service.UnlockUser(c, users[step.email]); err != nil {
+							t.Fatalf("step %d: UnlockUser() = %v", i, err)
+						}
+						continue
+					}
+					_, err := service.LoginUser(c, step.email, step.password, ClientInfo{IP: step.ip})
+					if got, ok := outcomeOf(err); !ok || got != step.want {
+						t.Fatalf("step %d: login of %s got error %v, want %s", i, step.email, err, step.want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestLoginThrottleRetryAfter(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		throttle := LoginThrottle{MaxAccountFailures: 1, LockoutDuration: time.Hour, FailureWindow: time.Hour}
+		service, _ := newThrottleFixture(t, repo, throttle, "alice@example.com")
+
+		if _, err := service.LoginUser(c, "alice@example.com", "wrong password", ClientInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidCredentials)
+		}
+		_, err := service.LoginUser(c, "alice@example.com", throttlePassword, ClientInfo{})
+		var throttledErr *ThrottledError
+		if !errors.As(err, &throttledErr) {
+			t.Fatalf("got error %v, want a *ThrottledError", err)
+		}
+		if throttledErr.RetryAfter <= 59*time.Minute || throttledErr.RetryAfter > time.Hour {
+			t.Errorf("RetryAfter = %s, want about an hour", throttledErr.RetryAfter)
+		}
+	})
+}
+
+func TestVerifyMFALockout(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		throttle := LoginThrottle{MaxAccountFailures: 2, LockoutDuration: time.Hour, FailureWindow: time.Hour}
+		service, users := newThrottleFixture(t, repo, throttle, "mfa@example.com")
+		userId := users["mfa@example.com"]
+
+		// Confirm with the code of the previous step so the current one is
+		// still unused, after waiting out a step that is about to end.
+		if left := totpPeriod - time.Now().Unix()%totpPeriod; left < 2 {
+			time.Sleep(time.Duration(left) * time.Second)
+		}
+		current := totpStep(time.Now())
+		secret, _, err := repo.EnrollTOTP(c, userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := totpEncoding.DecodeString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.ConfirmTOTP(c, userId, totpCode(key, current-1)); err != nil {
+			t.Fatal(err)
+		}
+
+		login, err := service.LoginUser(c, "mfa@example.com", throttlePassword, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login.MFAToken == "" {
+			t.Fatal("LoginUser() did not ask for a second factor")
+		}
+
+		for range throttle.MaxAccountFailures {
+			if _, err := service.VerifyMFA(c, login.MFAToken, "000000", "", ClientInfo{}); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("got error %v, want %v", err, ErrInvalidMFACode)
+			}
+		}
+		var throttledErr *ThrottledError
+		if _, err := service.VerifyMFA(c, login.MFAToken, totpCode(key, current), "", ClientInfo{}); !errors.As(err, &throttledErr) {
+			t.Fatalf("got error %v, want a *ThrottledError", err)
+		}
+
+		if err := service.UnlockUser(c, userId); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := service.VerifyMFA(c, login.MFAToken, totpCode(key, current), "", ClientInfo{})
+		if err != nil {
+			t.Fatalf("VerifyMFA() after unlock: %v", err)
+		}
+		if tokens.AccessToken == "" {
+			t.Error("VerifyMFA() returned no access token")
+		}
+	})
+}
@@ -0,0 +1,1518 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements Repository without a database, for tests and
+// for running users-service on its own. Every method holds one lock, which
+// gives the same all-or-nothing behaviour as the SQL transactions. Nothing
+// survives a restart.
+type MemoryRepository struct {
+	mu     sync.Mutex
+	hasher PasswordHasher
+
+	users           map[int32]*memoryUser
+	lastUserId      int32
+	usernameHistory []memoryUsernameChange
+	passwordHistory map[int32][]string
+	passwordResets  map[string]*memoryPasswordReset
+	sessions        map[string]*memorySession
+	refreshTokens   map[string]*memoryRefreshToken
+	revokedTokens   map[string]time.Time
+	loginFailures   map[string]*memoryLoginFailure
+	totp            map[int32]*memoryTOTP
+	recoveryCodes   map[int32][]*memoryRecoveryCode
+	identities      []*memoryIdentity
+	roles           map[string]Role
+	userRoles       map[int32]map[string]bool
+	auditEvents     []AuditEvent
+	outbox          []*memoryOutboxEvent
+	lastOutboxId    int64
+}
+
+type memoryUser struct {
+	User
+	password          string
+	passwordChangedAt time.Time
+	tokensValidAfter  time.Time
+	purgedAt          *time.Time
+}
+
+type memoryUsernameChange struct {
+	userId    int32
+	username  string
+	changedAt time.Time
+}
+
+type memoryPasswordReset struct {
+	userId    int32
+	expiresAt time.Time
+	usedAt    *time.Time
+}
+
+type memorySession struct {
+	Session
+	userId    int32
+	revokedAt *time.Time
+}
+
+type memoryRefreshToken struct {
+	userId    int32
+	familyId  string
+	expiresAt time.Time
+	usedAt    *time.Time
+	revokedAt *time.Time
+}
+
+type memoryLoginFailure struct {
+	failures     int
+	lastFailedAt time.Time
+	lockedUntil  *time.Time
+}
+
+type memoryTOTP struct {
+	secret       string
+	confirmedAt  *time.Time
+	lastUsedStep int64
+}
+
+type memoryRecoveryCode struct {
+	hash   string
+	usedAt *time.Time
+}
+
+type memoryIdentity struct {
+	userId int32
+	Identity
+	subject string
+}
+
+type memoryOutboxEvent struct {
+	id int64
+	*outboxEvent
+	publishedAt *time.Time
+	attempts    int
+	lastError   string
+	// relaying is set while a RelayOutbox call publishes the event, so a
+	// concurrent one skips it like SKIP LOCKED does.
+	relaying bool
+}
+
+// NewMemoryRepository returns an empty repository with the roles the
+// migrations create.
+func NewMemoryRepository(hasher PasswordHasher) *MemoryRepository {
+	return &MemoryRepository{
+		hasher:          hasher,
+		users:           make(map[int32]*memoryUser),
+		passwordHistory: make(map[int32][]string),
+		passwordResets:  make(map[string]*memoryPasswordReset),
+		sessions:        make(map[string]*memorySession),
+		refreshTokens:   make(map[string]*memoryRefreshToken),
+		revokedTokens:   make(map[string]time.Time),
+		loginFailures:   make(map[string]*memoryLoginFailure),
+		totp:            make(map[int32]*memoryTOTP),
+		recoveryCodes:   make(map[int32][]*memoryRecoveryCode),
+		roles: map[string]Role{
+			"admin": {
+				Name:        "admin",
+				Description: "Full access to every admin endpoint",
+				Permissions: []string{"audit:read", "roles:manage", "users:read", "users:write"},
+			},
+			"support": {
+				Name:        "support",
+				Description: "Read-only access to accounts for the support team",
+				Permissions: []string{"audit:read", "users:read"},
+			},
+		},
+		userRoles: make(map[int32]map[string]bool),
+	}
+}
+
+// user returns the account with the given id unless it was deleted.
+func (m *MemoryRepository) user(userId int32) *memoryUser {
+	if u, ok := m.users[userId]; ok && !u.IsDeleted {
+		return u
+	}
+	return nil
+}
+
+// userByEmail returns the account that is not deleted and has email.
+func (m *MemoryRepository) userByEmail(email string) *memoryUser {
+	for _, u := range m.users {
+		if !u.IsDeleted && u.Email != "" && u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (u *memoryUser) copy() *User {
+	user := u.User
+	return &user
+}
+
+// uniqueViolation mirrors the unique indexes on users: emails are unique
+// until the account is purged, phone numbers among accounts that are not
+// deleted and usernames regardless of case.
+func (m *MemoryRepository) uniqueViolation(user *User) error {
+	for _, other := range m.users {
+		switch {
+		case other.ID == user.ID:
+		case user.Email != "" && other.Email == user.Email:
+			return ErrEmailTaken
+		case user.PhoneNumber != "" && !user.IsDeleted && !other.IsDeleted && other.PhoneNumber == user.PhoneNumber:
+			return ErrPhoneNumberTaken
+		case user.Username != "" && strings.EqualFold(other.Username, user.Username):
+			return ErrUsernameTaken
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) enqueue(eventType string, userId int32, data any) error {
+	event, err := newOutboxEvent(eventType, userId, data)
+	if err != nil {
+		return err
+	}
+	m.lastOutboxId++
+	m.outbox = append(m.outbox, &memoryOutboxEvent{id: m.lastOutboxId, outboxEvent: event})
+	return nil
+}
+
+func (m *MemoryRepository) RegisterUser(c context.Context, user UserRegister) (*User, error) {
+	var hashing string
+	if user.Password != nil {
+		var err error
+		if hashing, err = m.hasher.Hash(*user.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	username := user.Username
+	if username != "" {
+		if !m.usernameAvailable(username, 0) {
+			return nil, ErrUsernameTaken
+		}
+	} else {
+		username = m.pickUsername(usernameFromEmail(user.Email))
+	}
+
+	now := time.Now()
+	created := &memoryUser{
+		User: User{
+			ID:          m.lastUserId + 1,
+			FullName:    user.FullName,
+			Username:    username,
+			Email:       user.Email,
+			PhoneNumber: user.PhoneNumber,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		},
+		password: hashing,
+	}
+	if hashing != "" {
+		created.passwordChangedAt = now
+	}
+	if err := m.uniqueViolation(&created.User); err != nil {
+		return nil, err
+	}
+	if err := m.enqueue(EventUserRegistered, created.ID, userEventData(&created.User)); err != nil {
+		return nil, err
+	}
+
+	m.lastUserId++
+	m.users[created.ID] = created
+	return created.copy(), nil
+}
+
+func (m *MemoryRepository) Authenticate(c context.Context, email, password string, policy PasswordPolicy) (int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.userByEmail(email)
+	if u == nil {
+		verifyWithoutPassword(m.hasher, password)
+		return 0, ErrInvalidCredentials
+	}
+	if u.password == "" {
+		verifyWithoutPassword(m.hasher, password)
+		return u.ID, ErrInvalidCredentials
+	}
+	if err := m.hasher.Verify(u.password, password); err != nil {
+		if err != ErrPasswordMismatch {
+			log.Printf("could not verify password of user %d: %v", u.ID, err)
+		}
+		return u.ID, ErrInvalidCredentials
+	}
+	if m.hasher.NeedsRehash(u.password) {
+		if newHash, err := m.hasher.Hash(password); err != nil {
+			log.Printf("could not rehash password of user %d: %v", u.ID, err)
+		} else {
+			u.password = newHash
+		}
+	}
+	if !u.IsActive {
+		return 0, ErrEmailNotVerified
+	}
+	if policy.expired(u.passwordChangedAt) {
+		return u.ID, ErrPasswordExpired
+	}
+	return u.ID, nil
+}
+
+func (m *MemoryRepository) FindUser(c context.Context, userId int32) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return nil, ErrUserNotFound
+	}
+	return u.copy(), nil
+}
+
+func (m *MemoryRepository) UpdateProfile(c context.Context, userId int32, update ProfileUpdate) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return nil, ErrUserNotFound
+	}
+
+	updated := u.User
+	if update.FullName != nil {
+		updated.FullName = strings.TrimSpace(*update.FullName)
+	}
+	if update.PhoneNumber != nil {
+		updated.PhoneNumber = *update.PhoneNumber
+	}
+	if update.Bio != nil {
+		updated.Bio = *update.Bio
+	}
+	if update.AvatarURL != nil {
+		updated.AvatarURL = *update.AvatarURL
+	}
+	if update.Locale != nil {
+		updated.Locale = *update.Locale
+	}
+	if update.Timezone != nil {
+		updated.Timezone = *update.Timezone
+	}
+	if update.DateOfBirth != nil {
+		updated.DateOfBirth = nil
+		if *update.DateOfBirth != "" {
+			dob, err := time.Parse(time.DateOnly, *update.DateOfBirth)
+			if err != nil {
+				return nil, fmt.Errorf("could not update user: %v", err)
+			}
+			updated.DateOfBirth = &dob
+		}
+	}
+	updated.UpdatedAt = time.Now()
+
+	if err := m.uniqueViolation(&updated); err != nil {
+		return nil, err
+	}
+	if err := m.enqueue(EventUserUpdated, userId, userEventData(&updated)); err != nil {
+		return nil, err
+	}
+	u.User = updated
+	return u.copy(), nil
+}
+
+func (m *MemoryRepository) ChangePassword(c context.Context, userId int32, currentPassword, newPassword string, historySize int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	if u.password == "" {
+		return ErrPasswordNotSet
+	}
+	if err := m.hasher.Verify(u.password, currentPassword); err != nil {
+		return ErrIncorrectPassword
+	}
+	if m.hasher.Verify(u.password, newPassword) == nil {
+		return ErrPasswordUnchanged
+	}
+	if err := m.checkPasswordHistory(u, newPassword, historySize); err != nil {
+		return err
+	}
+	if err := m.setPassword(u, newPassword, historySize); err != nil {
+		return err
+	}
+	m.revokeUserTokens(u)
+	return nil
+}
+
+// checkPasswordHistory works like UserRepository.checkPasswordHistory.
+func (m *MemoryRepository) checkPasswordHistory(u *memoryUser, newPassword string, historySize int) error {
+	if historySize <= 0 {
+		return nil
+	}
+	if u.password != "" && m.hasher.Verify(u.password, newPassword) == nil {
+		return ErrPasswordReused
+	}
+	history := m.passwordHistory[u.ID]
+	for i := len(history) - 1; i >= 0 && i >= len(history)-(historySize-1); i-- {
+		if m.hasher.Verify(history[i], newPassword) == nil {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+// setPassword works like UserRepository.setPassword. The history is kept
+// oldest first.
+func (m *MemoryRepository) setPassword(u *memoryUser, newPassword string, historySize int) error {
+	newHash, err := m.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+
+	history := m.passwordHistory[u.ID]
+	keep := max(historySize-1, 0)
+	if u.password != "" && keep > 0 {
+		history = append(history, u.password)
+	}
+	if len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	m.passwordHistory[u.ID] = history
+
+	now := time.Now()
+	u.password = newHash
+	u.passwordChangedAt = now
+	u.UpdatedAt = now
+	return nil
+}
+
+func (m *MemoryRepository) VerifyEmail(c context.Context, userId int32, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil || u.Email != email {
+		return ErrInvalidVerifyToken
+	}
+	updated := u.User
+	updated.IsActive = true
+	updated.UpdatedAt = time.Now()
+	if err := m.enqueue(EventUserUpdated, userId, userEventData(&updated)); err != nil {
+		return err
+	}
+	u.User = updated
+	return nil
+}
+
+func (m *MemoryRepository) FindUnverifiedUser(c context.Context, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.userByEmail(email)
+	if u == nil || u.IsActive {
+		return nil, ErrUserNotFound
+	}
+	return u.copy(), nil
+}
+
+// compareUsers orders users by the sort key of filter, then by id.
+func compareUsers(a, b *User, sortBy string) int {
+	var order int
+	switch sortBy {
+	case "email":
+		order = strings.Compare(a.Email, b.Email)
+	case "username":
+		order = strings.Compare(a.Username, b.Username)
+	default:
+		order = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if order == 0 {
+		order = cmp.Compare(a.ID, b.ID)
+	}
+	return order
+}
+
+func (m *MemoryRepository) ListUsers(c context.Context, filter UserFilter) (*UserPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emailPrefix := strings.ToLower(filter.EmailPrefix)
+	usernamePrefix := strings.ToLower(filter.UsernamePrefix)
+	var users []*User
+	for _, u := range m.users {
+		switch {
+		case filter.Active != nil && u.IsActive != *filter.Active,
+			filter.Deleted != nil && u.IsDeleted != *filter.Deleted,
+			filter.CreatedAfter != nil && u.CreatedAt.Before(*filter.CreatedAfter),
+			filter.CreatedBefore != nil && !u.CreatedAt.Before(*filter.CreatedBefore),
+			emailPrefix != "" && (u.Email == "" || !strings.HasPrefix(strings.ToLower(u.Email), emailPrefix)),
+			usernamePrefix != "" && (u.Username == "" || !strings.HasPrefix(strings.ToLower(u.Username), usernamePrefix)):
+			continue
+		}
+		users = append(users, u.copy())
+	}
+
+	direction := 1
+	if filter.Descending {
+		direction = -1
+	}
+	slices.SortFunc(users, func(a, b *User) int {
+		return direction * compareUsers(a, b, filter.SortBy)
+	})
+
+	page := &UserPage{TotalCount: int64(len(users))}
+	if filter.PageToken != "" {
+		value, lastId, err := decodeUserPageToken(filter)
+		if err != nil {
+			return nil, err
+		}
+		last := &User{ID: lastId}
+		switch value := value.(type) {
+		case time.Time:
+			last.CreatedAt = value
+		case string:
+			last.Email, last.Username = value, value
+		}
+		users = slices.DeleteFunc(users, func(u *User) bool {
+			return direction*compareUsers(u, last, filter.SortBy) <= 0
+		})
+	}
+
+	for _, u := range users[:min(len(users), filter.PageSize)] {
+		page.Users = append(page.Users, *u)
+	}
+	if len(users) > filter.PageSize {
+		page.NextPageToken = userPageToken(filter, page.Users[len(page.Users)-1])
+	}
+	return page, nil
+}
+
+func (m *MemoryRepository) UsernameAvailable(c context.Context, username string, exceptUserId int32) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usernameAvailable(username, exceptUserId), nil
+}
+
+func (m *MemoryRepository) usernameAvailable(username string, exceptUserId int32) bool {
+	for _, u := range m.users {
+		if u.ID != exceptUserId && strings.EqualFold(u.Username, username) {
+			return false
+		}
+	}
+	for _, change := range m.usernameHistory {
+		if change.userId != exceptUserId && strings.EqualFold(change.username, username) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemoryRepository) pickUsername(base string) string {
+	taken := make(map[string]bool)
+	for _, u := range m.users {
+		if name := strings.ToLower(u.Username); strings.HasPrefix(name, base) {
+			taken[name] = true
+		}
+	}
+	for _, change := range m.usernameHistory {
+		if name := strings.ToLower(change.username); strings.HasPrefix(name, base) {
+			taken[name] = true
+		}
+	}
+	return freeUsername(base, taken)
+}
+
+func (m *MemoryRepository) ChangeUsername(c context.Context, userId int32, username string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return nil, ErrUserNotFound
+	}
+	for _, change := range m.usernameHistory {
+		if change.userId != userId && strings.EqualFold(change.username, username) {
+			return nil, ErrUsernameTaken
+		}
+	}
+
+	updated := u.User
+	updated.Username = username
+	updated.UpdatedAt = time.Now()
+	if err := m.uniqueViolation(&updated); err != nil {
+		return nil, err
+	}
+	if err := m.enqueue(EventUserUpdated, userId, userEventData(&updated)); err != nil {
+		return nil, err
+	}
+
+	m.usernameHistory = slices.DeleteFunc(m.usernameHistory, func(change memoryUsernameChange) bool {
+		return change.userId == userId && strings.EqualFold(change.username, username)
+	})
+	if u.Username != "" && !strings.EqualFold(u.Username, username) {
+		m.usernameHistory = append(m.usernameHistory, memoryUsernameChange{userId: userId, username: u.Username, changedAt: updated.UpdatedAt})
+	}
+	u.User = updated
+	return u.copy(), nil
+}
+
+func (m *MemoryRepository) ResolveUsername(c context.Context, username string) (int32, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if !u.IsDeleted && strings.EqualFold(u.Username, username) {
+			return u.ID, u.Username, nil
+		}
+	}
+	for _, change := range m.usernameHistory {
+		if strings.EqualFold(change.username, username) {
+			if u := m.user(change.userId); u != nil {
+				return u.ID, u.Username, nil
+			}
+		}
+	}
+	return 0, "", ErrUserNotFound
+}
+
+func (m *MemoryRepository) DeleteAccount(c context.Context, userId int32, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	if u.password == "" {
+		return ErrPasswordNotSet
+	}
+	if err := m.hasher.Verify(u.password, password); err != nil {
+		return ErrIncorrectPassword
+	}
+
+	now := time.Now()
+	if err := m.enqueue(EventUserDeleted, userId, UserDeletedData{UserID: userId, DeletedAt: now.UTC()}); err != nil {
+		return err
+	}
+	u.IsDeleted = true
+	u.DeletedAt = &now
+	u.UpdatedAt = now
+	m.revokeUserTokens(u)
+	return nil
+}
+
+func (m *MemoryRepository) RestoreUser(c context.Context, userId int32, gracePeriod time.Duration) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userId]
+	if !ok || !u.IsDeleted {
+		return nil, ErrUserNotFound
+	}
+	now := time.Now()
+	if u.purgedAt != nil || !u.DeletedAt.After(now.Add(-gracePeriod)) {
+		return nil, ErrRestoreWindowExpired
+	}
+
+	restored := u.User
+	restored.IsDeleted = false
+	restored.DeletedAt = nil
+	restored.UpdatedAt = now
+	if err := m.uniqueViolation(&restored); err != nil {
+		return nil, err
+	}
+	if err := m.enqueue(EventUserUpdated, userId, userEventData(&restored)); err != nil {
+		return nil, err
+	}
+	u.User = restored
+	return u.copy(), nil
+}
+
+func (m *MemoryRepository) PurgeDeletedUsers(c context.Context, retention time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var purged []*memoryUser
+	for _, u := range m.users {
+		if u.IsDeleted && u.purgedAt == nil && u.DeletedAt.Before(now.Add(-retention)) {
+			purged = append(purged, u)
+		}
+	}
+	sort.Slice(purged, func(i, j int) bool { return purged[i].ID < purged[j].ID })
+
+	for _, u := range purged {
+		if err := m.enqueue(EventUserDeleted, u.ID, UserDeletedData{UserID: u.ID, DeletedAt: u.DeletedAt.UTC(), Purged: true}); err != nil {
+			return 0, err
+		}
+	}
+	for _, u := range purged {
+		u.User = User{
+			ID:        u.ID,
+			CreatedAt: u.CreatedAt,
+			UpdatedAt: now,
+			IsDeleted: true,
+			DeletedAt: u.DeletedAt,
+		}
+		u.password = ""
+		u.passwordChangedAt = time.Time{}
+		u.purgedAt = &now
+
+		for id, session := range m.sessions {
+			if session.userId == u.ID {
+				delete(m.sessions, id)
+			}
+		}
+		for hash, token := range m.refreshTokens {
+			if token.userId == u.ID {
+				delete(m.refreshTokens, hash)
+			}
+		}
+		m.identities = slices.DeleteFunc(m.identities, func(identity *memoryIdentity) bool { return identity.userId == u.ID })
+		for hash, reset := range m.passwordResets {
+			if reset.userId == u.ID {
+				delete(m.passwordResets, hash)
+			}
+		}
+		delete(m.passwordHistory, u.ID)
+		delete(m.totp, u.ID)
+		delete(m.recoveryCodes, u.ID)
+		m.usernameHistory = slices.DeleteFunc(m.usernameHistory, func(change memoryUsernameChange) bool { return change.userId == u.ID })
+		delete(m.userRoles, u.ID)
+		for i, event := range m.auditEvents {
+			if event.ActorID != u.ID && event.TargetID != u.ID {
+				continue
+			}
+			event.IPAddress, event.UserAgent = "", ""
+			if event.Details != nil {
+				details := maps.Clone(event.Details)
+				delete(details, "email")
+				delete(details, "username")
+				event.Details = details
+			}
+			m.auditEvents[i] = event
+		}
+	}
+	return int64(len(purged)), nil
+}
+
+func (m *MemoryRepository) CreatePasswordReset(c context.Context, email string) (*User, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.userByEmail(email)
+	if u == nil {
+		return nil, "", ErrUserNotFound
+	}
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	m.passwordResets[hashToken(token)] = &memoryPasswordReset{userId: u.ID, expiresAt: time.Now().Add(passwordResetTTL)}
+	return &User{ID: u.ID, FullName: u.FullName, Email: u.Email}, token, nil
+}
+
+// passwordResetUser returns the user of a usable reset token.
+func (m *MemoryRepository) passwordResetUser(token string) *memoryUser {
+	reset, ok := m.passwordResets[hashToken(token)]
+	if !ok || reset.usedAt != nil || !reset.expiresAt.After(time.Now()) {
+		return nil
+	}
+	return m.user(reset.userId)
+}
+
+func (m *MemoryRepository) FindPasswordResetUser(c context.Context, token string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.passwordResetUser(token)
+	if u == nil {
+		return nil, ErrInvalidResetToken
+	}
+	return u.copy(), nil
+}
+
+func (m *MemoryRepository) ResetPassword(c context.Context, token, newPassword string, historySize int) (int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.passwordResetUser(token)
+	if u == nil {
+		return 0, ErrInvalidResetToken
+	}
+	if err := m.checkPasswordHistory(u, newPassword, historySize); err != nil {
+		return u.ID, err
+	}
+	if err := m.setPassword(u, newPassword, historySize); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, reset := range m.passwordResets {
+		if reset.userId == u.ID && reset.usedAt == nil {
+			reset.usedAt = &now
+		}
+	}
+	m.revokeUserTokens(u)
+	return u.ID, nil
+}
+
+// insertRefreshToken adds a token to the session familyId and returns the
+// raw token with its expiry.
+func (m *MemoryRepository) insertRefreshToken(userId int32, familyId string) (string, time.Time, error) {
+	raw, err := generateOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(refreshTokenTTL)
+	m.refreshTokens[hashToken(raw)] = &memoryRefreshToken{userId: userId, familyId: familyId, expiresAt: expiresAt}
+	return raw, expiresAt, nil
+}
+
+func (m *MemoryRepository) CreateSession(c context.Context, userId int32, client ClientInfo) (*IssuedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userId]; !ok {
+		return nil, fmt.Errorf("could not insert session: user %d does not exist", userId)
+	}
+	sessionId, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, expiresAt, err := m.insertRefreshToken(userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	m.sessions[sessionId] = &memorySession{
+		Session: Session{
+			ID:          sessionId,
+			UserAgent:   truncate(client.UserAgent, 512),
+			IPAddress:   truncate(client.IP, 64),
+			DeviceLabel: truncate(client.DeviceLabel, 100),
+			CreatedAt:   now,
+			LastSeenAt:  now,
+			ExpiresAt:   expiresAt,
+		},
+		userId: userId,
+	}
+	return &IssuedSession{
+		UserID:           userId,
+		SessionID:        sessionId,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: expiresAt,
+		Access:           m.userAccess(userId),
+	}, nil
+}
+
+func (m *MemoryRepository) RotateRefreshToken(c context.Context, refreshToken string, client ClientInfo) (*IssuedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[hashToken(refreshToken)]
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+	if u := m.user(token.userId); u == nil || !u.IsActive {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	if token.usedAt != nil && token.revokedAt == nil {
+		m.revokeSessions(func(s *memorySession) bool { return s.ID == token.familyId })
+		return nil, ErrRefreshTokenReused
+	}
+	if token.revokedAt != nil || token.usedAt != nil || now.After(token.expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	newRefreshToken, newExpiresAt, err := m.insertRefreshToken(token.userId, token.familyId)
+	if err != nil {
+		return nil, err
+	}
+	token.usedAt = &now
+	if session, ok := m.sessions[token.familyId]; ok {
+		session.LastSeenAt = now
+		session.ExpiresAt = newExpiresAt
+		if client.IP != "" {
+			session.IPAddress = truncate(client.IP, 64)
+		}
+	}
+
+	return &IssuedSession{
+		UserID:           token.userId,
+		SessionID:        token.familyId,
+		RefreshToken:     newRefreshToken,
+		RefreshExpiresAt: newExpiresAt,
+		Access:           m.userAccess(token.userId),
+	}, nil
+}
+
+// revokeSessions ends the sessions matching match together with their
+// refresh tokens and returns how many were ended.
+func (m *MemoryRepository) revokeSessions(match func(s *memorySession) bool) int64 {
+	now := time.Now()
+	var revoked int64
+	for _, session := range m.sessions {
+		if session.revokedAt != nil || !match(session) {
+			continue
+		}
+		session.revokedAt = &now
+		revoked++
+		for _, token := range m.refreshTokens {
+			if token.familyId == session.ID && token.revokedAt == nil {
+				token.revokedAt = &now
+			}
+		}
+	}
+	return revoked
+}
+
+// revokeUserTokens works like the function of the same name for SQL.
+func (m *MemoryRepository) revokeUserTokens(u *memoryUser) {
+	u.tokensValidAfter = time.Now().Truncate(time.Second)
+	m.revokeSessions(func(s *memorySession) bool { return s.userId == u.ID })
+}
+
+func (m *MemoryRepository) ListSessions(c context.Context, userId int32) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range m.sessions {
+		if session.userId == userId && session.revokedAt == nil && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (m *MemoryRepository) RevokeSession(c context.Context, userId int32, sessionId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revoked := m.revokeSessions(func(s *memorySession) bool { return s.ID == sessionId && s.userId == userId })
+	if revoked == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (m *MemoryRepository) RevokeOtherSessions(c context.Context, userId int32, currentSessionId string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.revokeSessions(func(s *memorySession) bool { return s.userId == userId && s.ID != currentSessionId }), nil
+}
+
+func (m *MemoryRepository) RevokeAccessToken(c context.Context, jti string, userId int32, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.revokedTokens[jti]; !ok {
+		m.revokedTokens[jti] = expiresAt
+	}
+	return nil
+}
+
+func (m *MemoryRepository) RevokeRefreshTokenFamily(c context.Context, refreshToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if token, ok := m.refreshTokens[hashToken(refreshToken)]; ok {
+		m.revokeSessions(func(s *memorySession) bool { return s.ID == token.familyId })
+	}
+	return nil
+}
+
+func (m *MemoryRepository) IsTokenRevoked(c context.Context, jti, sessionId string, userId int32, issuedAt, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if jti == "" {
+		return true, nil
+	}
+	u := m.user(userId)
+	if u == nil || !u.IsActive {
+		return true, nil
+	}
+	if issuedAt.Before(u.tokensValidAfter) {
+		return true, nil
+	}
+	if _, ok := m.revokedTokens[jti]; ok {
+		return true, nil
+	}
+	session, ok := m.sessions[sessionId]
+	return ok && session.revokedAt != nil, nil
+}
+
+func (m *MemoryRepository) PruneRevokedTokens(c context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for jti, expiresAt := range m.revokedTokens {
+		if expiresAt.Before(now) {
+			delete(m.revokedTokens, jti)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) ReserveLoginAttempt(c context.Context, throttle LoginThrottle, key string, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	lf, ok := m.loginFailures[key]
+	if !ok {
+		lf = &memoryLoginFailure{}
+	}
+	var wait time.Duration
+	if lf.lockedUntil != nil {
+		wait = lf.lockedUntil.Sub(now)
+	}
+	failures := lf.failures
+	if !lf.lastFailedAt.After(now.Add(-throttle.FailureWindow)) {
+		failures = 0
+	}
+	wait = max(wait, lf.lastFailedAt.Add(throttle.delay(failures)).Sub(now))
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	lf.failures = failures + 1
+	lf.lastFailedAt = now
+	if lf.failures >= limit {
+		lockedUntil := now.Add(throttle.LockoutDuration)
+		lf.lockedUntil = &lockedUntil
+	}
+	m.loginFailures[key] = lf
+	return nil
+}
+
+func (m *MemoryRepository) ReleaseLoginAttempt(c context.Context, key string, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lf, ok := m.loginFailures[key]
+	if !ok || lf.failures == 0 {
+		return nil
+	}
+	lf.failures--
+	if lf.failures < limit {
+		lf.lockedUntil = nil
+	}
+	return nil
+}
+
+func (m *MemoryRepository) ClearLoginFailures(c context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, key)
+	return nil
+}
+
+func (m *MemoryRepository) UnlockUser(c context.Context, userId int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	delete(m.loginFailures, accountThrottleKey(u.Email))
+	delete(m.loginFailures, mfaThrottleKey(strconv.Itoa(int(userId))))
+	return nil
+}
+
+func (m *MemoryRepository) PruneLoginFailures(c context.Context, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, lf := range m.loginFailures {
+		if lf.lastFailedAt.Before(now.Add(-window)) && (lf.lockedUntil == nil || lf.lockedUntil.Before(now)) {
+			delete(m.loginFailures, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) EnrollTOTP(c context.Context, userId int32) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return "", "", ErrUserNotFound
+	}
+	if totp, ok := m.totp[userId]; ok && totp.confirmedAt != nil {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	m.totp[userId] = &memoryTOTP{secret: secret}
+	return secret, u.Email, nil
+}
+
+func (m *MemoryRepository) ConfirmTOTP(c context.Context, userId int32, code string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[userId]
+	if !ok {
+		return nil, ErrMFANotEnrolled
+	}
+	if totp.confirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	now := time.Now()
+	step, ok := validateTOTP(totp.secret, code, now, 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	stored := make([]*memoryRecoveryCode, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		stored = append(stored, &memoryRecoveryCode{hash: hashToken(normalizeRecoveryCode(code))})
+	}
+
+	totp.confirmedAt = &now
+	totp.lastUsedStep = step
+	m.recoveryCodes[userId] = stored
+	return codes, nil
+}
+
+func (m *MemoryRepository) DisableTOTP(c context.Context, userId int32, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	if u.password == "" {
+		return ErrPasswordNotSet
+	}
+	if err := m.hasher.Verify(u.password, password); err != nil {
+		return ErrIncorrectPassword
+	}
+	if _, ok := m.totp[userId]; !ok {
+		return ErrMFANotEnrolled
+	}
+	delete(m.totp, userId)
+	delete(m.recoveryCodes, userId)
+	return nil
+}
+
+func (m *MemoryRepository) MFAEnabled(c context.Context, userId int32) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[userId]
+	return ok && totp.confirmedAt != nil, nil
+}
+
+func (m *MemoryRepository) VerifyMFACode(c context.Context, userId int32, code, recoveryCode string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if recoveryCode != "" {
+		hash := hashToken(normalizeRecoveryCode(recoveryCode))
+		for _, stored := range m.recoveryCodes[userId] {
+			if stored.hash == hash && stored.usedAt == nil {
+				stored.usedAt = &now
+				return nil
+			}
+		}
+		return ErrInvalidMFACode
+	}
+
+	totp, ok := m.totp[userId]
+	if !ok || totp.confirmedAt == nil {
+		return ErrMFANotEnrolled
+	}
+	step, ok := validateTOTP(totp.secret, code, now, totp.lastUsedStep)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	totp.lastUsedStep = step
+	return nil
+}
+
+// identityTaken reports whether ext, or another identity at the same
+// provider, is already linked so that linking ext to userId would break the
+// unique indexes on identities.
+func (m *MemoryRepository) identityTaken(userId int32, ext ExternalIdentity) bool {
+	for _, identity := range m.identities {
+		if identity.Provider == ext.Provider && (identity.subject == ext.Subject || identity.userId == userId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryRepository) insertIdentity(userId int32, ext ExternalIdentity, lastLoginAt *time.Time) {
+	m.identities = append(m.identities, &memoryIdentity{
+		userId: userId,
+		Identity: Identity{
+			Provider:    ext.Provider,
+			Email:       ext.Email,
+			CreatedAt:   time.Now(),
+			LastLoginAt: lastLoginAt,
+		},
+		subject: ext.Subject,
+	})
+}
+
+func (m *MemoryRepository) FindOrCreateExternalUser(c context.Context, ext ExternalIdentity) (int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, identity := range m.identities {
+		if identity.Provider == ext.Provider && identity.subject == ext.Subject && m.user(identity.userId) != nil {
+			identity.LastLoginAt = &now
+			return identity.userId, nil
+		}
+	}
+
+	if ext.Email == "" || !ext.EmailVerified {
+		return 0, ErrExternalEmailRequired
+	}
+
+	if u := m.userByEmail(ext.Email); u != nil {
+		if m.identityTaken(u.ID, ext) {
+			return 0, ErrIdentityTaken
+		}
+		if !u.IsActive {
+			// See UserRepository.FindOrCreateExternalUser for why the
+			// password is dropped.
+			activated := u.User
+			activated.IsActive = true
+			activated.UpdatedAt = now
+			if err := m.enqueue(EventUserUpdated, u.ID, userEventData(&activated)); err != nil {
+				return 0, err
+			}
+			u.User = activated
+			u.password = ""
+			u.passwordChangedAt = time.Time{}
+		}
+		m.insertIdentity(u.ID, ext, &now)
+		return u.ID, nil
+	}
+
+	created := &memoryUser{User: User{
+		ID:        m.lastUserId + 1,
+		FullName:  strings.TrimSpace(ext.FullName),
+		Username:  m.pickUsername(usernameFromEmail(ext.Email)),
+		Email:     ext.Email,
+		IsActive:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}}
+	if err := m.uniqueViolation(&created.User); err != nil {
+		return 0, err
+	}
+	if m.identityTaken(created.ID, ext) {
+		return 0, ErrIdentityTaken
+	}
+	if err := m.enqueue(EventUserRegistered, created.ID, userEventData(&created.User)); err != nil {
+		return 0, err
+	}
+	m.lastUserId++
+	m.users[created.ID] = created
+	m.insertIdentity(created.ID, ext, &now)
+	return created.ID, nil
+}
+
+func (m *MemoryRepository) LinkIdentity(c context.Context, userId int32, ext ExternalIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, identity := range m.identities {
+		if identity.Provider == ext.Provider && identity.subject == ext.Subject {
+			if identity.userId == userId {
+				return nil
+			}
+			return ErrIdentityTaken
+		}
+	}
+	if m.user(userId) == nil {
+		return ErrUserNotFound
+	}
+	if m.identityTaken(userId, ext) {
+		return ErrIdentityTaken
+	}
+	m.insertIdentity(userId, ext, nil)
+	return nil
+}
+
+func (m *MemoryRepository) UnlinkIdentity(c context.Context, userId int32, provider string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.user(userId)
+	if u == nil {
+		return ErrUserNotFound
+	}
+	linked, found := 0, -1
+	for i, identity := range m.identities {
+		if identity.userId == userId {
+			linked++
+			if identity.Provider == provider {
+				found = i
+			}
+		}
+	}
+	if found < 0 {
+		return ErrIdentityNotFound
+	}
+	if u.password == "" && linked <= 1 {
+		return ErrLastLoginMethod
+	}
+	m.identities = slices.Delete(m.identities, found, found+1)
+	return nil
+}
+
+func (m *MemoryRepository) ListIdentities(c context.Context, userId int32) ([]Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	identities := []Identity{}
+	for _, identity := range m.identities {
+		if identity.userId == userId {
+			identities = append(identities, identity.Identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Provider < identities[j].Provider })
+	return identities, nil
+}
+
+// userAccess works like the function of the same name for SQL.
+func (m *MemoryRepository) userAccess(userId int32) UserAccess {
+	var access UserAccess
+	seen := make(map[string]bool)
+	for name := range m.userRoles[userId] {
+		access.Roles = append(access.Roles, name)
+		for _, permission := range m.roles[name].Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				access.Permissions = append(access.Permissions, permission)
+			}
+		}
+	}
+	sort.Strings(access.Roles)
+	sort.Strings(access.Permissions)
+	return access
+}
+
+func (m *MemoryRepository) ListRoles(c context.Context, userId int32) ([]Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles := []Role{}
+	for name, role := range m.roles {
+		if userId == 0 || m.userRoles[userId][name] {
+			role.Permissions = slices.Clone(role.Permissions)
+			roles = append(roles, role)
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// roleTargetError works like UserRepository.roleTargetError.
+func (m *MemoryRepository) roleTargetError(userId int32, role string) error {
+	if m.user(userId) == nil {
+		return ErrUserNotFound
+	}
+	if _, ok := m.roles[role]; !ok {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func (m *MemoryRepository) AssignRole(c context.Context, userId int32, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.roleTargetError(userId, role); err != nil {
+		return err
+	}
+	if m.userRoles[userId] == nil {
+		m.userRoles[userId] = make(map[string]bool)
+	}
+	m.userRoles[userId][role] = true
+	return nil
+}
+
+func (m *MemoryRepository) RevokeRole(c context.Context, userId int32, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.userRoles[userId][role] {
+		return m.roleTargetError(userId, role)
+	}
+	delete(m.userRoles[userId], role)
+	if u, ok := m.users[userId]; ok {
+		m.revokeUserTokens(u)
+	}
+	return nil
+}
+
+func (m *MemoryRepository) InsertAuditEvent(c context.Context, event AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.ID = int64(len(m.auditEvents)) + 1
+	event.OccurredAt = time.Now()
+	event.IPAddress = truncate(event.IPAddress, 64)
+	event.UserAgent = truncate(event.UserAgent, 512)
+	event.RequestID = truncate(event.RequestID, 64)
+	if len(event.Details) == 0 {
+		event.Details = nil
+	} else {
+		details := make(map[string]string, len(event.Details))
+		for k, v := range event.Details {
+			details[k] = v
+		}
+		event.Details = details
+	}
+	m.auditEvents = append(m.auditEvents, event)
+	return nil
+}
+
+func (m *MemoryRepository) ListAuditEvents(c context.Context, filter AuditFilter) (*AuditPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lastId := int64(len(m.auditEvents)) + 1
+	if filter.PageToken != "" {
+		var err error
+		if lastId, err = decodeAuditPageToken(filter.PageToken); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &AuditPage{Events: []AuditEvent{}}
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		event := m.auditEvents[i]
+		switch {
+		case event.ID >= lastId,
+			filter.UserID != 0 && event.ActorID != filter.UserID && event.TargetID != filter.UserID,
+			filter.TargetID != 0 && event.TargetID != filter.TargetID,
+			filter.Type != "" && event.Type != filter.Type,
+			filter.Outcome != "" && event.Outcome != filter.Outcome,
+			filter.Since != nil && event.OccurredAt.Before(*filter.Since),
+			filter.Until != nil && !event.OccurredAt.Before(*filter.Until):
+			continue
+		}
+		if len(page.Events) == filter.PageSize {
+			page.NextPageToken = encodeAuditPageToken(page.Events[len(page.Events)-1].ID)
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page, nil
+}
+
+// RelayOutbox publishes without holding the lock, so a slow broker does not
+// stall every other call. Events are marked once the publisher accepted
+// them, as with UserRepository.RelayOutbox, and skipped by other calls in
+// the meantime.
+func (m *MemoryRepository) RelayOutbox(c context.Context, publisher Publisher, limit int) (int, error) {
+	m.mu.Lock()
+	var pending []*memoryOutboxEvent
+	var events []EventMessage
+	for _, event := range m.outbox {
+		if len(pending) == limit {
+			break
+		}
+		if event.publishedAt == nil && !event.relaying {
+			event.relaying = true
+			pending = append(pending, event)
+			events = append(events, EventMessage{
+				Key:     fmt.Sprint(event.userId),
+				Type:    event.eventType,
+				Payload: event.payload,
+			})
+		}
+	}
+	m.mu.Unlock()
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	pc, cancel := context.WithTimeout(c, outboxPublishTimeout)
+	perr := publisher.Publish(pc, events...)
+	cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, event := range pending {
+		event.relaying = false
+		event.attempts++
+		if perr != nil {
+			event.lastError = truncate(perr.Error(), 1024)
+		} else {
+			event.publishedAt = &now
+			event.lastError = ""
+		}
+	}
+	if perr != nil {
+		return 0, fmt.Errorf("could not publish events: %v", perr)
+	}
+	return len(events), nil
+}
+
+func (m *MemoryRepository) PruneOutbox(c context.Context, retention time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	m.outbox = slices.DeleteFunc(m.outbox, func(event *memoryOutboxEvent) bool {
+		return event.publishedAt != nil && event.publishedAt.Before(cutoff)
+	})
+	return nil
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two-factor authentication is not enrolled")
+	ErrInvalidMFACode    = errors.New("invalid two-factor authentication code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired mfa token")
+)
+
+// generateRecoveryCode returns 50 random bits as a code like "k3v7q-7hx2m". Recovery codes
+// are random enough that a plain SHA-256 is a sufficient hash.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate recovery code: %v", err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode makes codes match regardless of case, spaces and
+// dashes typed by the user.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// EnrollTOTP stores a new, unconfirmed secret for the user, replacing any
+// earlier unconfirmed one, and returns it with the user's email.
+func (r *UserRepository) EnrollTOTP(c context.Context, userID int32) (string, string, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var email string
+	var confirmedAt sql.NullTime
+	err = tx.QueryRowContext(c, `
+		SELECT coalesce(u.email, ''), t.confirmed_at
+		FROM users u
+		LEFT JOIN user_totp t ON t.user_id = u.id
+		WHERE u.id = $1 AND u.is_deleted = false
+		FOR UPDATE OF u;
+	`, userID).Scan(&email, &confirmedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrUserNotFound
+		}
+		return "", "", fmt.Errorf("could not query user: %v", err)
+	}
+	if confirmedAt.Valid {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := tx.ExecContext(c, `
+		INSERT INTO user_totp (user_id, secret, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_used_step = 0, created_at = $3;
+	`, userID, secret, time.Now()); err != nil {
+		return "", "", fmt.Errorf("could not store totp secret: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return secret, email, nil
+}
+
+// ConfirmTOTP turns two-factor authentication on once code matches the
+// enrolled secret, and returns a fresh set of recovery codes. The codes are
+// only stored hashed, so this is the only time they can be shown.
+func (r *UserRepository) ConfirmTOTP(c context.Context, userID int32, code string) ([]string, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var confirmedAt sql.NullTime
+	err = tx.QueryRowContext(c, `
+		SELECT secret, confirmed_at FROM user_totp WHERE user_id = $1 FOR UPDATE;
+	`, userID).Scan(&secret, &confirmedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, fmt.Errorf("could not query totp: %v", err)
+	}
+	if confirmedAt.Valid {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	now := time.Now()
+	step, ok := validateTOTP(secret, code, now, 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	if _, err := tx.ExecContext(c, `
+		UPDATE user_totp SET confirmed_at = $2, last_used_step = $3 WHERE user_id = $1;
+	`, userID, now, step); err != nil {
+		return nil, fmt.Errorf("could not confirm totp: %v", err)
+	}
+
+	codes, err := replaceRecoveryCodes(c, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return codes, nil
+}
+
+func replaceRecoveryCodes(c context.Context, tx *sql.Tx, userID int32) ([]string, error) {
+	if _, err := tx.ExecContext(c, `DELETE FROM recovery_codes WHERE user_id = $1;`, userID); err != nil {
+		return nil, fmt.Errorf("could not delete recovery codes: %v", err)
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(c, `
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2);
+		`, userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, fmt.Errorf("could not store recovery code: %v", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking the
+// password, dropping the secret and the recovery codes.
+func (r *UserRepository) DisableTOTP(c context.Context, userID int32, password string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var hashedPassword string
+	err = tx.QueryRowContext(c, `
+		SELECT coalesce(password, '') FROM users WHERE id = $1 AND is_deleted = false FOR UPDATE;
+	`, userID).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("could not query user: %v", err)
+	}
+	if hashedPassword == "" {
+		return ErrPasswordNotSet
+	}
+	if err := r.hasher.Verify(hashedPassword, password); err != nil {
+		return ErrIncorrectPassword
+	}
+
+	res, err := tx.ExecContext(c, `DELETE FROM user_totp WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("could not delete totp: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrMFANotEnrolled
+	}
+	if _, err := tx.ExecContext(c, `DELETE FROM recovery_codes WHERE user_id = $1;`, userID); err != nil {
+		return fmt.Errorf("could not delete recovery codes: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) MFAEnabled(c context.Context, userID int32) (bool, error) {
+	var enabled bool
+	err := r.db.QueryRowContext(c, `
+		SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL);
+	`, userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("could not query totp: %v", err)
+	}
+	return enabled, nil
+}
+
+// VerifyMFACode accepts either a current TOTP code or an unused recovery
+// code, which is used up.
+func (r *UserRepository) VerifyMFACode(c context.Context, userID int32, code, recoveryCode string) error {
+	now := time.Now()
+
+	if recoveryCode != "" {
+		res, err := r.db.ExecContext(c, `
+			UPDATE recovery_codes SET used_at = $3
+			WHERE id = (
+			    SELECT id FROM recovery_codes
+			    WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+			    LIMIT 1
+			);
+		`, userID, hashToken(normalizeRecoveryCode(recoveryCode)), now)
+		if err != nil {
+			return fmt.Errorf("could not use recovery code: %v", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastUsedStep int64
+	err = tx.QueryRowContext(c, `
+		SELECT secret, last_used_step FROM user_totp
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL
+		FOR UPDATE;
+	`, userID).Scan(&secret, &lastUsedStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFANotEnrolled
+		}
+		return fmt.Errorf("could not query totp: %v", err)
+	}
+
+	step, ok := validateTOTP(secret, code, now, lastUsedStep)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	if _, err := tx.ExecContext(c, `UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1;`, userID, step); err != nil {
+		return fmt.Errorf("could not update totp: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// currentTOTPStep returns the current time step, first waiting for the next
+// one when less than two seconds are left, so a test that works with codes
+// relative to it does not see the step change underneath.
+func currentTOTPStep() int64 {
+	now := time.Now()
+	if left := totpPeriod - now.Unix()%totpPeriod; left < 2 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+	return totpStep(time.Now())
+}
+
+// registerMFAUser registers an active account for email.
+func registerMFAUser(t *testing.T, repo Repository, email string) int32 {
+	t.Helper()
+	c := context.Background()
+	password := "correct horse battery staple"
+	user, err := repo.RegisterUser(c, UserRegister{FullName: "Two Factor", Email: email, Password: &password, PhoneNumber: "+628150000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.VerifyEmail(c, user.ID, email); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// enableTOTP enrolls the user and confirms with the code of confirmStep,
+// returning the secret and the recovery codes.
+func enableTOTP(t *testing.T, repo Repository, userId int32, confirmStep int64) (string, []string) {
+	t.Helper()
+	c := context.Background()
+	secret, _, err := repo.EnrollTOTP(c, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := repo.ConfirmTOTP(c, userId, codeAt(t, secret, confirmStep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, codes
+}
+
+func TestVerifyMFACodeReplay(t *testing.T) {
+	// Each case starts from TOTP confirmed with the code of the step before
+	// the current one. Offsets are relative to the current step.
+	tests := []struct {
+		name    string
+		offsets []int64
+		want    []error
+	}{
+		{"confirmation code cannot be replayed", []int64{-1}, []error{ErrInvalidMFACode}},
+		{"current code is accepted once", []int64{0, 0}, []error{nil, ErrInvalidMFACode}},
+		{"older code after a newer one", []int64{1, 0}, []error{nil, ErrInvalidMFACode}},
+		{"codes in order", []int64{0, 1}, []error{nil, nil}},
+		{"code outside the skew", []int64{2}, []error{ErrInvalidMFACode}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				userId := registerMFAUser(t, repo, "totp@example.com")
+				current := currentTOTPStep()
+				secret, _ := enableTOTP(t, repo, userId, current-1)
+
+				for i, offset := range tt.offsets {
+					err := repo.VerifyMFACode(c, userId, codeAt(t, secret, current+offset), "")
+					if !errors.Is(err, tt.want[i]) {
+						t.Fatalf("code %d at offset %d: got error %v, want %v", i, offset, err, tt.want[i])
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestVerifyMFACodeRecoveryCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		// codes picks the recovery codes to present from those issued.
+		codes func(issued []string) []string
+		want  []error
+	}{
+		{
+			name:  "code works once",
+			codes: func(issued []string) []string { return []string{issued[0], issued[0]} },
+			want:  []error{nil, ErrInvalidMFACode},
+		},
+		{
+			name:  "codes are independent",
+			codes: func(issued []string) []string { return []string{issued[0], issued[1]} },
+			want:  []error{nil, nil},
+		},
+		{
+			name: "case, spaces and dashes are ignored",
+			codes: func(issued []string) []string {
+				typed := strings.ToUpper(strings.ReplaceAll(issued[2], "-", " "))
+				return []string{typed, issued[2]}
+			},
+			want: []error{nil, ErrInvalidMFACode},
+		},
+		{
+			name:  "unknown code",
+			codes: func(issued []string) []string { return []string{"aaaaa-bbbbb"} },
+			want:  []error{ErrInvalidMFACode},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				userId := registerMFAUser(t, repo, "recovery@example.com")
+				_, issued := enableTOTP(t, repo, userId, currentTOTPStep())
+				if len(issued) != recoveryCodeCount {
+					t.Fatalf("got %d recovery codes, want %d", len(issued), recoveryCodeCount)
+				}
+
+				for i, code := range tt.codes(issued) {
+					err := repo.VerifyMFACode(c, userId, "", code)
+					if !errors.Is(err, tt.want[i]) {
+						t.Fatalf("recovery code %d: got error %v, want %v", i, err, tt.want[i])
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// User lifecycle event types published to Kafka. Consumers switch on them,
+// so existing values must never be renamed.
+const (
+	EventUserRegistered = "UserRegistered"
+	EventUserUpdated    = "UserUpdated"
+	EventUserDeleted    = "UserDeleted"
+)
+
+// EventSchemaVersion is bumped whenever a field of an event is removed or
+// changes meaning. Adding fields does not need a new version.
+const EventSchemaVersion = 1
+
+// EventEnvelope is the JSON document sent as the Kafka message value.
+// EventID stays the same when an event is delivered more than once, so
+// consumers can drop duplicates.
+type EventEnvelope struct {
+	EventID       string    `json:"eventId"`
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schemaVersion"`
+	OccurredAt    time.Time `json:"occurredAt"`
+	Data          any       `json:"data"`
+}
+
+// UserEventData is the data of UserRegistered and UserUpdated: the state of
+// the account after the change.
+type UserEventData struct {
+	UserID    int32     `json:"userId"`
+	Username  string    `json:"username"`
+	FullName  string    `json:"fullName"`
+	Email     string    `json:"email"`
+	IsActive  bool      `json:"isActive"`
+	AvatarURL string    `json:"avatarUrl,omitempty"`
+	Locale    string    `json:"locale,omitempty"`
+	Timezone  string    `json:"timezone,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// UserDeletedData is the data of UserDeleted. It is sent once when the
+// account is deleted and again with Purged set when its personal data is
+// erased, at which point consumers must drop their copies too.
+type UserDeletedData struct {
+	UserID    int32     `json:"userId"`
+	DeletedAt time.Time `json:"deletedAt"`
+	Purged    bool      `json:"purged"`
+}
+
+// outboxEvent is an event as stored in the outbox, before it is published.
+type outboxEvent struct {
+	eventId   string
+	eventType string
+	userId    int32
+	payload   []byte
+	createdAt time.Time
+}
+
+// newOutboxEvent wraps data in a new EventEnvelope.
+func newOutboxEvent(eventType string, userId int32, data any) (*outboxEvent, error) {
+	eventId, err := generateTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(EventEnvelope{
+		EventID:       eventId,
+		Type:          eventType,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    now.UTC(),
+		Data:          data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal %s event: %v", eventType, err)
+	}
+	return &outboxEvent{eventId: eventId, eventType: eventType, userId: userId, payload: payload, createdAt: now}, nil
+}
+
+// enqueueEvent stores an event in the outbox as part of tx, so it is
+// published if and only if the change it describes is committed.
+func enqueueEvent(c context.Context, tx *sql.Tx, eventType string, userId int32, data any) error {
+	event, err := newOutboxEvent(eventType, userId, data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		insert into outbox_events (
+		    event_id,
+		    event_type,
+		    user_id,
+		    payload,
+		    created_at
+		) values (
+			$1, $2, $3, $4, $5
+		)
+    `
+	if _, err := tx.ExecContext(c, query, event.eventId, event.eventType, event.userId, string(event.payload), event.createdAt); err != nil {
+		return fmt.Errorf("could not insert outbox event: %v", err)
+	}
+	return nil
+}
+
+func userEventData(user *User) UserEventData {
+	return UserEventData{
+		UserID:    user.ID,
+		Username:  user.Username,
+		FullName:  user.FullName,
+		Email:     user.Email,
+		IsActive:  user.IsActive,
+		AvatarURL: user.AvatarURL,
+		Locale:    user.Locale,
+		Timezone:  user.Timezone,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+func enqueueUserEvent(c context.Context, tx *sql.Tx, eventType string, user *User) error {
+	return enqueueEvent(c, tx, eventType, user.ID, userEventData(user))
+}
+
+// enqueueUserChange reads the user as seen by tx and enqueues an event with
+// that state, for changes that do not return the row themselves.
+func enqueueUserChange(c context.Context, tx *sql.Tx, eventType string, userId int32) error {
+	user, err := scanUser(tx.QueryRowContext(c, `SELECT `+userColumns+` FROM users WHERE id = $1;`, userId))
+	if err != nil {
+		return fmt.Errorf("could not query user: %v", err)
+	}
+	return enqueueUserEvent(c, tx, eventType, user)
+}
+
+func enqueueUserDeleted(c context.Context, tx *sql.Tx, userId int32, deletedAt time.Time, purged bool) error {
+	return enqueueEvent(c, tx, EventUserDeleted, userId, UserDeletedData{
+		UserID:    userId,
+		DeletedAt: deletedAt.UTC(),
+		Purged:    purged,
+	})
+}
+
+// outboxPublishTimeout bounds one Publish call. The relayed rows stay
+// locked while the broker is waited on, so a hanging broker must not hold
+// them, and the transaction, open for long.
+const outboxPublishTimeout = 30 * time.Second
+
+// OutboxRelay moves events from the outbox to the publisher. An event is
+// marked as published only after the publisher accepted it, so a crash in
+// between sends it again on the next run: delivery is at least once.
+type OutboxRelay struct {
+	repo      Repository
+	publisher Publisher
+	interval  time.Duration
+	batchSize int
+}
+
+func NewOutboxRelay(repo Repository, publisher Publisher, interval time.Duration, batchSize int) *OutboxRelay {
+	return &OutboxRelay{
+		repo:      repo,
+		publisher: publisher,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run publishes pending events every interval until c is cancelled. A full
+// batch is followed by the next one right away so a backlog drains quickly.
+func (r *OutboxRelay) Run(c context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		for c.Err() == nil {
+			n, err := r.repo.RelayOutbox(c, r.publisher, r.batchSize)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if n < r.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOutbox publishes up to limit pending events, oldest first, and
+// returns how many were published. Rows are locked with SKIP LOCKED so
+// several replicas can relay side by side without sending a row twice.
+func (r *UserRepository) RelayOutbox(c context.Context, publisher Publisher, limit int) (int, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(c, `
+		SELECT id, event_type, user_id, payload
+		FROM outbox_events
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED;
+	`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("could not query outbox: %v", err)
+	}
+	var ids []any
+	var events []EventMessage
+	for rows.Next() {
+		var id int64
+		var userId int32
+		var event EventMessage
+		if err := rows.Scan(&id, &event.Type, &userId, &event.Payload); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan outbox event: %v", err)
+		}
+		// Keyed by user so all events of one account land on the same
+		// partition and are consumed in order.
+		event.Key = strconv.Itoa(int(userId))
+		ids = append(ids, id)
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not query outbox: %v", err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	pc, cancel := context.WithTimeout(c, outboxPublishTimeout)
+	perr := publisher.Publish(pc, events...)
+	cancel()
+	if perr != nil {
+		if _, err := tx.ExecContext(c, `
+			UPDATE outbox_events SET attempts = attempts + 1, last_error = $1
+			WHERE id IN (`+placeholders(2, len(ids))+`);
+		`, append([]any{truncate(perr.Error(), 1024)}, ids...)...); err != nil {
+			return 0, fmt.Errorf("could not record outbox failure: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("could not commit transaction: %v", err)
+		}
+		return 0, fmt.Errorf("could not publish events: %v", perr)
+	}
+
+	if _, err := tx.ExecContext(c, `
+		UPDATE outbox_events SET published_at = $1, attempts = attempts + 1, last_error = NULL
+		WHERE id IN (`+placeholders(2, len(ids))+`);
+	`, append([]any{time.Now()}, ids...)...); err != nil {
+		return 0, fmt.Errorf("could not mark events as published: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return len(events), nil
+}
+
+// PruneOutbox drops events published more than retention ago.
+func (r *UserRepository) PruneOutbox(c context.Context, retention time.Duration) error {
+	if _, err := r.db.ExecContext(c, `
+		DELETE FROM outbox_events WHERE published_at < $1;
+	`, time.Now().Add(-retention)); err != nil {
+		return fmt.Errorf("could not prune outbox: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubPublisher hands events to a MemoryPublisher after delay, or fails
+// with err when set, and remembers the deadline of every call.
+type stubPublisher struct {
+	*MemoryPublisher
+	delay time.Duration
+
+	mu        sync.Mutex
+	err       error
+	deadlines []time.Time
+}
+
+func (p *stubPublisher) Publish(c context.Context, events ...EventMessage) error {
+	p.mu.Lock()
+	deadline, _ := c.Deadline()
+	p.deadlines = append(p.deadlines, deadline)
+	err := p.err
+	p.mu.Unlock()
+	time.Sleep(p.delay)
+	if err != nil {
+		return err
+	}
+	return p.MemoryPublisher.Publish(c, events...)
+}
+
+func (p *stubPublisher) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// outboxRow is the delivery state of an outbox event.
+type outboxRow struct {
+	attempts  int
+	lastError string
+	published bool
+}
+
+// outboxRows reads the delivery state of every outbox event, oldest first,
+// from whichever backend repo is.
+func outboxRows(t *testing.T, repo Repository) []outboxRow {
+	t.Helper()
+	var rows []outboxRow
+	switch repo := repo.(type) {
+	case *MemoryRepository:
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		for _, event := range repo.outbox {
+			rows = append(rows, outboxRow{event.attempts, event.lastError, event.publishedAt != nil})
+		}
+	case *UserRepository:
+		result, err := repo.db.Query(`SELECT attempts, coalesce(last_error, ''), published_at IS NOT NULL FROM outbox_events ORDER BY id;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer result.Close()
+		for result.Next() {
+			var row outboxRow
+			if err := result.Scan(&row.attempts, &row.lastError, &row.published); err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, row)
+		}
+		if err := result.Err(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("cannot read the outbox of %T", repo)
+	}
+	return rows
+}
+
+// registerOutboxUsers registers n users, each of which enqueues one
+// UserRegistered event, and returns their ids in order.
+func registerOutboxUsers(t *testing.T, repo Repository, n int) []string {
+	t.Helper()
+	password := "correct horse battery staple"
+	var keys []string
+	for i := range n {
+		user, err := repo.RegisterUser(context.Background(), UserRegister{
+			FullName:    "Outbox",
+			Email:       fmt.Sprintf("outbox%d@example.com", i),
+			Password:    &password,
+			PhoneNumber: fmt.Sprintf("+62817000000%02d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, strconv.Itoa(int(user.ID)))
+	}
+	return keys
+}
+
+func TestRelayOutbox(t *testing.T) {
+	unavailable := errors.New("broker unavailable")
+
+	// relayStep relays once with limit, after making the publisher fail
+	// with err.
+	type relayStep struct {
+		limit   int
+		err     error
+		want    int
+		wantErr bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []relayStep
+		// want is the state of the three events afterwards.
+		want []outboxRow
+	}{
+		{
+			name: "publishes in batches",
+			steps: []relayStep{
+				{limit: 2, want: 2},
+				{limit: 2, want: 1},
+				{limit: 2, want: 0},
+			},
+			want: []outboxRow{{1, "", true}, {1, "", true}, {1, "", true}},
+		},
+		{
+			name: "failure is recorded and retried",
+			steps: []relayStep{
+				{limit: 2, err: unavailable, wantErr: true},
+				{limit: 2, err: unavailable, wantErr: true},
+			},
+			want: []outboxRow{{2, "broker unavailable", false}, {2, "broker unavailable", false}, {0, "", false}},
+		},
+		{
+			name: "success after a failure clears the error",
+			steps: []relayStep{
+				{limit: 2, err: unavailable, wantErr: true},
+				{limit: 3, want: 3},
+			},
+			want: []outboxRow{{2, "", true}, {2, "", true}, {1, "", true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				keys := registerOutboxUsers(t, repo, 3)
+				publisher := &stubPublisher{MemoryPublisher: NewMemoryPublisher()}
+
+				for i, step := range tt.steps {
+					publisher.fail(step.err)
+					n, err := repo.RelayOutbox(c, publisher, step.limit)
+					if (err != nil) != step.wantErr || n != step.want {
+						t.Fatalf("relay %d = %d, %v; want %d, error %v", i, n, err, step.want, step.wantErr)
+					}
+				}
+
+				rows := outboxRows(t, repo)
+				if len(rows) != len(tt.want) {
+					t.Fatalf("outbox holds %d events, want %d", len(rows), len(tt.want))
+				}
+				for i, row := range rows {
+					if row != tt.want[i] {
+						t.Errorf("event %d = %+v, want %+v", i, row, tt.want[i])
+					}
+				}
+
+				// Whatever was published went out oldest first, keyed by
+				// user.
+				for i, event := range publisher.Events() {
+					if event.Key != keys[i] || event.Type != EventUserRegistered {
+						t.Errorf("published event %d = %s for %s, want %s for %s", i, event.Type, event.Key, EventUserRegistered, keys[i])
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRelayOutboxPublishTimeout(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		registerOutboxUsers(t, repo, 1)
+		publisher := &stubPublisher{MemoryPublisher: NewMemoryPublisher()}
+
+		if _, err := repo.RelayOutbox(context.Background(), publisher, 10); err != nil {
+			t.Fatal(err)
+		}
+		end := time.Now()
+		if len(publisher.deadlines) != 1 {
+			t.Fatalf("Publish called %d times, want 1", len(publisher.deadlines))
+		}
+		deadline := publisher.deadlines[0]
+		if deadline.IsZero() || deadline.Sub(end) > outboxPublishTimeout {
+			t.Errorf("Publish deadline = %v, want at most %s from now", deadline, outboxPublishTimeout)
+		}
+	})
+}
+
+func TestRelayOutboxConcurrent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		keys := registerOutboxUsers(t, repo, 12)
+		publisher := &stubPublisher{MemoryPublisher: NewMemoryPublisher(), delay: 5 * time.Millisecond}
+
+		// Relays running side by side, as on several replicas, must not
+		// send an event twice while another one waits for the broker.
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Go(func() {
+				for {
+					n, err := repo.RelayOutbox(context.Background(), publisher, 2)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if n == 0 {
+						return
+					}
+				}
+			})
+		}
+		wg.Wait()
+
+		seen := make(map[string]int)
+		for _, event := range publisher.Events() {
+			seen[event.Key]++
+		}
+		for _, key := range keys {
+			if seen[key] != 1 {
+				t.Errorf("event of user %s published %d times, want once", key, seen[key])
+			}
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password does not match")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// PasswordHasher hashes new passwords and verifies stored hashes. Every
+// implementation verifies all supported formats, so switching the hasher
+// does not lock anybody out; NeedsRehash tells which hashes to upgrade.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify returns ErrPasswordMismatch when password does not match.
+	Verify(encoded, password string) error
+	// NeedsRehash reports whether encoded uses another algorithm or weaker
+	// parameters than new hashes get.
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommendation of RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher stores passwords as PHC strings such as
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+type Argon2idHasher struct {
+	params Argon2Params
+}
+
+func NewArgon2idHasher(params Argon2Params) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("could not generate salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(encoded, password string) error {
+	return verifyPasswordHash(encoded, password)
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	hash, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return hash.params.Memory < h.params.Memory ||
+		hash.params.Iterations < h.params.Iterations ||
+		hash.params.Parallelism < h.params.Parallelism ||
+		hash.params.SaltLength < h.params.SaltLength ||
+		hash.params.KeyLength < h.params.KeyLength
+}
+
+// BcryptHasher keeps hashing new passwords with bcrypt. It only reads the
+// first 72 bytes of a password.
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", fmt.Errorf("could not hash password: %v", err)
+	}
+	return string(hashed), nil
+}
+
+func (h *BcryptHasher) Verify(encoded, password string) error {
+	return verifyPasswordHash(encoded, password)
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcryptHash(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.cost
+}
+
+// verifyPasswordHash checks password against a hash in any supported
+// format. Accounts without a password have an empty hash and never match.
+func verifyPasswordHash(encoded, password string) error {
+	switch {
+	case encoded == "":
+		return ErrPasswordMismatch
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		hash, err := parseArgon2id(encoded)
+		if err != nil {
+			return err
+		}
+		key := argon2.IDKey([]byte(password), hash.salt, hash.params.Iterations, hash.params.Memory, hash.params.Parallelism, hash.params.KeyLength)
+		if subtle.ConstantTimeCompare(key, hash.key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	case isBcryptHash(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	default:
+		return ErrUnknownPasswordHash
+	}
+}
+
+// dummyHashes holds, per hasher, the hash of a random password that
+// verifyWithoutPassword checks against.
+var dummyHashes sync.Map
+
+// verifyWithoutPassword costs as much as verifying a stored hash. Logins for
+// unknown emails and for accounts without a password call it so they take
+// as long as a wrong password and do not tell which emails are registered.
+func verifyWithoutPassword(hasher PasswordHasher, password string) {
+	encoded, ok := dummyHashes.Load(hasher)
+	if !ok {
+		hash, err := hasher.Hash(rand.Text())
+		if err != nil {
+			log.Printf("could not hash the dummy password: %v", err)
+			return
+		}
+		encoded, _ = dummyHashes.LoadOrStore(hasher, hash)
+	}
+	hasher.Verify(encoded.(string), password)
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+type argon2idHash struct {
+	params Argon2Params
+	salt   []byte
+	key    []byte
+}
+
+func parseArgon2id(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var hash argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.params.Memory, &hash.params.Iterations, &hash.params.Parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if hash.params.Iterations == 0 || hash.params.Parallelism == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	hash.params.SaltLength = uint32(len(hash.salt))
+	hash.params.KeyLength = uint32(len(hash.key))
+	return &hash, nil
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Small argon2id parameters keep the tests fast; weakArgon2Params is what
+// an older deployment might have stored.
+var (
+	testArgon2Params = Argon2Params{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	weakArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+)
+
+func TestParseArgon2id(t *testing.T) {
+	const salt = "c29tZXNhbHRzb21lc2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    Argon2Params
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			encoded: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key,
+			want:    Argon2Params{Memory: 65536, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32},
+		},
+		{name: "other algorithm", encoded: "$argon2i$v=19$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "missing part", encoded: "$argon2id$v=19$m=65536,t=3,p=4$" + salt, wantErr: true},
+		{name: "old version", encoded: "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "malformed parameters", encoded: "$argon2id$v=19$m=65536;t=3;p=4$" + salt + "$" + key, wantErr: true},
+		{name: "zero iterations", encoded: "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "zero parallelism", encoded: "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "invalid salt", encoded: "$argon2id$v=19$m=65536,t=3,p=4$!!!$" + key, wantErr: true},
+		{name: "invalid hash", encoded: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$!!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := parseArgon2id(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArgon2id() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && hash.params != tt.want {
+				t.Errorf("parseArgon2id() params = %+v, want %+v", hash.params, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordHash(t *testing.T) {
+	bcryptHash, err := NewBcryptHasher(4).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := NewArgon2idHasher(weakArgon2Params).Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+		want     error
+	}{
+		{"bcrypt match", bcryptHash, "secret", nil},
+		{"bcrypt mismatch", bcryptHash, "Secret", ErrPasswordMismatch},
+		{"argon2id match", argon2Hash, "secret", nil},
+		{"argon2id mismatch", argon2Hash, "Secret", ErrPasswordMismatch},
+		{"no password", "", "", ErrPasswordMismatch},
+		{"unknown format", "$md5$abc", "secret", ErrUnknownPasswordHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyPasswordHash(tt.encoded, tt.password); !errors.Is(err, tt.want) {
+				t.Errorf("verifyPasswordHash() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash := func(hasher PasswordHasher) string {
+		encoded, err := hasher.Hash("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	weakArgon2 := hash(NewArgon2idHasher(weakArgon2Params))
+	testArgon2 := hash(NewArgon2idHasher(testArgon2Params))
+	cheapBcrypt := hash(NewBcryptHasher(4))
+	bcrypt := hash(NewBcryptHasher(5))
+
+	tests := []struct {
+		name    string
+		hasher  PasswordHasher
+		encoded string
+		want    bool
+	}{
+		{"argon2id with the same parameters", NewArgon2idHasher(testArgon2Params), testArgon2, false},
+		{"argon2id with weaker parameters", NewArgon2idHasher(testArgon2Params), weakArgon2, true},
+		{"argon2id with stronger parameters", NewArgon2idHasher(weakArgon2Params), testArgon2, false},
+		{"bcrypt under argon2id", NewArgon2idHasher(testArgon2Params), bcrypt, true},
+		{"bcrypt with the same cost", NewBcryptHasher(5), bcrypt, false},
+		{"bcrypt with a lower cost", NewBcryptHasher(5), cheapBcrypt, true},
+		{"argon2id under bcrypt", NewBcryptHasher(5), testArgon2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.encoded); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+const rehashPassword = "correct horse battery staple"
+
+// setHasher swaps the hasher of repo, as a restart with other settings
+// would.
+func setHasher(repo Repository, hasher PasswordHasher) {
+	switch r := repo.(type) {
+	case *MemoryRepository:
+		r.mu.Lock()
+		r.hasher = hasher
+		r.mu.Unlock()
+	case *UserRepository:
+		r.hasher = hasher
+	}
+}
+
+// storedPasswordHash returns the password hash repo keeps for the user.
+func storedPasswordHash(t *testing.T, repo Repository, userId int32) string {
+	t.Helper()
+	switch r := repo.(type) {
+	case *MemoryRepository:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.users[userId].password
+	case *UserRepository:
+		var hash string
+		err := r.db.QueryRowContext(context.Background(), `SELECT coalesce(password, '') FROM users WHERE id = $1;`, userId).Scan(&hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	t.Fatalf("unknown repository %T", repo)
+	return ""
+}
+
+func TestAuthenticateRehashes(t *testing.T) {
+	current := NewArgon2idHasher(testArgon2Params)
+
+	tests := []struct {
+		name       string
+		old        PasswordHasher
+		password   string
+		wantErr    error
+		wantRehash bool
+	}{
+		{"bcrypt is upgraded", NewBcryptHasher(4), rehashPassword, nil, true},
+		{"weak argon2id is upgraded", NewArgon2idHasher(weakArgon2Params), rehashPassword, nil, true},
+		{"current hash is kept", current, rehashPassword, nil, false},
+		{"wrong password is not rehashed", NewBcryptHasher(4), "wrong password", ErrInvalidCredentials, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				setHasher(repo, tt.old)
+				password := rehashPassword
+				user, err := repo.RegisterUser(c, UserRegister{FullName: "Rehash", Email: "rehash@example.com", Password: &password, PhoneNumber: "+628160000001"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := repo.VerifyEmail(c, user.ID, user.Email); err != nil {
+					t.Fatal(err)
+				}
+				before := storedPasswordHash(t, repo, user.ID)
+
+				setHasher(repo, current)
+				if _, err := repo.Authenticate(c, "rehash@example.com", tt.password, PasswordPolicy{}); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+				}
+
+				after := storedPasswordHash(t, repo, user.ID)
+				if rehashed := after != before; rehashed != tt.wantRehash {
+					t.Fatalf("rehashed = %v, want %v", rehashed, tt.wantRehash)
+				}
+				if !tt.wantRehash {
+					return
+				}
+				if !strings.HasPrefix(after, "$argon2id$") || current.NeedsRehash(after) {
+					t.Errorf("stored hash %q does not use the current parameters", after)
+				}
+				if _, err := repo.Authenticate(c, "rehash@example.com", rehashPassword, PasswordPolicy{}); err != nil {
+					t.Errorf("Authenticate() with the new hash: %v", err)
+				}
+			})
+		})
+	}
+}
+
+// countingHasher counts the hashes it is asked to verify.
+type countingHasher struct {
+	PasswordHasher
+	verified atomic.Int32
+}
+
+func (h *countingHasher) Verify(encoded, password string) error {
+	if encoded != "" {
+		h.verified.Add(1)
+	}
+	return h.PasswordHasher.Verify(encoded, password)
+}
+
+func TestAuthenticateAlwaysVerifies(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"registered", "known@example.com", rehashPassword, nil},
+		{"wrong password", "known@example.com", "wrong password", ErrInvalidCredentials},
+		{"unknown email", "unknown@example.com", rehashPassword, ErrInvalidCredentials},
+		{"deleted account", "deleted@example.com", rehashPassword, ErrInvalidCredentials},
+		{"no password", "external@example.com", "", ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				password := rehashPassword
+				for i, email := range []string{"known@example.com", "deleted@example.com"} {
+					user, err := repo.RegisterUser(c, UserRegister{FullName: "Known", Email: email, Password: &password, PhoneNumber: fmt.Sprintf("+62821000000%d", i)})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := repo.VerifyEmail(c, user.ID, email); err != nil {
+						t.Fatal(err)
+					}
+					if email == "deleted@example.com" {
+						if err := repo.DeleteAccount(c, user.ID, password); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				newExternalUser(t, repo, "google")
+
+				// Without an account to check against, a hash is still
+				// verified so the answer takes as long.
+				hasher := &countingHasher{PasswordHasher: testHasher}
+				setHasher(repo, hasher)
+				if _, err := repo.Authenticate(c, tt.email, tt.password, PasswordPolicy{}); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+				}
+				if verified := hasher.verified.Load(); verified != 1 {
+					t.Errorf("verified %d hashes, want 1", verified)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrPasswordReused  = errors.New("password was used recently, choose a different one")
+	ErrPasswordExpired = errors.New("password has expired and must be reset")
+)
+
+// commonPasswords is a bundled list of passwords that show up at the top of
+// breach dumps, one per line in lower case.
+//
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var commonPasswords = func() map[string]struct{} {
+	set := make(map[string]struct{})
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordList))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			set[line] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// PasswordPolicy decides which passwords users may choose. MinLength counts
+// characters, while MaxLength counts bytes since that is what the hashers
+// are limited by. HistorySize is how many previous passwords, the current one
+// included, cannot be chosen again; MaxAge makes passwords expire. Both are
+// disabled when zero.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MinCharacterClasses is how many of lower case letters, upper case
+	// letters, digits and symbols a password has to mix.
+	MinCharacterClasses int
+	RejectCommon        bool
+	HistorySize         int
+	MaxAge              time.Duration
+}
+
+// PasswordPolicyError lists every rule a password broke. Field is the name
+// of the request field holding the password.
+type PasswordPolicyError struct {
+	Field      string
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, strings.Join(e.Violations, "; "))
+}
+
+// Check returns a *PasswordPolicyError for field when password breaks the
+// policy. personal holds values the password must not contain, such as the
+// email and username of the account.
+func (p PasswordPolicy) Check(field, password string, personal ...string) error {
+	var violations []string
+
+	if password == "" {
+		return &PasswordPolicyError{Field: field, Violations: []string{"password is required"}}
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("password must be at most %d bytes", p.MaxLength))
+	}
+	if classes := characterClasses(password); classes < p.MinCharacterClasses {
+		violations = append(violations, fmt.Sprintf(
+			"password must mix at least %d of lower case letters, upper case letters, digits and symbols",
+			p.MinCharacterClasses,
+		))
+	}
+
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if len(value) >= 3 && strings.Contains(lower, value) {
+			violations = append(violations, "password must not contain your email or username")
+			break
+		}
+	}
+	if p.RejectCommon && isCommonPassword(lower) {
+		violations = append(violations, "password is too common")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Field: field, Violations: violations}
+	}
+	return nil
+}
+
+// expired tells whether a password set at changedAt has to be replaced.
+func (p PasswordPolicy) expired(changedAt time.Time) bool {
+	return p.MaxAge > 0 && !changedAt.IsZero() && time.Since(changedAt) > p.MaxAge
+}
+
+// personalValues returns the parts of an account a password must not
+// contain: the email, its local part and the username.
+func personalValues(email, username string) []string {
+	values := []string{email, username}
+	if local, _, ok := strings.Cut(email, "@"); ok {
+		values = append(values, local)
+	}
+	return values
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			n++
+		}
+	}
+	return n
+}
+
+// isCommonPassword also catches list entries dressed up with a trailing
+// number or symbol, such as "Sunshine2024!".
+func isCommonPassword(lower string) bool {
+	if _, ok := commonPasswords[lower]; ok {
+		return true
+	}
+	base := strings.TrimRightFunc(lower, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	if len(base) < 4 || base == lower {
+		return false
+	}
+	_, ok := commonPasswords[base]
+	return ok
+}
+
+// checkPasswordHistory returns ErrPasswordReused when newPassword matches
+// currentHash or one of the historySize-1 passwords before it.
+func (r *UserRepository) checkPasswordHistory(c context.Context, tx *sql.Tx, userId int32, currentHash, newPassword string, historySize int) error {
+	if historySize <= 0 {
+		return nil
+	}
+	if currentHash != "" && r.hasher.Verify(currentHash, newPassword) == nil {
+		return ErrPasswordReused
+	}
+
+	rows, err := tx.QueryContext(c, `
+		SELECT password_hash FROM password_history
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2;
+	`, userId, historySize-1)
+	if err != nil {
+		return fmt.Errorf("could not query password history: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return fmt.Errorf("could not scan password history: %v", err)
+		}
+		if r.hasher.Verify(hash, newPassword) == nil {
+			return ErrPasswordReused
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not query password history: %v", err)
+	}
+	return nil
+}
+
+// setPassword stores newPassword and moves currentHash into the history,
+// which is cut down to what historySize still needs.
+func (r *UserRepository) setPassword(c context.Context, tx *sql.Tx, userId int32, currentHash, newPassword string, historySize int) error {
+	newHash, err := r.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := tx.ExecContext(c, `
+		UPDATE users SET password = $2, password_changed_at = $3, updated_at = $3 WHERE id = $1;
+	`, userId, newHash, now); err != nil {
+		return fmt.Errorf("could not update password: %v", err)
+	}
+
+	keep := max(historySize-1, 0)
+	if currentHash != "" && keep > 0 {
+		if _, err := tx.ExecContext(c, `
+			INSERT INTO password_history (user_id, password_hash, created_at) VALUES ($1, $2, $3);
+		`, userId, currentHash, now); err != nil {
+			return fmt.Errorf("could not update password history: %v", err)
+		}
+	}
+	if _, err := tx.ExecContext(c, `
+		DELETE FROM password_history
+		WHERE user_id = $1
+		AND id NOT IN (SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2);
+	`, userId, keep); err != nil {
+		return fmt.Errorf("could not prune password history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 20, MinCharacterClasses: 3, RejectCommon: true}
+	personal := personalValues("jane.doe@example.com", "janedoe")
+	const classes = "password must mix at least 3 of lower case letters, upper case letters, digits and symbols"
+
+	tests := []struct {
+		name     string
+		field    string
+		password string
+		want     []string
+	}{
+		{"strong", "password", "Tr0ub4dor&3", nil},
+		{"empty", "password", "", []string{"password is required"}},
+		{"too short", "password", "Ab1!", []string{"password must be at least 8 characters"}},
+		{"too long", "password", "Abcdefgh1!Abcdefgh1!x", []string{"password must be at most 20 bytes"}},
+		{"short in characters though long in bytes", "password", "Çéñô1!", []string{"password must be at least 8 characters"}},
+		{"long enough in characters", "password", "Çéñô1!xy", nil},
+		{"too long in bytes", "password", "ÇéñôÇéñôÇéñô1!", []string{"password must be at most 20 bytes"}},
+		{"too few character classes", "password", "abcdefghij", []string{classes}},
+		{"contains the username", "password", "xJanedoe1!", []string{"password must not contain your email or username"}},
+		{"contains the local part of the email", "password", "Jane.Doe#42", []string{"password must not contain your email or username"}},
+		{"common", "password", "Password1!", []string{"password is too common"}},
+		{"common with a suffix", "password", "Sunshine2024!", []string{"password is too common"}},
+		{"every rule at once", "password", "qwerty", []string{"password must be at least 8 characters", classes, "password is too common"}},
+		{"field is reported", "newPassword", "short", []string{"password must be at least 8 characters", classes}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.field, tt.password, personal...)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Check() = %v, want nil", err)
+				}
+				return
+			}
+
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check() = %v, want a *PasswordPolicyError", err)
+			}
+			if policyErr.Field != tt.field {
+				t.Errorf("Field = %q, want %q", policyErr.Field, tt.field)
+			}
+			if !slices.Equal(policyErr.Violations, tt.want) {
+				t.Errorf("Violations = %q, want %q", policyErr.Violations, tt.want)
+			}
+		})
+	}
+}
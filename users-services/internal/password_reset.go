@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// CreatePasswordReset stores a single-use reset token for the account with
+// the given email and returns the raw token. ErrUserNotFound is returned for
+// unknown emails; callers must not leak it to clients.
+func (r *UserRepository) CreatePasswordReset(c context.Context, email string) (*User, string, error) {
+	var user User
+	err := r.db.QueryRowContext(c, `
+		SELECT id, coalesce(full_name, ''), email FROM users WHERE email = $1 AND is_deleted = false;
+	`, email).Scan(&user.ID, &user.FullName, &user.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", ErrUserNotFound
+		}
+		return nil, "", fmt.Errorf("could not query user: %v", err)
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := `
+		insert into password_resets (
+		    user_id,
+		    token_hash,
+		    expires_at
+		) values (
+			$1, $2, $3
+		)
+    `
+	if _, err := r.db.ExecContext(c, query, user.ID, hashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		return nil, "", fmt.Errorf("could not insert password reset: %v", err)
+	}
+	return &user, token, nil
+}
+
+// FindPasswordResetUser returns the user a reset token was issued to, so
+// the new password can be checked against the account before it is used.
+func (r *UserRepository) FindPasswordResetUser(c context.Context, token string) (*User, error) {
+	query := `SELECT ` + userColumns + `
+		FROM users
+		WHERE is_deleted = false
+		AND id = (
+			SELECT user_id FROM password_resets
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		);
+    `
+	user, err := scanUser(r.db.QueryRowContext(c, query, hashToken(token), time.Now()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidResetToken
+		}
+		return nil, fmt.Errorf("could not query password reset: %v", err)
+	}
+	return user, nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and revokes
+// every session of the user. All outstanding reset tokens of the user are
+// invalidated as well. Passwords among the last historySize cannot be
+// chosen again. It returns the id of the user.
+func (r *UserRepository) ResetPassword(c context.Context, token string, newPassword string, historySize int) (int32, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userId int32
+	var hashedPassword string
+	err = tx.QueryRowContext(c, `
+		SELECT pr.user_id, coalesce(u.password, '')
+		FROM password_resets pr
+		JOIN users u ON u.id = pr.user_id
+		WHERE pr.token_hash = $1
+		AND pr.used_at IS NULL
+		AND pr.expires_at > $2
+		AND u.is_deleted = false
+		FOR UPDATE OF pr, u;
+	`, hashToken(token), now).Scan(&userId, &hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidResetToken
+		}
+		return 0, fmt.Errorf("could not query password reset: %v", err)
+	}
+
+	if err := r.checkPasswordHistory(c, tx, userId, hashedPassword, newPassword, historySize); err != nil {
+		return userId, err
+	}
+	if _, err := tx.ExecContext(c, `
+		UPDATE password_resets SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL;
+	`, userId, now); err != nil {
+		return 0, fmt.Errorf("could not update password reset: %v", err)
+	}
+	if err := r.setPassword(c, tx, userId, hashedPassword, newPassword, historySize); err != nil {
+		return 0, err
+	}
+	if err := revokeUserTokens(c, tx, userId); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return userId, nil
+}
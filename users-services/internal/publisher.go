@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// EventMessage is one event as handed to a Publisher. Payload is the JSON
+// encoded EventEnvelope.
+type EventMessage struct {
+	Key     string
+	Type    string
+	Payload []byte
+}
+
+// Publisher delivers outbox events to the message broker. Publish returns
+// only once every event has been accepted, or an error if any was not.
+type Publisher interface {
+	Publish(c context.Context, events ...EventMessage) error
+}
+
+// KafkaPublisher writes events to a Kafka topic and waits for all in-sync
+// replicas to acknowledge them.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}
+}
+
+func (p *KafkaPublisher) Publish(c context.Context, events ...EventMessage) error {
+	messages := make([]kafka.Message, len(events))
+	for i, event := range events {
+		messages[i] = kafka.Message{
+			Key:   []byte(event.Key),
+			Value: event.Payload,
+			Headers: []kafka.Header{
+				{Key: "event-type", Value: []byte(event.Type)},
+				{Key: "schema-version", Value: []byte(strconv.Itoa(EventSchemaVersion))},
+			},
+		}
+	}
+	if err := p.writer.WriteMessages(c, messages...); err != nil {
+		return fmt.Errorf("could not write to kafka: %v", err)
+	}
+	return nil
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// LogPublisher only logs events, which is handy for local development
+// without a broker.
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(c context.Context, events ...EventMessage) error {
+	for _, event := range events {
+		log.Printf("event %s key=%s %s", event.Type, event.Key, event.Payload)
+	}
+	return nil
+}
+
+// MemoryPublisher keeps published events in memory for tests.
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []EventMessage
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(c context.Context, events ...EventMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, events...)
+	return nil
+}
+
+// Events returns a copy of everything published so far.
+func (p *MemoryPublisher) Events() []EventMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]EventMessage(nil), p.events...)
+}
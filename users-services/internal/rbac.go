@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserAccess is what a user may do, as carried in their access tokens.
+type UserAccess struct {
+	Roles       []string
+	Permissions []string
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(c context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// userAccess loads the roles of a user and the union of their permissions.
+func userAccess(c context.Context, q queryer, userId int32) (UserAccess, error) {
+	rows, err := q.QueryContext(c, `
+		SELECT r.name, p.name
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = $1
+		ORDER BY r.name;
+	`, userId)
+	if err != nil {
+		return UserAccess{}, fmt.Errorf("could not query roles: %v", err)
+	}
+	defer rows.Close()
+
+	var access UserAccess
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var role string
+		var permission sql.NullString
+		if err := rows.Scan(&role, &permission); err != nil {
+			return UserAccess{}, fmt.Errorf("could not scan role: %v", err)
+		}
+		if n := len(access.Roles); n == 0 || access.Roles[n-1] != role {
+			access.Roles = append(access.Roles, role)
+		}
+		if permission.Valid && !seen[permission.String] {
+			seen[permission.String] = true
+			access.Permissions = append(access.Permissions, permission.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return UserAccess{}, fmt.Errorf("could not query roles: %v", err)
+	}
+	sort.Strings(access.Permissions)
+	return access, nil
+}
+
+// ListRoles returns every role with its permissions, or only the roles of
+// userId when it is not zero.
+func (r *UserRepository) ListRoles(c context.Context, userId int32) ([]Role, error) {
+	rows, err := r.db.QueryContext(c, `
+		SELECT r.name, coalesce(r.description, ''), p.name
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		WHERE $1 = 0 OR r.id IN (SELECT role_id FROM user_roles WHERE user_id = $1)
+		ORDER BY r.name, p.name;
+	`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("could not query roles: %v", err)
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var name, description string
+		var permission sql.NullString
+		if err := rows.Scan(&name, &description, &permission); err != nil {
+			return nil, fmt.Errorf("could not scan role: %v", err)
+		}
+		if n := len(roles); n == 0 || roles[n-1].Name != name {
+			roles = append(roles, Role{Name: name, Description: description, Permissions: []string{}})
+		}
+		if permission.Valid {
+			role := &roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, permission.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not query roles: %v", err)
+	}
+	return roles, nil
+}
+
+// AssignRole grants role to the user. The new role shows up in the user's
+// tokens from their next login or refresh.
+func (r *UserRepository) AssignRole(c context.Context, userId int32, role string) error {
+	res, err := r.db.ExecContext(c, `
+		INSERT INTO user_roles (user_id, role_id, assigned_at)
+		SELECT u.id, r.id, $3 FROM users u, roles r
+		WHERE u.id = $1 AND u.is_deleted = false AND r.name = $2
+		ON CONFLICT (user_id, role_id) DO NOTHING;
+	`, userId, role, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not assign role: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	return r.roleTargetError(c, userId, role)
+}
+
+// RevokeRole takes role away from the user and revokes their tokens, since
+// tokens issued earlier still claim the role.
+func (r *UserRepository) RevokeRole(c context.Context, userId int32, role string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(c, `
+		DELETE FROM user_roles
+		WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2);
+	`, userId, role)
+	if err != nil {
+		return fmt.Errorf("could not revoke role: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return r.roleTargetError(c, userId, role)
+	}
+
+	if err := revokeUserTokens(c, tx, userId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// roleTargetError explains why assigning or revoking changed nothing:
+// either the user or the role does not exist, or there was nothing to do.
+func (r *UserRepository) roleTargetError(c context.Context, userId int32, role string) error {
+	var userExists, roleExists bool
+	err := r.db.QueryRowContext(c, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND is_deleted = false),
+		       EXISTS (SELECT 1 FROM roles WHERE name = $2);
+	`, userId, role).Scan(&userExists, &roleExists)
+	if err != nil {
+		return fmt.Errorf("could not query role: %v", err)
+	}
+	switch {
+	case !userExists:
+		return ErrUserNotFound
+	case !roleExists:
+		return ErrRoleNotFound
+	default:
+		return nil
+	}
+}
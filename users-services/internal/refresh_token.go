@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// generateOpaqueToken returns a random token for refresh and reset links.
+// Only its hash is ever stored.
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertRefreshToken stores a new refresh token in the given family and
+// returns the raw token together with its expiry.
+func insertRefreshToken(c context.Context, tx *sql.Tx, userId int32, familyId string) (string, time.Time, error) {
+	raw, err := generateOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(refreshTokenTTL)
+
+	query := `
+		insert into refresh_tokens (
+		    user_id,
+		    family_id,
+		    token_hash,
+		    expires_at
+		) values (
+			$1, $2, $3, $4
+		)
+    `
+	if _, err := tx.ExecContext(c, query, userId, familyId, hashToken(raw), expiresAt); err != nil {
+		return "", time.Time{}, fmt.Errorf("could not insert refresh token: %v", err)
+	}
+	return raw, expiresAt, nil
+}
+
+// CreateSession starts a new session for the user with its first refresh
+// token. The session id is the family id of its refresh tokens.
+func (r *UserRepository) CreateSession(c context.Context, userId int32, client ClientInfo) (*IssuedSession, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	sessionId, err := insertSession(c, tx, userId, client, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, expiresAt, err := insertRefreshToken(c, tx, userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := userAccess(c, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+
+	return &IssuedSession{
+		UserID:           userId,
+		SessionID:        sessionId,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: expiresAt,
+		Access:           access,
+	}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one. Every
+// refresh token is single use: presenting one that was already exchanged
+// revokes its whole session, logging out both the attacker and the victim.
+func (r *UserRepository) RotateRefreshToken(c context.Context, refreshToken string, client ClientInfo) (*IssuedSession, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT rt.id, rt.user_id, rt.family_id, rt.expires_at, rt.used_at, rt.revoked_at
+		FROM refresh_tokens rt
+		JOIN users u ON u.id = rt.user_id
+		WHERE rt.token_hash = $1
+		AND u.is_deleted = false
+		AND u.is_active = true
+		FOR UPDATE OF rt;
+    `
+
+	var (
+		tokenId   int32
+		userId    int32
+		familyId  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRowContext(c, query, hashToken(refreshToken)).Scan(&tokenId, &userId, &familyId, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, fmt.Errorf("could not query refresh token: %v", err)
+	}
+
+	now := time.Now()
+	if usedAt.Valid && !revokedAt.Valid {
+		if _, err := revokeSessions(c, tx, `id = $1`, familyId); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("could not commit transaction: %v", err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if revokedAt.Valid || usedAt.Valid || now.After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.ExecContext(c, `UPDATE refresh_tokens SET used_at = $2 WHERE id = $1;`, tokenId, now); err != nil {
+		return nil, fmt.Errorf("could not update refresh token: %v", err)
+	}
+
+	newRefreshToken, newExpiresAt, err := insertRefreshToken(c, tx, userId, familyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := touchSession(c, tx, familyId, client, newExpiresAt); err != nil {
+		return nil, err
+	}
+
+	access, err := userAccess(c, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+
+	return &IssuedSession{
+		UserID:           userId,
+		SessionID:        familyId,
+		RefreshToken:     newRefreshToken,
+		RefreshExpiresAt: newExpiresAt,
+		Access:           access,
+	}, nil
+}
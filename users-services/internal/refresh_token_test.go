@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newRefreshSession registers an active user and starts two sessions for
+// them through the repository, returning both.
+func newRefreshSession(t *testing.T, repo Repository) (*IssuedSession, *IssuedSession) {
+	t.Helper()
+	c := context.Background()
+	password := "correct horse battery staple"
+	user, err := repo.RegisterUser(c, UserRegister{FullName: "Rotate", Email: "rotate@example.com", Password: &password, PhoneNumber: "+628100000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.VerifyEmail(c, user.ID, user.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := repo.CreateSession(c, user.ID, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := repo.CreateSession(c, user.ID, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, other
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	tests := []struct {
+		name string
+		// present lists the refresh tokens presented in turn, by the order
+		// they were issued in: 0 came with the login, 1 with the first
+		// refresh and so on.
+		present []int
+		want    []error
+		// revoked tells whether the session ends up logged out.
+		revoked bool
+	}{
+		{
+			name:    "every refresh returns a new token",
+			present: []int{0, 1, 2},
+			want:    []error{nil, nil, nil},
+		},
+		{
+			name:    "reusing the last token revokes the family",
+			present: []int{0, 0, 1},
+			want:    []error{nil, ErrRefreshTokenReused, ErrInvalidRefreshToken},
+			revoked: true,
+		},
+		{
+			name:    "reusing an older token revokes the family",
+			present: []int{0, 1, 0, 2},
+			want:    []error{nil, nil, ErrRefreshTokenReused, ErrInvalidRefreshToken},
+			revoked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				session, other := newRefreshSession(t, repo)
+
+				issued := []string{session.RefreshToken}
+				for i, n := range tt.present {
+					rotated, err := repo.RotateRefreshToken(c, issued[n], ClientInfo{})
+					if !errors.Is(err, tt.want[i]) {
+						t.Fatalf("refresh %d with token %d: got error %v, want %v", i, n, err, tt.want[i])
+					}
+					if err == nil {
+						if rotated.SessionID != session.SessionID {
+							t.Fatalf("refresh %d moved to session %q, want %q", i, rotated.SessionID, session.SessionID)
+						}
+						issued = append(issued, rotated.RefreshToken)
+					}
+				}
+
+				now := time.Now()
+				revoked, err := repo.IsTokenRevoked(c, "access-jti", session.SessionID, session.UserID, now, now.Add(time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if revoked != tt.revoked {
+					t.Errorf("access token revoked = %v, want %v", revoked, tt.revoked)
+				}
+
+				// Other sessions of the user are not affected.
+				if _, err := repo.RotateRefreshToken(c, other.RefreshToken, ClientInfo{}); err != nil {
+					t.Errorf("refresh of another session: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestRotateRefreshTokenUnknown(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		if _, err := repo.RotateRefreshToken(context.Background(), "not-a-token", ClientInfo{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("got error %v, want %v", err, ErrInvalidRefreshToken)
+		}
+	})
+}
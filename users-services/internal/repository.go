@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// Repository stores everything users-service knows about accounts. The
+// methods return the sentinel errors of this package, such as
+// ErrUserNotFound, so UserService and the gRPC layer work the same on every
+// backend:
+//
+//   - UserRepository on Postgres, for production;
+//   - UserRepository on SQLite (NewSQLiteRepository), for a single node;
+//   - MemoryRepository, for tests and running without any database.
+//
+// Every method that changes an account also enqueues its lifecycle event
+// in the same transaction, for RelayOutbox to publish.
+type Repository interface {
+	// RegisterUser inserts an inactive user. Without a chosen username one
+	// is derived from the email.
+	RegisterUser(c context.Context, user UserRegister) (*User, error)
+	// Authenticate checks the credentials and returns the id of the user.
+	// The id is also returned with ErrInvalidCredentials for a wrong
+	// password and with ErrPasswordExpired, so the attempt can be recorded.
+	Authenticate(c context.Context, email, password string, policy PasswordPolicy) (int32, error)
+	FindUser(c context.Context, userId int32) (*User, error)
+	UpdateProfile(c context.Context, userId int32, update ProfileUpdate) (*User, error)
+	ChangePassword(c context.Context, userId int32, currentPassword, newPassword string, historySize int) error
+	VerifyEmail(c context.Context, userId int32, email string) error
+	FindUnverifiedUser(c context.Context, email string) (*User, error)
+	ListUsers(c context.Context, filter UserFilter) (*UserPage, error)
+
+	UsernameAvailable(c context.Context, username string, exceptUserId int32) (bool, error)
+	ChangeUsername(c context.Context, userId int32, username string) (*User, error)
+	ResolveUsername(c context.Context, username string) (int32, string, error)
+
+	DeleteAccount(c context.Context, userId int32, password string) error
+	RestoreUser(c context.Context, userId int32, gracePeriod time.Duration) (*User, error)
+	PurgeDeletedUsers(c context.Context, retention time.Duration) (int64, error)
+
+	CreatePasswordReset(c context.Context, email string) (*User, string, error)
+	FindPasswordResetUser(c context.Context, token string) (*User, error)
+	ResetPassword(c context.Context, token, newPassword string, historySize int) (int32, error)
+
+	CreateSession(c context.Context, userId int32, client ClientInfo) (*IssuedSession, error)
+	RotateRefreshToken(c context.Context, refreshToken string, client ClientInfo) (*IssuedSession, error)
+	ListSessions(c context.Context, userId int32) ([]Session, error)
+	RevokeSession(c context.Context, userId int32, sessionId string) error
+	RevokeOtherSessions(c context.Context, userId int32, currentSessionId string) (int64, error)
+	RevokeAccessToken(c context.Context, jti string, userId int32, expiresAt time.Time) error
+	RevokeRefreshTokenFamily(c context.Context, refreshToken string) error
+	IsTokenRevoked(c context.Context, jti, sessionId string, userId int32, issuedAt, expiresAt time.Time) (bool, error)
+	PruneRevokedTokens(c context.Context) error
+
+	ReserveLoginAttempt(c context.Context, throttle LoginThrottle, key string, limit int) error
+	ReleaseLoginAttempt(c context.Context, key string, limit int) error
+	ClearLoginFailures(c context.Context, key string) error
+	UnlockUser(c context.Context, userId int32) error
+	PruneLoginFailures(c context.Context, window time.Duration) error
+
+	EnrollTOTP(c context.Context, userId int32) (secret, email string, err error)
+	ConfirmTOTP(c context.Context, userId int32, code string) ([]string, error)
+	DisableTOTP(c context.Context, userId int32, password string) error
+	MFAEnabled(c context.Context, userId int32) (bool, error)
+	VerifyMFACode(c context.Context, userId int32, code, recoveryCode string) error
+
+	FindOrCreateExternalUser(c context.Context, ext ExternalIdentity) (int32, error)
+	LinkIdentity(c context.Context, userId int32, ext ExternalIdentity) error
+	UnlinkIdentity(c context.Context, userId int32, provider string) error
+	ListIdentities(c context.Context, userId int32) ([]Identity, error)
+
+	ListRoles(c context.Context, userId int32) ([]Role, error)
+	AssignRole(c context.Context, userId int32, role string) error
+	RevokeRole(c context.Context, userId int32, role string) error
+
+	InsertAuditEvent(c context.Context, event AuditEvent) error
+	ListAuditEvents(c context.Context, filter AuditFilter) (*AuditPage, error)
+
+	// RelayOutbox publishes up to limit pending events, oldest first, and
+	// returns how many were published.
+	RelayOutbox(c context.Context, publisher Publisher, limit int) (int, error)
+	PruneOutbox(c context.Context, retention time.Duration) error
+}
+
+// IssuedSession is a session that was just started or refreshed, with the
+// raw refresh token and what the user may do right now. UserService signs
+// the matching access token, so repositories never see the signing keys.
+type IssuedSession struct {
+	UserID           int32
+	SessionID        string
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+	Access           UserAccess
+}
+
+var (
+	_ Repository = (*UserRepository)(nil)
+	_ Repository = (*MemoryRepository)(nil)
+)
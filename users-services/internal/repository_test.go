@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/wafi11/microservices/users-services/migrations"
+)
+
+// testHasher keeps hashing cheap; tests that care about the parameters
+// build their own.
+var testHasher = NewBcryptHasher(4)
+
+// backends returns a constructor for every Repository implementation that
+// runs without a server. Tests go through forEachBackend so the memory and
+// SQLite repositories are held to the same behaviour.
+var backends = []struct {
+	name string
+	open func(t *testing.T, hasher PasswordHasher) Repository
+}{
+	{"memory", func(t *testing.T, hasher PasswordHasher) Repository {
+		return NewMemoryRepository(hasher)
+	}},
+	{"sqlite", openSQLiteRepository},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, repo Repository)) {
+	t.Helper()
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t, testHasher))
+		})
+	}
+}
+
+func openSQLiteRepository(t *testing.T, hasher PasswordHasher) Repository {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewSQLiteMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLiteRepository(db, hasher)
+}
+
+func TestRepositoryRegisterUser(t *testing.T) {
+	password := "correct horse battery staple"
+	first := UserRegister{FullName: "Jane Doe", Username: "jane", Email: "jane@example.com", Password: &password, PhoneNumber: "+628111111111"}
+
+	tests := []struct {
+		name    string
+		user    UserRegister
+		wantErr error
+	}{
+		{"another user", UserRegister{FullName: "John Doe", Email: "john@example.com", Password: &password, PhoneNumber: "+628122222222"}, nil},
+		{"email taken", UserRegister{FullName: "Jane", Email: "jane@example.com", Password: &password, PhoneNumber: "+628133333333"}, ErrEmailTaken},
+		{"phone number taken", UserRegister{FullName: "Jane", Email: "jane2@example.com", Password: &password, PhoneNumber: "+628111111111"}, ErrPhoneNumberTaken},
+		{"username taken regardless of case", UserRegister{FullName: "Jane", Username: "JANE", Email: "jane3@example.com", Password: &password, PhoneNumber: "+628144444444"}, ErrUsernameTaken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				if _, err := repo.RegisterUser(c, first); err != nil {
+					t.Fatal(err)
+				}
+
+				user, err := repo.RegisterUser(c, tt.user)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("RegisterUser() error = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				found, err := repo.FindUser(c, user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found.Email != tt.user.Email || found.FullName != tt.user.FullName || found.IsActive {
+					t.Errorf("FindUser() = %+v, want the inactive user just registered", found)
+				}
+			})
+		})
+	}
+}
+
+func TestRepositoryFindUserUnknown(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		if _, err := repo.FindUser(context.Background(), 42); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("FindUser() error = %v, want %v", err, ErrUserNotFound)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// ClientInfo describes the device a request comes from, as forwarded by the
+// gateway. Every field may be empty.
+type ClientInfo struct {
+	IP          string
+	UserAgent   string
+	DeviceLabel string
+}
+
+type Session struct {
+	ID          string    `json:"id"`
+	UserAgent   string    `json:"userAgent"`
+	IPAddress   string    `json:"ipAddress"`
+	DeviceLabel string    `json:"deviceLabel"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastSeenAt  time.Time `json:"lastSeenAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// truncate keeps client supplied values within their column sizes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// insertSession records a new login. The session id is also the family id
+// of its refresh tokens.
+func insertSession(c context.Context, tx *sql.Tx, userId int32, client ClientInfo, expiresAt time.Time) (string, error) {
+	sessionId, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	query := `
+		insert into sessions (
+		    id,
+		    user_id,
+		    user_agent,
+		    ip_address,
+		    device_label,
+		    created_at,
+		    last_seen_at,
+		    expires_at
+		) values (
+			$1, $2, $3, $4, $5, $6, $6, $7
+		)
+    `
+	_, err = tx.ExecContext(c, query,
+		sessionId,
+		userId,
+		nullIfEmpty(truncate(client.UserAgent, 512)),
+		nullIfEmpty(truncate(client.IP, 64)),
+		nullIfEmpty(truncate(client.DeviceLabel, 100)),
+		now,
+		expiresAt,
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not insert session: %v", err)
+	}
+	return sessionId, nil
+}
+
+// touchSession marks the session as used by a refresh, keeping the last
+// known address.
+func touchSession(c context.Context, tx *sql.Tx, sessionId string, client ClientInfo, expiresAt time.Time) error {
+	_, err := tx.ExecContext(c, `
+		UPDATE sessions SET
+			last_seen_at = $2,
+			expires_at = $3,
+			ip_address = coalesce($4, ip_address)
+		WHERE id = $1;
+	`, sessionId, time.Now(), expiresAt, nullIfEmpty(truncate(client.IP, 64)))
+	if err != nil {
+		return fmt.Errorf("could not update session: %v", err)
+	}
+	return nil
+}
+
+// revokeSessions ends the sessions matching where, together with their
+// refresh tokens. where may refer to args as $1, $2, ...
+func revokeSessions(c context.Context, tx *sql.Tx, where string, args ...any) (int64, error) {
+	now := fmt.Sprintf("$%d", len(args)+1)
+	args = append(args, time.Now())
+
+	_, err := tx.ExecContext(c, `
+		UPDATE refresh_tokens SET revoked_at = `+now+`
+		WHERE revoked_at IS NULL
+		AND family_id IN (SELECT id FROM sessions WHERE revoked_at IS NULL AND `+where+`);
+	`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("could not revoke refresh tokens: %v", err)
+	}
+
+	res, err := tx.ExecContext(c, `
+		UPDATE sessions SET revoked_at = `+now+`
+		WHERE revoked_at IS NULL AND `+where+`;
+	`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("could not revoke sessions: %v", err)
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("could not revoke sessions: %v", err)
+	}
+	return revoked, nil
+}
+
+// ListSessions returns the user's sessions that can still be refreshed,
+// most recently used first.
+func (r *UserRepository) ListSessions(c context.Context, userId int32) ([]Session, error) {
+	rows, err := r.db.QueryContext(c, `
+		SELECT id, coalesce(user_agent, ''), coalesce(ip_address, ''), coalesce(device_label, ''),
+		       created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC, id;
+	`, userId, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("could not query sessions: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.DeviceLabel, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("could not scan session: %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not query sessions: %v", err)
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs one of the user's sessions out. Its access tokens are
+// rejected from the next revocation check on.
+func (r *UserRepository) RevokeSession(c context.Context, userId int32, sessionId string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeSessions(c, tx, `id = $1 AND user_id = $2`, sessionId, userId)
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrSessionNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs out everywhere but currentSessionId and returns
+// how many sessions were ended.
+func (r *UserRepository) RevokeOtherSessions(c context.Context, userId int32, currentSessionId string) (int64, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeSessions(c, tx, `user_id = $1 AND id <> $2`, userId, currentSessionId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return revoked, nil
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// sessionFixture is two users: alice logged in from three devices and bob
+// from one.
+type sessionFixture struct {
+	alice, bob int32
+	// devices are alice's sessions in the order they were started.
+	devices []*IssuedSession
+	bobs    *IssuedSession
+}
+
+func newSessionFixture(t *testing.T, repo Repository) *sessionFixture {
+	t.Helper()
+	c := context.Background()
+	password := "correct horse battery staple"
+	register := func(name, phone string) int32 {
+		user, err := repo.RegisterUser(c, UserRegister{FullName: name, Email: name + "@example.com", Password: &password, PhoneNumber: phone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.VerifyEmail(c, user.ID, user.Email); err != nil {
+			t.Fatal(err)
+		}
+		return user.ID
+	}
+	login := func(userId int32, client ClientInfo) *IssuedSession {
+		session, err := repo.CreateSession(c, userId, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+
+	f := &sessionFixture{alice: register("alice", "+628170000001"), bob: register("bob", "+628170000002")}
+	for i := range 3 {
+		f.devices = append(f.devices, login(f.alice, ClientInfo{
+			IP:          fmt.Sprintf("203.0.113.%d", i+1),
+			UserAgent:   fmt.Sprintf("browser %d", i),
+			DeviceLabel: fmt.Sprintf("device %d", i),
+		}))
+	}
+	f.bobs = login(f.bob, ClientInfo{IP: "198.51.100.1"})
+	return f
+}
+
+// sessionIds lists the ids of sessions in order.
+func sessionIds(sessions []Session) []string {
+	ids := []string{}
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+func TestListSessions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		f := newSessionFixture(t, repo)
+
+		// Refreshing the first session makes it the most recently used.
+		if _, err := repo.RotateRefreshToken(c, f.devices[0].RefreshToken, ClientInfo{IP: "192.0.2.9"}); err != nil {
+			t.Fatal(err)
+		}
+
+		sessions, err := repo.ListSessions(c, f.alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{f.devices[0].SessionID, f.devices[2].SessionID, f.devices[1].SessionID}
+		if got := sessionIds(sessions); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("ListSessions() = %v, want %v", got, want)
+		}
+
+		tests := []struct {
+			session Session
+			ip      string
+			agent   string
+			label   string
+		}{
+			{sessions[0], "192.0.2.9", "browser 0", "device 0"},
+			{sessions[1], "203.0.113.3", "browser 2", "device 2"},
+			{sessions[2], "203.0.113.2", "browser 1", "device 1"},
+		}
+		for _, tt := range tests {
+			s := tt.session
+			if s.IPAddress != tt.ip || s.UserAgent != tt.agent || s.DeviceLabel != tt.label {
+				t.Errorf("session %s = %q/%q/%q, want %q/%q/%q", s.ID, s.IPAddress, s.UserAgent, s.DeviceLabel, tt.ip, tt.agent, tt.label)
+			}
+			if s.LastSeenAt.Before(s.CreatedAt) || !s.ExpiresAt.After(s.LastSeenAt) {
+				t.Errorf("session %s times = %s/%s/%s", s.ID, s.CreatedAt, s.LastSeenAt, s.ExpiresAt)
+			}
+		}
+
+		if sessions, err := repo.ListSessions(c, 4242); err != nil || len(sessions) != 0 {
+			t.Errorf("ListSessions() of an unknown user = %v, %v; want none", sessions, err)
+		}
+	})
+}
+
+func TestRevokeSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(c context.Context, repo Repository, f *sessionFixture) (int64, error)
+		// wantRevoked is the count RevokeOtherSessions reports.
+		wantRevoked int64
+		wantErr     error
+		// wantAlice are alice's sessions left, by index into devices in
+		// the order ListSessions returns them.
+		wantAlice []int
+	}{
+		{
+			name: "revoke one session",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				return 0, repo.RevokeSession(c, f.alice, f.devices[1].SessionID)
+			},
+			wantAlice: []int{2, 0},
+		},
+		{
+			name: "revoke a session twice",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				if err := repo.RevokeSession(c, f.alice, f.devices[1].SessionID); err != nil {
+					return 0, err
+				}
+				return 0, repo.RevokeSession(c, f.alice, f.devices[1].SessionID)
+			},
+			wantErr:   ErrSessionNotFound,
+			wantAlice: []int{2, 0},
+		},
+		{
+			name: "revoke another user's session",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				return 0, repo.RevokeSession(c, f.alice, f.bobs.SessionID)
+			},
+			wantErr:   ErrSessionNotFound,
+			wantAlice: []int{2, 1, 0},
+		},
+		{
+			name: "revoke an unknown session",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				return 0, repo.RevokeSession(c, f.alice, "no-such-session")
+			},
+			wantErr:   ErrSessionNotFound,
+			wantAlice: []int{2, 1, 0},
+		},
+		{
+			name: "revoke the other sessions",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				return repo.RevokeOtherSessions(c, f.alice, f.devices[1].SessionID)
+			},
+			wantRevoked: 2,
+			wantAlice:   []int{1},
+		},
+		{
+			name: "revoke the other sessions twice",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				if _, err := repo.RevokeOtherSessions(c, f.alice, f.devices[1].SessionID); err != nil {
+					return 0, err
+				}
+				return repo.RevokeOtherSessions(c, f.alice, f.devices[1].SessionID)
+			},
+			wantRevoked: 0,
+			wantAlice:   []int{1},
+		},
+		{
+			name: "revoke the other sessions after one was revoked",
+			revoke: func(c context.Context, repo Repository, f *sessionFixture) (int64, error) {
+				if err := repo.RevokeSession(c, f.alice, f.devices[0].SessionID); err != nil {
+					return 0, err
+				}
+				return repo.RevokeOtherSessions(c, f.alice, f.devices[2].SessionID)
+			},
+			wantRevoked: 1,
+			wantAlice:   []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				f := newSessionFixture(t, repo)
+
+				revoked, err := tt.revoke(c, repo, f)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if revoked != tt.wantRevoked {
+					t.Errorf("revoked %d sessions, want %d", revoked, tt.wantRevoked)
+				}
+
+				sessions, err := repo.ListSessions(c, f.alice)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []string{}
+				left := make(map[int]bool)
+				for _, i := range tt.wantAlice {
+					want = append(want, f.devices[i].SessionID)
+					left[i] = true
+				}
+				if got := sessionIds(sessions); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("sessions left = %v, want %v", got, want)
+				}
+
+				// A revoked session can no longer be refreshed.
+				for i, device := range f.devices {
+					_, err := repo.RotateRefreshToken(c, device.RefreshToken, ClientInfo{})
+					if wantErr := !left[i]; (err != nil) != wantErr {
+						t.Errorf("refresh of session %d: error %v, revoked %v", i, err, wantErr)
+					}
+				}
+
+				// Bob is never affected.
+				if sessions, err := repo.ListSessions(c, f.bob); err != nil || len(sessions) != 1 {
+					t.Errorf("bob's sessions = %v, %v; want one", sessions, err)
+				}
+			})
+		})
+	}
+}
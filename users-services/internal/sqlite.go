@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteTimeLayout is how times are written to SQLite. Timestamps are text
+// there, so every value has to be UTC with the same number of digits for
+// comparisons to follow the clock.
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000000"
+
+var (
+	placeholderRegex = regexp.MustCompile(`\$(\d+)`)
+	// Row locks are meaningless in SQLite, where a write transaction has the
+	// whole database to itself.
+	forUpdateRegex = regexp.MustCompile(`(?i)\s+FOR\s+UPDATE(\s+OF\s+\w+(\s*,\s*\w+)*)?(\s+SKIP\s+LOCKED)?`)
+)
+
+// OpenSQLite opens the SQLite database at path, creating it if needed, for
+// NewSQLiteRepository and migrations.NewSQLiteMigrator. Transactions begin
+// immediately, so writers queue up on the busy timeout instead of failing
+// when two of them upgrade from reading at the same time.
+func OpenSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"},
+		"_txlock": {"immediate"},
+	}.Encode()
+
+	db := sql.OpenDB(sqliteConnector{dsn: dsn, driver: &sqlite.Driver{}})
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	return db, nil
+}
+
+// NewSQLiteRepository returns a UserRepository on a database opened with
+// OpenSQLite. It suits a single instance: every write transaction waits for
+// the one before it.
+func NewSQLiteRepository(db *sql.DB, hasher PasswordHasher) *UserRepository {
+	r := NewUserRepository(db, hasher)
+	r.sqlite = true
+	return r
+}
+
+// sqliteUniqueConstraint returns what a SQLite unique violation names:
+// "table.column" for column constraints or the index name for expression
+// indexes.
+func sqliteUniqueConstraint(err error) (string, bool) {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return "", false
+	}
+	_, constraint, ok := strings.Cut(sqliteErr.Error(), "UNIQUE constraint failed: ")
+	if !ok {
+		return "", false
+	}
+	constraint, _, _ = strings.Cut(constraint, " (")
+	if name, ok := strings.CutPrefix(constraint, "index "); ok {
+		constraint = strings.Trim(name, "'")
+	}
+	return constraint, true
+}
+
+// sqliteQuery turns the Postgres flavoured SQL of UserRepository into SQLite:
+// $1 placeholders become ?1 and row locks are dropped.
+func sqliteQuery(query string) string {
+	query = forUpdateRegex.ReplaceAllString(query, "")
+	return placeholderRegex.ReplaceAllString(query, "?$1")
+}
+
+// sqliteConnector hands out connections that accept the SQL and arguments
+// UserRepository uses on Postgres.
+type sqliteConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (sc sqliteConnector) Connect(c context.Context) (driver.Conn, error) {
+	conn, err := sc.driver.Open(sc.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{Conn: conn}, nil
+}
+
+func (sc sqliteConnector) Driver() driver.Driver {
+	return sc.driver
+}
+
+// sqliteConn rewrites every query with sqliteQuery and every time argument
+// to sqliteTimeLayout before passing it on to the SQLite driver.
+type sqliteConn struct {
+	driver.Conn
+}
+
+func (conn *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.Conn.Prepare(sqliteQuery(query))
+}
+
+func (conn *sqliteConn) PrepareContext(c context.Context, query string) (driver.Stmt, error) {
+	return conn.Conn.(driver.ConnPrepareContext).PrepareContext(c, sqliteQuery(query))
+}
+
+func (conn *sqliteConn) BeginTx(c context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return conn.Conn.(driver.ConnBeginTx).BeginTx(c, opts)
+}
+
+func (conn *sqliteConn) ExecContext(c context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return conn.Conn.(driver.ExecerContext).ExecContext(c, sqliteQuery(query), args)
+}
+
+func (conn *sqliteConn) QueryContext(c context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return conn.Conn.(driver.QueryerContext).QueryContext(c, sqliteQuery(query), args)
+}
+
+func (conn *sqliteConn) Ping(c context.Context) error {
+	return conn.Conn.(driver.Pinger).Ping(c)
+}
+
+func (conn *sqliteConn) ResetSession(c context.Context) error {
+	return conn.Conn.(driver.SessionResetter).ResetSession(c)
+}
+
+// CheckNamedValue formats times, including those inside sql.NullTime, and
+// leaves every other argument to the default conversion.
+func (conn *sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if valuer, ok := nv.Value.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		nv.Value = value
+	}
+	if t, ok := nv.Value.(time.Time); ok {
+		nv.Value = t.UTC().Format(sqliteTimeLayout)
+		return nil
+	}
+	return driver.ErrSkip
+}
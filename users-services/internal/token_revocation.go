@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// revocationCache remembers revoked token ids until the tokens expire.
+// Revocation is permanent, so a cached hit never goes stale; misses still
+// fall through to Postgres because another replica may have revoked the
+// token.
+type revocationCache struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{revoked: make(map[string]time.Time)}
+}
+
+func (rc *revocationCache) add(jti string, expiresAt time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.revoked[jti] = expiresAt
+}
+
+func (rc *revocationCache) contains(jti string) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	_, ok := rc.revoked[jti]
+	return ok
+}
+
+func (rc *revocationCache) prune(now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for jti, expiresAt := range rc.revoked {
+		if now.After(expiresAt) {
+			delete(rc.revoked, jti)
+		}
+	}
+}
+
+func (r *UserRepository) RevokeAccessToken(c context.Context, jti string, userId int32, expiresAt time.Time) error {
+	query := `
+		insert into revoked_tokens (
+		    jti,
+		    user_id,
+		    expires_at
+		) values (
+			$1, $2, $3
+		) ON CONFLICT (jti) DO NOTHING
+    `
+	if _, err := r.db.ExecContext(c, query, jti, userId, expiresAt); err != nil {
+		return fmt.Errorf("could not revoke token: %v", err)
+	}
+	r.revoked.add(jti, expiresAt)
+	return nil
+}
+
+// revokeUserTokens invalidates every access and refresh token issued to the
+// user up to now.
+func revokeUserTokens(c context.Context, tx *sql.Tx, userId int32) error {
+	now := time.Now()
+
+	// iat only has second precision, so the cutoff is truncated to keep a
+	// token issued right after the revocation valid.
+	if _, err := tx.ExecContext(c, `UPDATE users SET tokens_valid_after = $2 WHERE id = $1;`, userId, now.Truncate(time.Second)); err != nil {
+		return fmt.Errorf("could not revoke user tokens: %v", err)
+	}
+	if _, err := revokeSessions(c, tx, `user_id = $1`, userId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily ends the session the refresh token belongs to.
+func (r *UserRepository) RevokeRefreshTokenFamily(c context.Context, refreshToken string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := revokeSessions(c, tx, `id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`, hashToken(refreshToken)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether an access token was revoked explicitly, was
+// issued before a user-wide revocation, belongs to a session that was
+// logged out, or belongs to a user that can no longer log in. Tokens issued
+// before sessions existed have no sessionId.
+func (r *UserRepository) IsTokenRevoked(c context.Context, jti, sessionId string, userId int32, issuedAt, expiresAt time.Time) (bool, error) {
+	if jti == "" || r.revoked.contains(jti) {
+		return true, nil
+	}
+
+	query := `
+		SELECT
+		    	EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+		    	OR EXISTS (SELECT 1 FROM sessions WHERE id = $3 AND revoked_at IS NOT NULL),
+		    	u.tokens_valid_after
+		FROM users u
+		WHERE u.id = $2
+		AND u.is_deleted = false
+		AND u.is_active = true;
+    `
+	var revoked bool
+	var validAfter sql.NullTime
+	err := r.db.QueryRowContext(c, query, jti, userId, sessionId).Scan(&revoked, &validAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return true, nil
+		}
+		return false, fmt.Errorf("could not query token revocation: %v", err)
+	}
+
+	if validAfter.Valid && issuedAt.Before(validAfter.Time) {
+		return true, nil
+	}
+	if revoked {
+		r.revoked.add(jti, expiresAt)
+	}
+	return revoked, nil
+}
+
+// PruneRevokedTokens drops revocation entries for tokens that have expired
+// anyway.
+func (r *UserRepository) PruneRevokedTokens(c context.Context) error {
+	now := time.Now()
+	if _, err := r.db.ExecContext(c, `DELETE FROM revoked_tokens WHERE expires_at < $1;`, now); err != nil {
+		return fmt.Errorf("could not prune revoked tokens: %v", err)
+	}
+	r.revoked.prune(now)
+	return nil
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// codeAt returns the code an authenticator app shows for secret at step.
+func codeAt(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, step)
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	current := totpStep(now)
+
+	tests := []struct {
+		name         string
+		secret       string
+		code         string
+		lastUsedStep int64
+		wantStep     int64
+		wantOK       bool
+	}{
+		{"current step", secret, codeAt(t, secret, current), 0, current, true},
+		{"one step behind", secret, codeAt(t, secret, current-1), 0, current - 1, true},
+		{"one step ahead", secret, codeAt(t, secret, current+1), 0, current + 1, true},
+		{"two steps behind", secret, codeAt(t, secret, current-2), 0, 0, false},
+		{"two steps ahead", secret, codeAt(t, secret, current+2), 0, 0, false},
+		{"replay of the last used step", secret, codeAt(t, secret, current), current, 0, false},
+		{"step before the last used one", secret, codeAt(t, secret, current-1), current, 0, false},
+		{"step after the last used one", secret, codeAt(t, secret, current+1), current, current + 1, true},
+		{"wrong length", secret, codeAt(t, secret, current)[:5], 0, 0, false},
+		{"invalid secret", "not base32!", "123456", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := validateTOTP(tt.secret, tt.code, now, tt.lastUsedStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("validateTOTP() = %d, %v, want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
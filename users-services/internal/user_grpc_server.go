@@ -2,10 +2,20 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/wafi11/microservices/users-services/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type GrpcServer struct {
@@ -29,7 +39,7 @@ func (s *GrpcServer) RegisterUser(ctx context.Context, req *proto.RegisterReques
 	// call service
 	user, err := s.service.RegisterUser(ctx, userReq)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	// convert internal type → proto
@@ -37,34 +47,493 @@ func (s *GrpcServer) RegisterUser(ctx context.Context, req *proto.RegisterReques
 }
 
 func (s *GrpcServer) LoginUser(c context.Context, req *proto.LoginRequest) (*proto.LoginResponse, error) {
-	token, err := s.service.LoginUser(c, req.GetEmail(), req.GetPassword())
+	result, err := s.service.LoginUser(c, req.GetEmail(), req.GetPassword(), clientInfo(c))
+
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	if result.MFAToken != "" {
+		return &proto.LoginResponse{MfaRequired: true, MfaToken: result.MFAToken}, nil
+	}
+
+	return tokenPairToProto(result.Tokens), nil
+}
+
+func (s *GrpcServer) VerifyMFA(c context.Context, req *proto.VerifyMFARequest) (*proto.LoginResponse, error) {
+	if req.GetMfaToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "mfa token is required")
+	}
+	if (req.GetCode() == "") == (req.GetRecoveryCode() == "") {
+		return nil, status.Error(codes.InvalidArgument, "exactly one of code or recovery code is required")
+	}
+
+	tokens, err := s.service.VerifyMFA(c, req.GetMfaToken(), req.GetCode(), req.GetRecoveryCode(), clientInfo(c))
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return tokenPairToProto(tokens), nil
+}
+
+func (s *GrpcServer) LoginWithExternalIdentity(c context.Context, req *proto.LoginWithExternalIdentityRequest) (*proto.LoginResponse, error) {
+	if req.GetProvider() == "" || req.GetSubject() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider and subject are required")
+	}
+	if req.GetEmail() != "" {
+		if err := validateEmail(req.GetEmail()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	result, err := s.service.LoginWithExternalIdentity(c, ExternalIdentity{
+		Provider:      req.GetProvider(),
+		Subject:       req.GetSubject(),
+		Email:         req.GetEmail(),
+		EmailVerified: req.GetEmailVerified(),
+		FullName:      req.GetFullName(),
+	}, clientInfo(c))
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	if result.MFAToken != "" {
+		return &proto.LoginResponse{MfaRequired: true, MfaToken: result.MFAToken}, nil
+	}
+	return tokenPairToProto(result.Tokens), nil
+}
+
+func (s *GrpcServer) LinkIdentity(c context.Context, req *proto.LinkIdentityRequest) (*proto.LinkIdentityResponse, error) {
+	if req.GetProvider() == "" || req.GetSubject() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider and subject are required")
+	}
+	err := s.service.LinkIdentity(c, req.GetUserId(), ExternalIdentity{
+		Provider: req.GetProvider(),
+		Subject:  req.GetSubject(),
+		Email:    req.GetEmail(),
+	})
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.LinkIdentityResponse{}, nil
+}
+
+func (s *GrpcServer) UnlinkIdentity(c context.Context, req *proto.UnlinkIdentityRequest) (*proto.UnlinkIdentityResponse, error) {
+	if req.GetProvider() == "" {
+		return nil, status.Error(codes.InvalidArgument, "provider is required")
+	}
+	if err := s.service.UnlinkIdentity(c, req.GetUserId(), req.GetProvider()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.UnlinkIdentityResponse{}, nil
+}
+
+func (s *GrpcServer) ListIdentities(c context.Context, req *proto.ListIdentitiesRequest) (*proto.ListIdentitiesResponse, error) {
+	identities, err := s.service.ListIdentities(c, req.GetUserId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	resp := &proto.ListIdentitiesResponse{}
+	for _, identity := range identities {
+		item := &proto.Identity{
+			Provider:  identity.Provider,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt.Format(time.RFC3339),
+		}
+		if identity.LastLoginAt != nil {
+			item.LastLoginAt = identity.LastLoginAt.Format(time.RFC3339)
+		}
+		resp.Identities = append(resp.Identities, item)
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) EnrollTOTP(c context.Context, req *proto.EnrollTOTPRequest) (*proto.EnrollTOTPResponse, error) {
+	secret, uri, err := s.service.EnrollTOTP(c, req.GetUserId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.EnrollTOTPResponse{Secret: secret, OtpauthUri: uri}, nil
+}
+
+func (s *GrpcServer) ConfirmTOTP(c context.Context, req *proto.ConfirmTOTPRequest) (*proto.ConfirmTOTPResponse, error) {
+	if req.GetCode() == "" {
+		return nil, status.Error(codes.InvalidArgument, "code is required")
+	}
+	recoveryCodes, err := s.service.ConfirmTOTP(c, req.GetUserId(), req.GetCode())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (s *GrpcServer) DisableTOTP(c context.Context, req *proto.DisableTOTPRequest) (*proto.DisableTOTPResponse, error) {
+	if req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "password is required")
+	}
+	if err := s.service.DisableTOTP(c, req.GetUserId(), req.GetPassword()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.DisableTOTPResponse{}, nil
+}
+
+func (s *GrpcServer) ChangePassword(c context.Context, req *proto.ChangePasswordRequest) (*proto.LoginResponse, error) {
+	if req.GetCurrentPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "current password is required")
+	}
+
+	tokens, err := s.service.ChangePassword(c, req.GetUserId(), req.GetCurrentPassword(), req.GetNewPassword(), clientInfo(c))
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return tokenPairToProto(tokens), nil
+}
+
+func (s *GrpcServer) CheckUsernameAvailability(c context.Context, req *proto.CheckUsernameAvailabilityRequest) (*proto.CheckUsernameAvailabilityResponse, error) {
+	available, reason, message, err := s.service.CheckUsernameAvailability(c, req.GetUsername())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.CheckUsernameAvailabilityResponse{Available: available, Reason: reason, Message: message}, nil
+}
+
+func (s *GrpcServer) ChangeUsername(c context.Context, req *proto.ChangeUsernameRequest) (*proto.FindMeResponse, error) {
+	if err := validateUsername(req.GetUsername()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	user, err := s.service.ChangeUsername(c, req.GetUserId(), req.GetUsername())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return userToFindMe(*user), nil
+}
+
+func (s *GrpcServer) ResolveUsername(c context.Context, req *proto.ResolveUsernameRequest) (*proto.ResolveUsernameResponse, error) {
+	userId, username, err := s.service.ResolveUsername(c, req.GetUsername())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.ResolveUsernameResponse{
+		UserId:     userId,
+		Username:   username,
+		Redirected: !strings.EqualFold(username, req.GetUsername()),
+	}, nil
+}
+
+func (s *GrpcServer) UnlockUser(c context.Context, req *proto.UnlockUserRequest) (*proto.UnlockUserResponse, error) {
+	if err := s.service.UnlockUser(c, req.GetUserId()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.UnlockUserResponse{}, nil
+}
+
+func (s *GrpcServer) DeleteAccount(c context.Context, req *proto.DeleteAccountRequest) (*proto.DeleteAccountResponse, error) {
+	if req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "password is required")
+	}
+	if err := s.service.DeleteAccount(c, req.GetUserId(), req.GetPassword()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.DeleteAccountResponse{}, nil
+}
+
+// RestoreUser is meant for admin tooling; the gateway does not route to it.
+func (s *GrpcServer) RestoreUser(c context.Context, req *proto.RestoreUserRequest) (*proto.FindMeResponse, error) {
+	user, err := s.service.RestoreUser(c, req.GetUserId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return userToFindMe(*user), nil
+}
+
+func (s *GrpcServer) ListUsers(c context.Context, req *proto.ListUsersRequest) (*proto.ListUsersResponse, error) {
+	filter := UserFilter{
+		Active:         req.Active,
+		Deleted:        req.Deleted,
+		EmailPrefix:    req.GetEmailPrefix(),
+		UsernamePrefix: req.GetUsernamePrefix(),
+		SortBy:         req.GetSortBy(),
+		Descending:     req.GetDescending(),
+		PageSize:       int(req.GetPageSize()),
+		PageToken:      req.GetPageToken(),
+	}
+	var err error
+	if filter.CreatedAfter, err = parseOptionalTime(req.GetCreatedAfter()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if filter.CreatedBefore, err = parseOptionalTime(req.GetCreatedBefore()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	page, err := s.service.ListUsers(c, filter)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	resp := &proto.ListUsersResponse{NextPageToken: page.NextPageToken, TotalCount: page.TotalCount}
+	for _, user := range page.Users {
+		resp.Users = append(resp.Users, userToAdmin(user))
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) ListAuditEvents(c context.Context, req *proto.ListAuditEventsRequest) (*proto.ListAuditEventsResponse, error) {
+	filter := AuditFilter{
+		UserID:    req.GetUserId(),
+		TargetID:  req.GetTargetId(),
+		Type:      req.GetEventType(),
+		Outcome:   req.GetOutcome(),
+		PageSize:  int(req.GetPageSize()),
+		PageToken: req.GetPageToken(),
+	}
+	var err error
+	if filter.Since, err = parseOptionalTime(req.GetSince()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if filter.Until, err = parseOptionalTime(req.GetUntil()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	page, err := s.service.ListAuditEvents(c, filter)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	resp := &proto.ListAuditEventsResponse{NextPageToken: page.NextPageToken}
+	for _, event := range page.Events {
+		resp.Events = append(resp.Events, &proto.AuditEvent{
+			Id:         event.ID,
+			OccurredAt: event.OccurredAt.Format(time.RFC3339),
+			EventType:  event.Type,
+			ActorId:    event.ActorID,
+			TargetId:   event.TargetID,
+			IpAddress:  event.IPAddress,
+			UserAgent:  event.UserAgent,
+			Outcome:    event.Outcome,
+			RequestId:  event.RequestID,
+			Details:    event.Details,
+		})
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) AssignRole(c context.Context, req *proto.AssignRoleRequest) (*proto.ListRolesResponse, error) {
+	if req.GetRole() == "" {
+		return nil, status.Error(codes.InvalidArgument, "role is required")
+	}
+	if err := s.service.AssignRole(c, req.GetUserId(), req.GetRole()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return s.ListRoles(c, &proto.ListRolesRequest{UserId: req.GetUserId()})
+}
+
+func (s *GrpcServer) RevokeRole(c context.Context, req *proto.RevokeRoleRequest) (*proto.ListRolesResponse, error) {
+	if req.GetRole() == "" {
+		return nil, status.Error(codes.InvalidArgument, "role is required")
+	}
+	if err := s.service.RevokeRole(c, req.GetUserId(), req.GetRole()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return s.ListRoles(c, &proto.ListRolesRequest{UserId: req.GetUserId()})
+}
+
+func (s *GrpcServer) ListRoles(c context.Context, req *proto.ListRolesRequest) (*proto.ListRolesResponse, error) {
+	roles, err := s.service.ListRoles(c, req.GetUserId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
 
+	resp := &proto.ListRolesResponse{}
+	for _, role := range roles {
+		resp.Roles = append(resp.Roles, &proto.Role{
+			Name:        role.Name,
+			Description: role.Description,
+			Permissions: role.Permissions,
+		})
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) RequestPasswordReset(c context.Context, req *proto.RequestPasswordResetRequest) (*proto.RequestPasswordResetResponse, error) {
+	if err := validateEmail(req.GetEmail()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.service.RequestPasswordReset(c, req.GetEmail()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.RequestPasswordResetResponse{}, nil
+}
+
+func (s *GrpcServer) ResetPassword(c context.Context, req *proto.ResetPasswordRequest) (*proto.ResetPasswordResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+	if err := s.service.ResetPassword(c, req.GetToken(), req.GetNewPassword()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.ResetPasswordResponse{}, nil
+}
+
+func (s *GrpcServer) VerifyEmail(c context.Context, req *proto.VerifyEmailRequest) (*proto.VerifyEmailResponse, error) {
+	if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+	if err := s.service.VerifyEmail(c, req.GetToken()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.VerifyEmailResponse{}, nil
+}
+
+func (s *GrpcServer) ResendVerification(c context.Context, req *proto.ResendVerificationRequest) (*proto.ResendVerificationResponse, error) {
+	if err := validateEmail(req.GetEmail()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.service.ResendVerification(c, req.GetEmail()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.ResendVerificationResponse{}, nil
+}
+
+func (s *GrpcServer) RefreshToken(c context.Context, req *proto.RefreshTokenRequest) (*proto.LoginResponse, error) {
+	if req.GetRefreshToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh token is required")
+	}
+
+	tokens, err := s.service.RefreshToken(c, req.GetRefreshToken(), clientInfo(c))
 	if err != nil {
-		return nil, status.Error(codes.Unauthenticated, err.Error())
+		return nil, statusFromError(err)
 	}
 
-	return &proto.LoginResponse{Token: token}, nil
+	return tokenPairToProto(tokens), nil
 }
 
 func (s *GrpcServer) FindMe(c context.Context, req *proto.FindMeRequest) (*proto.FindMeResponse, error) {
 	user, err := s.service.FindMe(c, req.GetUserId())
 	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return userToFindMe(*user), nil
+}
+
+// profileFields maps UpdateProfile field mask paths onto ProfileUpdate.
+var profileFields = map[string]func(*ProfileUpdate, *proto.UpdateProfileRequest){
+	"full_name":     func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.FullName = &r.FullName },
+	"phone_number":  func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.PhoneNumber = &r.PhoneNumber },
+	"bio":           func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.Bio = &r.Bio },
+	"avatar_url":    func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.AvatarURL = &r.AvatarUrl },
+	"locale":        func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.Locale = &r.Locale },
+	"timezone":      func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.Timezone = &r.Timezone },
+	"date_of_birth": func(u *ProfileUpdate, r *proto.UpdateProfileRequest) { u.DateOfBirth = &r.DateOfBirth },
+}
+
+func (s *GrpcServer) UpdateProfile(c context.Context, req *proto.UpdateProfileRequest) (*proto.FindMeResponse, error) {
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "update_mask must list at least one field")
+	}
+
+	var update ProfileUpdate
+	for _, path := range paths {
+		apply, ok := profileFields[path]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "field %q cannot be updated", path)
+		}
+		apply(&update, req)
+	}
+
+	if err := update.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	user, err := s.service.UpdateProfile(c, req.GetUserId(), update)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return userToFindMe(*user), nil
+}
+
+func (s *GrpcServer) Logout(c context.Context, req *proto.LogoutRequest) (*proto.LogoutResponse, error) {
+	if err := s.service.Logout(c, req.GetToken(), req.GetRefreshToken()); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	return &proto.FindMeResponse{
-		FullName:    user.FullName,
-		Username:    user.Username,
-		Email:       user.Email,
-		PhoneNumber: user.PhoneNumber,
-		IsActive:    user.IsActive,
-		CreatedAt:   user.CreatedAt.String(),
-	}, nil
+	return &proto.LogoutResponse{}, nil
+}
+
+func (s *GrpcServer) IsTokenRevoked(c context.Context, req *proto.IsTokenRevokedRequest) (*proto.IsTokenRevokedResponse, error) {
+	revoked, err := s.service.IsTokenRevoked(
+		c,
+		req.GetJti(),
+		req.GetSessionId(),
+		req.GetUserId(),
+		time.Unix(req.GetIssuedAt(), 0),
+		time.Unix(req.GetExpiresAt(), 0),
+	)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &proto.IsTokenRevokedResponse{Revoked: revoked}, nil
+}
+
+func (s *GrpcServer) ListSessions(c context.Context, req *proto.ListSessionsRequest) (*proto.ListSessionsResponse, error) {
+	sessions, err := s.service.ListSessions(c, req.GetUserId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	resp := &proto.ListSessionsResponse{}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &proto.Session{
+			Id:          session.ID,
+			UserAgent:   session.UserAgent,
+			IpAddress:   session.IPAddress,
+			DeviceLabel: session.DeviceLabel,
+			CreatedAt:   session.CreatedAt.Format(time.RFC3339),
+			LastSeenAt:  session.LastSeenAt.Format(time.RFC3339),
+			ExpiresAt:   session.ExpiresAt.Format(time.RFC3339),
+			Current:     session.ID == req.GetCurrentSessionId(),
+		})
+	}
+	return resp, nil
+}
+
+func (s *GrpcServer) RevokeSession(c context.Context, req *proto.RevokeSessionRequest) (*proto.RevokeSessionResponse, error) {
+	if req.GetSessionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "session id is required")
+	}
+	if err := s.service.RevokeSession(c, req.GetUserId(), req.GetSessionId()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.RevokeSessionResponse{}, nil
+}
+
+func (s *GrpcServer) RevokeAllOtherSessions(c context.Context, req *proto.RevokeAllOtherSessionsRequest) (*proto.RevokeAllOtherSessionsResponse, error) {
+	if req.GetCurrentSessionId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "current session id is required")
+	}
+	revoked, err := s.service.RevokeAllOtherSessions(c, req.GetUserId(), req.GetCurrentSessionId())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &proto.RevokeAllOtherSessionsResponse{Revoked: revoked}, nil
+}
+
+func (s *GrpcServer) GetJWKS(c context.Context, req *proto.GetJWKSRequest) (*proto.GetJWKSResponse, error) {
+	jwks, err := s.service.JWKS()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &proto.GetJWKSResponse{Jwks: string(jwks)}, nil
 }
 
 func protoToUser(req *proto.RegisterRequest) UserRegister {
 	password := req.Password
 	return UserRegister{
 		FullName:    req.FullName,
+		Username:    req.Username,
 		Email:       req.Email,
 		Password:    &password,
 		PhoneNumber: req.PhoneNumber,
@@ -81,3 +550,197 @@ func userToProto(user User) *proto.UserResponse {
 		IsActive:    user.IsActive,
 	}
 }
+
+func tokenPairToProto(tokens *TokenPair) *proto.LoginResponse {
+	return &proto.LoginResponse{
+		Token:                 tokens.AccessToken,
+		RefreshToken:          tokens.RefreshToken,
+		RefreshTokenExpiresAt: tokens.RefreshExpiresAt.Unix(),
+	}
+}
+
+// parseOptionalTime parses an RFC 3339 timestamp, treating "" as unset.
+func parseOptionalTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q: expected RFC 3339", value)
+	}
+	return &t, nil
+}
+
+func userToAdmin(user User) *proto.AdminUser {
+	resp := &proto.AdminUser{
+		Id:          user.ID,
+		FullName:    user.FullName,
+		Username:    user.Username,
+		Email:       user.Email,
+		PhoneNumber: user.PhoneNumber,
+		IsActive:    user.IsActive,
+		IsDeleted:   user.IsDeleted,
+		CreatedAt:   user.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:   user.UpdatedAt.Format(time.RFC3339),
+	}
+	if user.DeletedAt != nil {
+		resp.DeletedAt = user.DeletedAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+func userToFindMe(user User) *proto.FindMeResponse {
+	resp := &proto.FindMeResponse{
+		FullName:    user.FullName,
+		Username:    user.Username,
+		Email:       user.Email,
+		PhoneNumber: user.PhoneNumber,
+		IsActive:    user.IsActive,
+		CreatedAt:   user.CreatedAt.String(),
+		Bio:         user.Bio,
+		AvatarUrl:   user.AvatarURL,
+		Locale:      user.Locale,
+		Timezone:    user.Timezone,
+		UpdatedAt:   user.UpdatedAt.String(),
+	}
+	if user.DateOfBirth != nil {
+		resp.DateOfBirth = user.DateOfBirth.Format(time.DateOnly)
+	}
+	return resp
+}
+
+// errorDomain is sent in ErrorInfo details so clients can tell our reasons
+// apart from those of other services.
+const errorDomain = "users-services"
+
+// statusWithReason attaches a stable, machine readable reason to the status
+// so the gateway does not have to match on error messages.
+func statusWithReason(code codes.Code, err error, reason string) error {
+	return statusWithDetails(code, err, &errdetails.ErrorInfo{Reason: reason, Domain: errorDomain})
+}
+
+// statusWithDetails attaches details to the status, falling back to the
+// bare status if they cannot be encoded.
+func statusWithDetails(code codes.Code, err error, details ...protoadapt.MessageV1) error {
+	st := status.New(code, err.Error())
+	detailed, derr := st.WithDetails(details...)
+	if derr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// Metadata set by the gateway to describe the end user's device, since the
+// gRPC peer is the gateway itself.
+const (
+	clientIPMetadataKey    = "x-client-ip"
+	userAgentMetadataKey   = "x-client-user-agent"
+	deviceLabelMetadataKey = "x-device-label"
+)
+
+func clientInfo(c context.Context) ClientInfo {
+	info := ClientInfo{IP: clientIP(c)}
+	if md, ok := metadata.FromIncomingContext(c); ok {
+		if values := md.Get(userAgentMetadataKey); len(values) > 0 {
+			info.UserAgent = values[0]
+		}
+		if values := md.Get(deviceLabelMetadataKey); len(values) > 0 {
+			info.DeviceLabel = values[0]
+		}
+	}
+	return info
+}
+
+// clientIP returns the end user's address forwarded by the gateway, falling
+// back to the gRPC peer for direct callers.
+func clientIP(c context.Context) string {
+	if md, ok := metadata.FromIncomingContext(c); ok {
+		if values := md.Get(clientIPMetadataKey); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	if p, ok := peer.FromContext(c); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// statusFromError maps errors returned by the service layer onto gRPC
+// status codes. Unknown errors are reported as Internal.
+func statusFromError(err error) error {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		st, derr := status.New(codes.ResourceExhausted, err.Error()).WithDetails(
+			&errdetails.ErrorInfo{Reason: "TOO_MANY_LOGIN_ATTEMPTS", Domain: errorDomain},
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(throttled.RetryAfter)},
+		)
+		if derr != nil {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return st.Err()
+	}
+
+	var weak *PasswordPolicyError
+	if errors.As(err, &weak) {
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(weak.Violations))
+		for i, violation := range weak.Violations {
+			violations[i] = &errdetails.BadRequest_FieldViolation{Field: weak.Field, Description: violation}
+		}
+		return statusWithDetails(codes.InvalidArgument, err,
+			&errdetails.ErrorInfo{Reason: "PASSWORD_POLICY", Domain: errorDomain},
+			&errdetails.BadRequest{FieldViolations: violations},
+		)
+	}
+
+	switch {
+	case errors.Is(err, ErrPasswordReused):
+		return statusWithDetails(codes.InvalidArgument, err,
+			&errdetails.ErrorInfo{Reason: "PASSWORD_REUSED", Domain: errorDomain},
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "new_password", Description: err.Error()},
+			}},
+		)
+	case errors.Is(err, ErrPasswordExpired):
+		return statusWithReason(codes.FailedPrecondition, err, "PASSWORD_EXPIRED")
+	case errors.Is(err, ErrEmailNotVerified):
+		return statusWithReason(codes.FailedPrecondition, err, "EMAIL_NOT_VERIFIED")
+	case errors.Is(err, ErrRestoreWindowExpired),
+		errors.Is(err, ErrMFAAlreadyEnabled),
+		errors.Is(err, ErrMFANotEnrolled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrExternalEmailRequired):
+		return statusWithReason(codes.FailedPrecondition, err, "EXTERNAL_EMAIL_NOT_VERIFIED")
+	case errors.Is(err, ErrLastLoginMethod):
+		return statusWithReason(codes.FailedPrecondition, err, "LAST_LOGIN_METHOD")
+	case errors.Is(err, ErrPasswordNotSet):
+		return statusWithReason(codes.FailedPrecondition, err, "PASSWORD_NOT_SET")
+	case errors.Is(err, ErrIdentityTaken):
+		return statusWithReason(codes.AlreadyExists, err, "IDENTITY_TAKEN")
+	case errors.Is(err, ErrUserNotFound),
+		errors.Is(err, ErrRoleNotFound),
+		errors.Is(err, ErrIdentityNotFound),
+		errors.Is(err, ErrSessionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrIncorrectPassword),
+		errors.Is(err, ErrPasswordUnchanged),
+		errors.Is(err, ErrInvalidResetToken),
+		errors.Is(err, ErrInvalidVerifyToken),
+		errors.Is(err, ErrInvalidPageToken),
+		errors.Is(err, ErrInvalidMFACode):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrEmailTaken),
+		errors.Is(err, ErrPhoneNumberTaken),
+		errors.Is(err, ErrUsernameTaken):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrInvalidCredentials),
+		errors.Is(err, ErrInvalidRefreshToken),
+		errors.Is(err, ErrRefreshTokenReused),
+		errors.Is(err, ErrInvalidMFAToken):
+		return status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -2,31 +2,64 @@ package internal
 
 import (
 	"errors"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
+
+	"golang.org/x/text/language"
 )
 
 type User struct {
-	ID          int32     `json:"userId"`
-	FullName    string    `json:"fullName"`
-	Username    string    `json:"username"`
-	Email       string    `json:"email"`
-	Password    *string   `json:"password,omitempty"`
-	PhoneNumber string    `json:"phoneNumber"`
-	IsActive    bool      `json:"isActive"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID          int32      `json:"userId"`
+	FullName    string     `json:"fullName"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Password    *string    `json:"password,omitempty"`
+	PhoneNumber string     `json:"phoneNumber"`
+	IsActive    bool       `json:"isActive"`
+	Bio         string     `json:"bio"`
+	AvatarURL   string     `json:"avatarUrl"`
+	Locale      string     `json:"locale"`
+	Timezone    string     `json:"timezone"`
+	DateOfBirth *time.Time `json:"dateOfBirth,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	IsDeleted   bool       `json:"isDeleted"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
 }
 
 type UserRegister struct {
 	FullName    string  `json:"fullName"`
+	Username    string  `json:"username,omitempty"` // derived from the email when empty
 	Email       string  `json:"email"`
 	Password    *string `json:"password,omitempty"`
 	PhoneNumber string  `json:"phoneNumber"`
 }
-type Repository interface {
-	registerUser(user UserRegister) (User, error)
+
+// ProfileUpdate carries the fields listed in an UpdateProfile field mask. A
+// nil field is left untouched; an empty optional field is cleared.
+type ProfileUpdate struct {
+	FullName    *string
+	PhoneNumber *string
+	Bio         *string
+	AvatarURL   *string
+	Locale      *string
+	Timezone    *string
+	DateOfBirth *string
+}
+
+type TokenPair struct {
+	AccessToken      string    `json:"accessToken"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+// LoginResult holds either a token pair or, when two-factor authentication
+// is enabled, the challenge token VerifyMFA expects.
+type LoginResult struct {
+	Tokens   *TokenPair
+	MFAToken string
 }
 
 var (
@@ -41,12 +74,54 @@ func (u *UserRegister) Validate() error {
 	if err := validateEmail(u.Email); err != nil {
 		return err
 	}
+	if u.Username != "" {
+		if err := validateUsername(u.Username); err != nil {
+			return err
+		}
+	}
 	if err := validatePhone(u.PhoneNumber); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (u *ProfileUpdate) Validate() error {
+	if u.FullName != nil {
+		if err := validateFullName(*u.FullName); err != nil {
+			return err
+		}
+	}
+	if u.PhoneNumber != nil {
+		if err := validatePhone(*u.PhoneNumber); err != nil {
+			return err
+		}
+	}
+	if u.Bio != nil && len(*u.Bio) > 500 {
+		return errors.New("bio max 500 characters")
+	}
+	if u.AvatarURL != nil && *u.AvatarURL != "" {
+		if err := validateAvatarURL(*u.AvatarURL); err != nil {
+			return err
+		}
+	}
+	if u.Locale != nil && *u.Locale != "" {
+		if _, err := language.Parse(*u.Locale); err != nil || len(*u.Locale) > 35 {
+			return errors.New("locale must be a BCP 47 language tag")
+		}
+	}
+	if u.Timezone != nil && *u.Timezone != "" {
+		if _, err := time.LoadLocation(*u.Timezone); err != nil {
+			return errors.New("timezone must be an IANA time zone name")
+		}
+	}
+	if u.DateOfBirth != nil && *u.DateOfBirth != "" {
+		if err := validateDateOfBirth(*u.DateOfBirth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func validateFullName(name string) error {
 	name = strings.TrimSpace(name)
 	if len(name) < 4 {
@@ -71,3 +146,26 @@ func validatePhone(phone string) error {
 	}
 	return nil
 }
+
+func validateAvatarURL(raw string) error {
+	if len(raw) > 500 {
+		return errors.New("avatar url max 500 characters")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("avatar url must be an http or https url")
+	}
+	return nil
+}
+
+func validateDateOfBirth(raw string) error {
+	dob, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return errors.New("date of birth must use the YYYY-MM-DD format")
+	}
+	now := time.Now()
+	if dob.After(now) || dob.Before(now.AddDate(-150, 0, 0)) {
+		return errors.New("date of birth is out of range")
+	}
+	return nil
+}
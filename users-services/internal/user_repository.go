@@ -10,124 +10,450 @@ import (
 	"time"
 
 	"github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 )
 
-type UserRepository struct {
-	db *sql.DB
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrEmailTaken         = errors.New("email already registered")
+	ErrPhoneNumberTaken   = errors.New("phone number already registered")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrIncorrectPassword  = errors.New("current password is incorrect")
+	ErrPasswordNotSet     = errors.New("account has no password; set a password first")
+	ErrPasswordUnchanged  = errors.New("new password must be different from the current password")
+	ErrEmailNotVerified   = errors.New("email not verified")
+	ErrInvalidVerifyToken = errors.New("invalid or expired email verification token")
+)
+
+// userColumns is the column list scanned by scanUser.
+const userColumns = `
+		id,
+		coalesce(full_name, ''),
+		coalesce(username, ''),
+		coalesce(email, ''),
+		coalesce(phone_number, ''),
+		coalesce(is_active, false),
+		coalesce(bio, ''),
+		coalesce(avatar_url, ''),
+		coalesce(locale, ''),
+		coalesce(timezone, ''),
+		date_of_birth,
+		created_at,
+		updated_at,
+		coalesce(is_deleted, false),
+		deleted_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{
-		db: db,
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var dateOfBirth, deletedAt sql.NullTime
+	err := row.Scan(
+		&user.ID,
+		&user.FullName,
+		&user.Username,
+		&user.Email,
+		&user.PhoneNumber,
+		&user.IsActive,
+		&user.Bio,
+		&user.AvatarURL,
+		&user.Locale,
+		&user.Timezone,
+		&dateOfBirth,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsDeleted,
+		&deletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if dateOfBirth.Valid {
+		user.DateOfBirth = &dateOfBirth.Time
 	}
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+	return &user, nil
 }
 
-func hashingPassword(password string) string {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Fatal(err)
+// uniqueConstraint returns the unique constraint err violated. SQLite
+// reports the columns instead, or the index for expression indexes.
+func uniqueConstraint(err error) (string, bool) {
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return pgErr.Constraint, true
+	}
+	return sqliteUniqueConstraint(err)
+}
+
+// uniqueViolation translates unique constraint errors on users into the
+// matching sentinel error, or returns nil.
+func uniqueViolation(err error) error {
+	constraint, ok := uniqueConstraint(err)
+	if !ok {
+		return nil
 	}
-	return string(hashedPassword)
+	switch constraint {
+	case "users_email_key", "idx_users_email", "users.email":
+		return ErrEmailTaken
+	case "idx_users_phone_number", "users.phone_number":
+		return ErrPhoneNumberTaken
+	case "idx_users_username_lower":
+		return ErrUsernameTaken
+	}
+	return nil
 }
 
-func verifyPassword(hashedPassword, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
 
-func (r *UserRepository) registerUser(c context.Context, user UserRegister) (*User, error) {
-	query := make(map[string]string)
-	var username, hashing string
-	var userId int32
+// placeholders returns "$from, ..., $(from+n-1)" for IN lists, which unlike
+// ANY($1) work on both Postgres and SQLite.
+func placeholders(from, n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", from+i)
+	}
+	return strings.Join(list, ", ")
+}
+
+// UserRepository is the SQL implementation of Repository. It runs on
+// Postgres, or on SQLite when created with NewSQLiteRepository.
+type UserRepository struct {
+	db      *sql.DB
+	hasher  PasswordHasher
+	revoked *revocationCache
+	// sqlite is set for databases opened with OpenSQLite.
+	sqlite bool
+}
+
+func NewUserRepository(db *sql.DB, hasher PasswordHasher) *UserRepository {
+	return &UserRepository{
+		db:      db,
+		hasher:  hasher,
+		revoked: newRevocationCache(),
+	}
+}
 
+// RegisterUser inserts an inactive user. Without a chosen username one is
+// derived from the email, suffixed with a number when the name is taken.
+func (r *UserRepository) RegisterUser(c context.Context, user UserRegister) (*User, error) {
+	var hashing string
 	if user.Password != nil {
-		hashing = hashingPassword(*user.Password)
+		var err error
+		if hashing, err = r.hasher.Hash(*user.Password); err != nil {
+			return nil, err
+		}
 	}
 
-	query["query_insert"] = `
+	for attempt := 1; ; attempt++ {
+		candidate := user.Username
+		if candidate != "" {
+			available, err := r.UsernameAvailable(c, candidate, 0)
+			if err != nil {
+				return nil, err
+			}
+			if !available {
+				return nil, ErrUsernameTaken
+			}
+		} else {
+			var err error
+			if candidate, err = r.pickUsername(c, usernameFromEmail(user.Email)); err != nil {
+				return nil, err
+			}
+		}
+
+		created, err := r.insertUser(c, user, candidate, hashing)
+		if err == nil {
+			return created, nil
+		}
+		if errors.Is(err, ErrUsernameTaken) && user.Username == "" && attempt < usernameAttempts {
+			// Someone registered the derived name in the meantime.
+			continue
+		}
+		return nil, err
+	}
+}
+
+// insertUser stores the user together with its UserRegistered event.
+func (r *UserRepository) insertUser(c context.Context, user UserRegister, username, hashedPassword string) (*User, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
 		insert into users (
 		    full_name,
 			username,
 		    email,
 		    password,
 		    phone_number,
-		    is_active
+		    is_active,
+		    password_changed_at
 		) values (
-			$1, $2, $3, $4, $5, $6
-		) RETURNING id,username
+			$1, $2, $3, $4, $5, $6, $7
+		) RETURNING ` + userColumns + `
     `
-
-	err := r.db.QueryRowContext(c, query["query_insert"], user.FullName, strings.Split(user.Email, "@")[0], user.Email, hashing, user.PhoneNumber, true).Scan(&userId, &username)
-
+	changedAt := sql.NullTime{Time: time.Now(), Valid: hashedPassword != ""}
+	created, err := scanUser(tx.QueryRowContext(c, query, user.FullName, username, user.Email, hashedPassword, user.PhoneNumber, false, changedAt))
 	if err != nil {
-		var pgErr *pq.Error
-		ok := errors.As(err, &pgErr)
-		if ok && pgErr.Code == "23505" {
-			switch pgErr.Constraint {
-			case "users_email_key", "idx_users_email":
-				return nil, fmt.Errorf("email already registered")
-			case "idx_users_phone_number":
-				return nil, fmt.Errorf("phone number already registered")
-			}
+		if uerr := uniqueViolation(err); uerr != nil {
+			return nil, uerr
 		}
 		return nil, fmt.Errorf("could not insert user: %v", err)
 	}
-	return &User{
-		ID:          userId,
-		FullName:    user.FullName,
-		Username:    username,
-		Email:       user.Email,
-		Password:    nil,
-		PhoneNumber: user.PhoneNumber,
-		IsActive:    true,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-	}, nil
-}
-func (r *UserRepository) loginUser(c context.Context, email string, password string) (string, error) {
+
+	if err := enqueueUserEvent(c, tx, EventUserRegistered, created); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return created, nil
+}
+
+// Authenticate checks the credentials and returns the id of the user.
+// Passwords older than the policy allows are rejected with
+// ErrPasswordExpired once the password itself was verified. Hashes made
+// with an older algorithm or weaker parameters are upgraded on the way.
+func (r *UserRepository) Authenticate(c context.Context, email string, password string, policy PasswordPolicy) (int32, error) {
 	query := `
-        SELECT id, password FROM users WHERE email = $1 AND is_deleted = false AND is_active = true;
+        SELECT id, coalesce(password, ''), coalesce(is_active, false), password_changed_at
+        FROM users WHERE email = $1 AND is_deleted = false;
     `
 
 	var userId int32
 	var hashedPassword string
+	var isActive bool
+	var changedAt sql.NullTime
 
-	err := r.db.QueryRowContext(c, query, email).Scan(&userId, &hashedPassword)
+	err := r.db.QueryRowContext(c, query, email).Scan(&userId, &hashedPassword, &isActive, &changedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", fmt.Errorf("invalid email or password")
+			verifyWithoutPassword(r.hasher, password)
+			return 0, ErrInvalidCredentials
 		}
-		return "", fmt.Errorf("could not query user: %v", err)
+		return 0, fmt.Errorf("could not query user: %v", err)
 	}
 
-	if err := verifyPassword(hashedPassword, password); err != nil {
-		return "", fmt.Errorf("invalid email or password")
+	// The id is returned alongside ErrInvalidCredentials so the failed
+	// attempt can be recorded against the account.
+	if hashedPassword == "" {
+		verifyWithoutPassword(r.hasher, password)
+		return userId, ErrInvalidCredentials
 	}
+	if err := r.hasher.Verify(hashedPassword, password); err != nil {
+		if !errors.Is(err, ErrPasswordMismatch) {
+			log.Printf("could not verify password of user %d: %v", userId, err)
+		}
+		return userId, ErrInvalidCredentials
+	}
+	if r.hasher.NeedsRehash(hashedPassword) {
+		r.rehashPassword(c, userId, hashedPassword, password)
+	}
+	// Checked only after the password so the error does not tell strangers
+	// which emails are registered.
+	if !isActive {
+		return 0, ErrEmailNotVerified
+	}
+	if policy.expired(changedAt.Time) {
+		return userId, ErrPasswordExpired
+	}
+
+	return userId, nil
+}
 
-	token, err := GenerateToken(fmt.Sprintf("%d", userId))
+// rehashPassword replaces oldHash with a hash from the current hasher. The
+// password is unchanged, so neither password_changed_at nor the history is
+// touched, and a password changed in the meantime is left alone. Failing to
+// upgrade must not fail the login, so errors are only logged.
+func (r *UserRepository) rehashPassword(c context.Context, userId int32, oldHash, password string) {
+	newHash, err := r.hasher.Hash(password)
 	if err != nil {
-		return "", fmt.Errorf("could not generate token: %v", err)
+		log.Printf("could not rehash password of user %d: %v", userId, err)
+		return
+	}
+	if _, err := r.db.ExecContext(c, `
+		UPDATE users SET password = $3 WHERE id = $1 AND password = $2;
+	`, userId, oldHash, newHash); err != nil {
+		log.Printf("could not rehash password of user %d: %v", userId, err)
 	}
-
-	return token, nil
 }
 
-func (r *UserRepository) findMe(c context.Context, userID int32) (*User, error) {
-	var user User
-	query := `
-		SELECT 
-		    	full_name,
-		    	email,
-		    	phone_number,
-		    	is_active,
-		    	created_at 
+func (r *UserRepository) FindUser(c context.Context, userID int32) (*User, error) {
+	query := `SELECT ` + userColumns + `
 		FROM users WHERE id = $1
 		AND is_deleted = false;
     `
-	err := r.db.QueryRowContext(c, query, userID).Scan(&user.FullName, &user.Email, &user.PhoneNumber, &user.IsActive, &user.CreatedAt)
+	user, err := scanUser(r.db.QueryRowContext(c, query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("could not query user: %v", err)
+	}
+	return user, nil
+}
+
+// UpdateProfile writes only the fields set in update and bumps updated_at.
+func (r *UserRepository) UpdateProfile(c context.Context, userID int32, update ProfileUpdate) (*User, error) {
+	var sets []string
+	var args []any
+	set := func(column string, value any) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if update.FullName != nil {
+		set("full_name", strings.TrimSpace(*update.FullName))
+	}
+	if update.PhoneNumber != nil {
+		set("phone_number", *update.PhoneNumber)
+	}
+	if update.Bio != nil {
+		set("bio", nullIfEmpty(*update.Bio))
+	}
+	if update.AvatarURL != nil {
+		set("avatar_url", nullIfEmpty(*update.AvatarURL))
+	}
+	if update.Locale != nil {
+		set("locale", nullIfEmpty(*update.Locale))
+	}
+	if update.Timezone != nil {
+		set("timezone", nullIfEmpty(*update.Timezone))
+	}
+	if update.DateOfBirth != nil {
+		set("date_of_birth", nullIfEmpty(*update.DateOfBirth))
+	}
+	set("updated_at", time.Now())
+	args = append(args, userID)
+
+	query := fmt.Sprintf(`
+		UPDATE users SET %s
+		WHERE id = $%d AND is_deleted = false
+		RETURNING %s;
+    `, strings.Join(sets, ", "), len(args), userColumns)
+
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRowContext(c, query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		if uerr := uniqueViolation(err); uerr != nil {
+			return nil, uerr
+		}
+		return nil, fmt.Errorf("could not update user: %v", err)
+	}
+
+	if err := enqueueUserEvent(c, tx, EventUserUpdated, user); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return user, nil
+}
+
+// ChangePassword replaces the password after checking the current one.
+// Passwords among the last historySize cannot be chosen again.
+func (r *UserRepository) ChangePassword(c context.Context, userID int32, currentPassword, newPassword string, historySize int) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var hashedPassword string
+	err = tx.QueryRowContext(c, `
+		SELECT coalesce(password, '') FROM users WHERE id = $1 AND is_deleted = false FOR UPDATE;
+	`, userID).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("could not query user: %v", err)
+	}
+
+	if hashedPassword == "" {
+		return ErrPasswordNotSet
+	}
+	if err := r.hasher.Verify(hashedPassword, currentPassword); err != nil {
+		return ErrIncorrectPassword
+	}
+	if r.hasher.Verify(hashedPassword, newPassword) == nil {
+		return ErrPasswordUnchanged
+	}
+	if err := r.checkPasswordHistory(c, tx, userID, hashedPassword, newPassword, historySize); err != nil {
+		return err
+	}
+	if err := r.setPassword(c, tx, userID, hashedPassword, newPassword, historySize); err != nil {
+		return err
+	}
+
+	if err := revokeUserTokens(c, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// VerifyEmail activates the account if it still has the email the
+// verification token was issued for.
+func (r *UserRepository) VerifyEmail(c context.Context, userID int32, email string) error {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET is_active = true, updated_at = $3
+		WHERE id = $1 AND email = $2 AND is_deleted = false
+		RETURNING ` + userColumns + `;
+    `
+	user, err := scanUser(tx.QueryRowContext(c, query, userID, email, time.Now()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidVerifyToken
+		}
+		return fmt.Errorf("could not verify email: %v", err)
+	}
 
+	if err := enqueueUserEvent(c, tx, EventUserUpdated, user); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) FindUnverifiedUser(c context.Context, email string) (*User, error) {
+	query := `SELECT ` + userColumns + `
+		FROM users WHERE email = $1
+		AND is_deleted = false
+		AND coalesce(is_active, false) = false;
+    `
+	user, err := scanUser(r.db.QueryRowContext(c, query, email))
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
 		return nil, fmt.Errorf("could not query user: %v", err)
 	}
-	return &user, nil
+	return user, nil
 }
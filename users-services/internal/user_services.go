@@ -1,23 +1,574 @@
 package internal
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type UserService struct {
-	Repo *UserRepository
+	Repo Repository
+	// Keys sign access tokens and the short lived email verification and
+	// MFA challenge tokens.
+	Keys       *KeySet
+	Mailer     Mailer
+	AppBaseURL string
+	// RestoreGracePeriod is how long a deleted account can still be
+	// restored.
+	RestoreGracePeriod time.Duration
+	LoginThrottle      LoginThrottle
+	PasswordPolicy     PasswordPolicy
 }
 
-func NewUserService(repo *UserRepository) *UserService {
-	return &UserService{Repo: repo}
+func NewUserService(repo Repository, keys *KeySet, mailer Mailer, appBaseURL string, restoreGracePeriod time.Duration, loginThrottle LoginThrottle, passwordPolicy PasswordPolicy) *UserService {
+	return &UserService{
+		Repo:               repo,
+		Keys:               keys,
+		Mailer:             mailer,
+		AppBaseURL:         appBaseURL,
+		RestoreGracePeriod: restoreGracePeriod,
+		LoginThrottle:      loginThrottle,
+		PasswordPolicy:     passwordPolicy,
+	}
 }
 
+// RegisterUser creates an inactive account and emails a verification link;
+// the account can log in once the link was opened.
 func (service *UserService) RegisterUser(c context.Context, user UserRegister) (*User, error) {
-	return service.Repo.registerUser(c, user)
+	var password string
+	if user.Password != nil {
+		password = *user.Password
+	}
+	if err := service.PasswordPolicy.Check("password", password, personalValues(user.Email, user.Username)...); err != nil {
+		return nil, err
+	}
+
+	registered, err := service.Repo.RegisterUser(c, user)
+	if err != nil {
+		return nil, err
+	}
+	service.audit(c, AuditEvent{
+		Type:     AuditUserRegistered,
+		ActorID:  registered.ID,
+		TargetID: registered.ID,
+	})
+	if err := service.sendVerificationEmail(registered); err != nil {
+		log.Printf("could not send verification email: %v", err)
+	}
+	return registered, nil
+}
+
+func (service *UserService) VerifyEmail(c context.Context, token string) error {
+	claims, err := service.Keys.VerifyEmailVerificationToken(token)
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return ErrInvalidVerifyToken
+	}
+	err = service.Repo.VerifyEmail(c, int32(userId), claims.Email)
+	service.auditResult(c, AuditEvent{Type: AuditEmailVerified, ActorID: int32(userId), TargetID: int32(userId)}, err)
+	return err
+}
+
+// ResendVerification sends a new verification link to an unverified
+// account. Like RequestPasswordReset it never reveals whether the email
+// exists.
+func (service *UserService) ResendVerification(c context.Context, email string) error {
+	user, err := service.Repo.FindUnverifiedUser(c, email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return service.sendVerificationEmail(user)
+}
+
+func (service *UserService) sendVerificationEmail(user *User) error {
+	token, err := service.Keys.GenerateEmailVerificationToken(user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", strings.TrimRight(service.AppBaseURL, "/"), url.QueryEscape(token))
+	service.sendMail(Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening the link below within %s:\n\n%s\n\nIf you did not create an account, you can ignore this email.\n",
+			user.FullName, emailVerificationTTL, link,
+		),
+	})
+	return nil
+}
+
+// sendMail delivers msg in the background so callers neither wait for the
+// mail server nor leak through their timing whether a mail was sent.
+func (service *UserService) sendMail(msg Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := service.Mailer.Send(ctx, msg); err != nil {
+			log.Printf("could not send %q email: %v", msg.Subject, err)
+		}
+	}()
+}
+
+// LoginUser checks the credentials unless the account or the client address
+// is currently throttled. The client IP may be empty when it is unknown.
+// Users with two-factor authentication get an MFA challenge instead of
+// tokens.
+func (service *UserService) LoginUser(c context.Context, email string, password string, client ClientInfo) (*LoginResult, error) {
+	clientIP := client.IP
+	accountKey := accountThrottleKey(email)
+	throttle := service.LoginThrottle
+	// Attempts are counted as failures before the password is checked, so
+	// parallel guesses cannot all get in before the first one is recorded.
+	if err := service.Repo.ReserveLoginAttempt(c, throttle, accountKey, throttle.MaxAccountFailures); err != nil {
+		service.auditThrottledLogin(c, err)
+		return nil, err
+	}
+	if clientIP != "" {
+		if err := service.Repo.ReserveLoginAttempt(c, throttle, ipThrottleKey(clientIP), throttle.MaxIPFailures); err != nil {
+			service.releaseLoginAttempt(c, accountKey, throttle.MaxAccountFailures)
+			service.auditThrottledLogin(c, err)
+			return nil, err
+		}
+	}
+
+	userId, err := service.Repo.Authenticate(c, email, password, service.PasswordPolicy)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditLogin,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"method": "password"},
+	}, err, ErrInvalidCredentials, ErrEmailNotVerified, ErrPasswordExpired)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return nil, err
+	}
+	// Anything else did not guess wrong, so the address gets its attempt
+	// back. Its counter is not reset, or an attacker could clear it by
+	// logging into an account of their own. The password was right even if
+	// the email still needs verifying.
+	if clientIP != "" {
+		service.releaseLoginAttempt(c, ipThrottleKey(clientIP), throttle.MaxIPFailures)
+	}
+	if err == nil || errors.Is(err, ErrEmailNotVerified) {
+		if cerr := service.Repo.ClearLoginFailures(c, accountKey); cerr != nil {
+			log.Println(cerr)
+		}
+	} else {
+		service.releaseLoginAttempt(c, accountKey, throttle.MaxAccountFailures)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return service.completeLogin(c, userId, client)
+}
+
+func (service *UserService) auditThrottledLogin(c context.Context, err error) {
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		return
+	}
+	service.audit(c, AuditEvent{
+		Type:    AuditLogin,
+		Outcome: AuditFailure,
+		Details: map[string]string{"reason": "throttled"},
+	})
+}
+
+func (service *UserService) releaseLoginAttempt(c context.Context, key string, limit int) {
+	if err := service.Repo.ReleaseLoginAttempt(c, key, limit); err != nil {
+		log.Println(err)
+	}
+}
+
+// completeLogin starts a session for an authenticated user, or returns an
+// MFA challenge when a second factor is still required.
+func (service *UserService) completeLogin(c context.Context, userId int32, client ClientInfo) (*LoginResult, error) {
+	enabled, err := service.Repo.MFAEnabled(c, userId)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		token, err := service.Keys.GenerateMFAChallengeToken(userId)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate mfa token: %v", err)
+		}
+		return &LoginResult{MFAToken: token}, nil
+	}
+
+	tokens, err := service.startSession(c, userId, client)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Tokens: tokens}, nil
+}
+
+// startSession logs the user in on the client and returns its first token
+// pair.
+func (service *UserService) startSession(c context.Context, userId int32, client ClientInfo) (*TokenPair, error) {
+	session, err := service.Repo.CreateSession(c, userId, client)
+	if err != nil {
+		return nil, err
+	}
+	return service.signTokens(session)
+}
+
+// signTokens signs an access token for a session the repository just
+// started or refreshed and pairs it with the session's refresh token.
+func (service *UserService) signTokens(session *IssuedSession) (*TokenPair, error) {
+	accessToken, err := service.Keys.GenerateToken(strconv.Itoa(int(session.UserID)), session.SessionID, session.Access)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate token: %v", err)
+	}
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     session.RefreshToken,
+		RefreshExpiresAt: session.RefreshExpiresAt,
+	}, nil
+}
+
+// VerifyMFA finishes a login started by LoginUser with either a TOTP code
+// or a recovery code. Wrong codes count towards the same lockout as wrong
+// passwords.
+func (service *UserService) VerifyMFA(c context.Context, mfaToken, code, recoveryCode string, client ClientInfo) (*TokenPair, error) {
+	claims, err := service.Keys.VerifyMFAChallengeToken(mfaToken)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+
+	key := mfaThrottleKey(claims.Subject)
+	limit := service.LoginThrottle.MaxAccountFailures
+	if err := service.Repo.ReserveLoginAttempt(c, service.LoginThrottle, key, limit); err != nil {
+		return nil, err
+	}
+	err = service.Repo.VerifyMFACode(c, int32(userId), code, recoveryCode)
+	method := "totp"
+	if recoveryCode != "" {
+		method = "recovery_code"
+	}
+	service.auditResult(c, AuditEvent{
+		Type:     AuditLoginMFA,
+		ActorID:  int32(userId),
+		TargetID: int32(userId),
+		Details:  map[string]string{"method": method},
+	}, err, ErrInvalidMFACode)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) {
+			service.releaseLoginAttempt(c, key, limit)
+		}
+		return nil, err
+	}
+	if err := service.Repo.ClearLoginFailures(c, key); err != nil {
+		log.Println(err)
+	}
+
+	return service.startSession(c, int32(userId), client)
+}
+
+// LoginWithExternalIdentity logs in the user behind an identity the gateway
+// got from an OAuth2/OIDC provider. Unknown identities are linked to the
+// account with the same verified email, or get a new account.
+func (service *UserService) LoginWithExternalIdentity(c context.Context, ext ExternalIdentity, client ClientInfo) (*LoginResult, error) {
+	userId, err := service.Repo.FindOrCreateExternalUser(c, ext)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditLogin,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"method": ext.Provider},
+	}, err, ErrExternalEmailRequired, ErrEmailTaken, ErrIdentityTaken)
+	if err != nil {
+		return nil, err
+	}
+	return service.completeLogin(c, userId, client)
+}
+
+func (service *UserService) LinkIdentity(c context.Context, userId int32, ext ExternalIdentity) error {
+	err := service.Repo.LinkIdentity(c, userId, ext)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditIdentityLinked,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"provider": ext.Provider},
+	}, err, ErrIdentityTaken)
+	return err
+}
+
+// UnlinkIdentity removes a linked provider, as long as the user keeps a
+// password or another provider to log in with.
+func (service *UserService) UnlinkIdentity(c context.Context, userId int32, provider string) error {
+	err := service.Repo.UnlinkIdentity(c, userId, provider)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditIdentityUnlinked,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"provider": provider},
+	}, err)
+	return err
+}
+
+func (service *UserService) ListIdentities(c context.Context, userId int32) ([]Identity, error) {
+	return service.Repo.ListIdentities(c, userId)
+}
+
+// EnrollTOTP starts setting up two-factor authentication and returns the
+// secret with an otpauth:// URI for authenticator apps.
+func (service *UserService) EnrollTOTP(c context.Context, userId int32) (string, string, error) {
+	secret, email, err := service.Repo.EnrollTOTP(c, userId)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totpURI(secret, email), nil
+}
+
+// ConfirmTOTP enables two-factor authentication and returns the recovery
+// codes.
+func (service *UserService) ConfirmTOTP(c context.Context, userId int32, code string) ([]string, error) {
+	recoveryCodes, err := service.Repo.ConfirmTOTP(c, userId, code)
+	service.auditResult(c, AuditEvent{Type: AuditMFAEnabled, ActorID: userId, TargetID: userId}, err, ErrInvalidMFACode)
+	return recoveryCodes, err
+}
+
+func (service *UserService) DisableTOTP(c context.Context, userId int32, password string) error {
+	err := service.Repo.DisableTOTP(c, userId, password)
+	service.auditResult(c, AuditEvent{Type: AuditMFADisabled, ActorID: userId, TargetID: userId}, err, ErrIncorrectPassword)
+	return err
+}
+
+// UnlockUser lifts a lockout caused by failed logins on the account.
+func (service *UserService) UnlockUser(c context.Context, userId int32) error {
+	err := service.Repo.UnlockUser(c, userId)
+	service.auditResult(c, AuditEvent{Type: AuditAccountUnlocked, TargetID: userId}, err)
+	return err
 }
 
-func (service *UserService) LoginUser(c context.Context, email string, password string) (string, error) {
-	return service.Repo.loginUser(c, email, password)
+func (service *UserService) UpdateProfile(ctx context.Context, userId int32, update ProfileUpdate) (*User, error) {
+	user, err := service.Repo.UpdateProfile(ctx, userId, update)
+	service.auditResult(ctx, AuditEvent{Type: AuditProfileUpdated, ActorID: userId, TargetID: userId}, err)
+	return user, err
+}
+
+// ChangePassword replaces the password after checking the current one and
+// logs out every other session. The caller gets a fresh token pair.
+func (service *UserService) ChangePassword(ctx context.Context, userId int32, currentPassword, newPassword string, client ClientInfo) (*TokenPair, error) {
+	user, err := service.Repo.FindUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.PasswordPolicy.Check("new_password", newPassword, personalValues(user.Email, user.Username)...); err != nil {
+		return nil, err
+	}
+
+	err = service.Repo.ChangePassword(ctx, userId, currentPassword, newPassword, service.PasswordPolicy.HistorySize)
+	service.auditResult(ctx, AuditEvent{Type: AuditPasswordChanged, ActorID: userId, TargetID: userId}, err, ErrIncorrectPassword, ErrPasswordUnchanged, ErrPasswordReused)
+	if err != nil {
+		return nil, err
+	}
+	return service.startSession(ctx, userId, client)
+}
+
+// DeleteAccount soft deletes the account once the password is confirmed.
+// It can be restored by an admin within the grace period.
+func (service *UserService) DeleteAccount(c context.Context, userId int32, password string) error {
+	err := service.Repo.DeleteAccount(c, userId, password)
+	service.auditResult(c, AuditEvent{Type: AuditAccountDeleted, ActorID: userId, TargetID: userId}, err, ErrIncorrectPassword)
+	return err
+}
+
+func (service *UserService) RestoreUser(c context.Context, userId int32) (*User, error) {
+	user, err := service.Repo.RestoreUser(c, userId, service.RestoreGracePeriod)
+	service.auditResult(c, AuditEvent{Type: AuditAccountRestored, TargetID: userId}, err, ErrRestoreWindowExpired)
+	return user, err
+}
+
+func (service *UserService) ListUsers(c context.Context, filter UserFilter) (*UserPage, error) {
+	return service.Repo.ListUsers(c, filter)
+}
+
+// CheckUsernameAvailability reports whether username can be registered or
+// changed to. When it cannot, reason is INVALID, RESERVED or TAKEN and
+// message explains why.
+func (service *UserService) CheckUsernameAvailability(c context.Context, username string) (available bool, reason, message string, err error) {
+	if err := validateUsername(username); err != nil {
+		if errors.Is(err, ErrUsernameReserved) {
+			return false, "RESERVED", err.Error(), nil
+		}
+		return false, "INVALID", err.Error(), nil
+	}
+	available, err = service.Repo.UsernameAvailable(c, username, 0)
+	if err != nil {
+		return false, "", "", err
+	}
+	if !available {
+		return false, "TAKEN", ErrUsernameTaken.Error(), nil
+	}
+	return true, "", "", nil
+}
+
+func (service *UserService) ChangeUsername(c context.Context, userId int32, username string) (*User, error) {
+	user, err := service.Repo.ChangeUsername(c, userId, username)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditUsernameChanged,
+		ActorID:  userId,
+		TargetID: userId,
+	}, err, ErrUsernameTaken)
+	return user, err
+}
+
+// ResolveUsername maps a current or former username to the account and its
+// current username, so links to old handles can redirect.
+func (service *UserService) ResolveUsername(c context.Context, username string) (int32, string, error) {
+	return service.Repo.ResolveUsername(c, username)
+}
+
+func (service *UserService) AssignRole(c context.Context, userId int32, role string) error {
+	err := service.Repo.AssignRole(c, userId, role)
+	service.auditResult(c, AuditEvent{Type: AuditRoleAssigned, TargetID: userId, Details: map[string]string{"role": role}}, err)
+	return err
+}
+
+// RevokeRole also signs the user out everywhere, so the role is gone from
+// their tokens right away.
+func (service *UserService) RevokeRole(c context.Context, userId int32, role string) error {
+	err := service.Repo.RevokeRole(c, userId, role)
+	service.auditResult(c, AuditEvent{Type: AuditRoleRevoked, TargetID: userId, Details: map[string]string{"role": role}}, err)
+	return err
+}
+
+// ListRoles returns every role, or the roles of userId when it is not zero.
+func (service *UserService) ListRoles(c context.Context, userId int32) ([]Role, error) {
+	return service.Repo.ListRoles(c, userId)
+}
+
+func (service *UserService) RefreshToken(c context.Context, refreshToken string, client ClientInfo) (*TokenPair, error) {
+	session, err := service.Repo.RotateRefreshToken(c, refreshToken, client)
+	if err != nil {
+		return nil, err
+	}
+	return service.signTokens(session)
+}
+
+func (service *UserService) ListSessions(c context.Context, userId int32) ([]Session, error) {
+	return service.Repo.ListSessions(c, userId)
+}
+
+// RevokeSession logs out one of the user's devices.
+func (service *UserService) RevokeSession(c context.Context, userId int32, sessionId string) error {
+	err := service.Repo.RevokeSession(c, userId, sessionId)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditSessionRevoked,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"session_id": sessionId},
+	}, err)
+	return err
+}
+
+// RevokeAllOtherSessions logs out every device except the current one and
+// returns how many sessions were ended.
+func (service *UserService) RevokeAllOtherSessions(c context.Context, userId int32, currentSessionId string) (int64, error) {
+	revoked, err := service.Repo.RevokeOtherSessions(c, userId, currentSessionId)
+	service.auditResult(c, AuditEvent{
+		Type:     AuditSessionRevoked,
+		ActorID:  userId,
+		TargetID: userId,
+		Details:  map[string]string{"except_session_id": currentSessionId, "count": strconv.FormatInt(revoked, 10)},
+	}, err)
+	return revoked, err
+}
+
+// ListAuditEvents returns security events, newest first.
+func (service *UserService) ListAuditEvents(c context.Context, filter AuditFilter) (*AuditPage, error) {
+	return service.Repo.ListAuditEvents(c, filter)
 }
 
 func (service *UserService) FindMe(ctx context.Context, userId int32) (*User, error) {
-	return service.Repo.findMe(ctx, userId)
+	return service.Repo.FindUser(ctx, userId)
+}
+
+// Logout revokes the presented access token and ends the session it was
+// issued for, along with the refresh token family presented with it, which
+// may belong to another session. Tokens that are already invalid and
+// sessions that already ended are ignored.
+func (service *UserService) Logout(c context.Context, accessToken string, refreshToken string) error {
+	if accessToken != "" {
+		if claims, err := service.Keys.VerifyToken(accessToken); err == nil {
+			userId, err := strconv.Atoi(claims.UserId)
+			if err == nil && claims.ID != "" {
+				if err := service.Repo.RevokeAccessToken(c, claims.ID, int32(userId), claims.Expiry.Time()); err != nil {
+					return err
+				}
+			}
+			if err == nil && claims.SessionId != "" {
+				err := service.Repo.RevokeSession(c, int32(userId), claims.SessionId)
+				if err != nil && !errors.Is(err, ErrSessionNotFound) {
+					return err
+				}
+			}
+		}
+	}
+	if refreshToken != "" {
+		return service.Repo.RevokeRefreshTokenFamily(c, refreshToken)
+	}
+	return nil
+}
+
+func (service *UserService) IsTokenRevoked(c context.Context, jti, sessionId string, userId int32, issuedAt, expiresAt time.Time) (bool, error) {
+	return service.Repo.IsTokenRevoked(c, jti, sessionId, userId, issuedAt, expiresAt)
+}
+
+func (service *UserService) JWKS() ([]byte, error) {
+	return service.Keys.JWKS()
+}
+
+// RequestPasswordReset emails a reset link when the address belongs to an
+// account. It reports success either way, so the response does not reveal
+// whether the email is registered.
+func (service *UserService) RequestPasswordReset(c context.Context, email string) error {
+	user, token, err := service.Repo.CreatePasswordReset(c, email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	service.audit(c, AuditEvent{Type: AuditResetRequested, TargetID: user.ID})
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", strings.TrimRight(service.AppBaseURL, "/"), url.QueryEscape(token))
+	service.sendMail(Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password of your account. Open the link below within %s to choose a new one:\n\n%s\n\nIf this wasn't you, you can ignore this email.\n",
+			user.FullName, passwordResetTTL, link,
+		),
+	})
+	return nil
+}
+
+func (service *UserService) ResetPassword(c context.Context, token string, newPassword string) error {
+	user, err := service.Repo.FindPasswordResetUser(c, token)
+	if err != nil {
+		return err
+	}
+	if err := service.PasswordPolicy.Check("new_password", newPassword, personalValues(user.Email, user.Username)...); err != nil {
+		return err
+	}
+
+	userId, err := service.Repo.ResetPassword(c, token, newPassword, service.PasswordPolicy.HistorySize)
+	service.auditResult(c, AuditEvent{Type: AuditPasswordReset, ActorID: userId, TargetID: userId}, err, ErrPasswordReused)
+	return err
 }
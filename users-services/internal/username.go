@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 30
+	// usernameAttempts bounds how often registration and sign-up through an
+	// external identity re-pick a derived username that was taken
+	// concurrently.
+	usernameAttempts = 3
+)
+
+var (
+	ErrUsernameTaken    = errors.New("username is already taken")
+	ErrUsernameReserved = errors.New("username is reserved")
+)
+
+// usernameRegex allows letters, digits and single dots, dashes or
+// underscores between them.
+var usernameRegex = regexp.MustCompile(`^[A-Za-z0-9]+(?:[._-][A-Za-z0-9]+)*$`)
+
+// reservedUsernames cannot be registered because they would collide with
+// routes or impersonate staff.
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "system": true,
+	"support": true, "help": true, "staff": true, "moderator": true,
+	"official": true, "security": true, "api": true, "www": true,
+	"mail": true, "me": true, "login": true, "logout": true,
+	"register": true, "settings": true, "null": true, "undefined": true,
+}
+
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength {
+		return fmt.Errorf("username minimal %d characters", minUsernameLength)
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("username max %d characters", maxUsernameLength)
+	}
+	if !usernameRegex.MatchString(username) {
+		return errors.New("username may only contain letters, digits and single dots, dashes or underscores between them")
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return ErrUsernameReserved
+	}
+	return nil
+}
+
+// usernameFromEmail turns the local part of an email into a valid username
+// base, leaving room for a numeric suffix.
+func usernameFromEmail(email string) string {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+
+	var b strings.Builder
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '.' || r == '_' || r == '-':
+			if s := b.String(); s != "" && !strings.ContainsRune("._-", rune(s[len(s)-1])) {
+				b.WriteRune(r)
+			}
+		}
+	}
+
+	base := strings.TrimRight(b.String(), "._-")
+	if len(base) > maxUsernameLength-6 {
+		base = strings.TrimRight(base[:maxUsernameLength-6], "._-")
+	}
+	if len(base) < minUsernameLength {
+		base = "user"
+	}
+	return base
+}
+
+// pickUsername returns base, or base followed by the smallest number that
+// makes it unused and not reserved.
+func (r *UserRepository) pickUsername(c context.Context, base string) (string, error) {
+	rows, err := r.db.QueryContext(c, `
+		SELECT lower(username) FROM users WHERE lower(username) LIKE $1 ESCAPE '\'
+		UNION
+		SELECT lower(username) FROM username_history WHERE lower(username) LIKE $1 ESCAPE '\';
+	`, escapeLike(base)+"%")
+	if err != nil {
+		return "", fmt.Errorf("could not query usernames: %v", err)
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", fmt.Errorf("could not scan username: %v", err)
+		}
+		taken[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("could not query usernames: %v", err)
+	}
+
+	return freeUsername(base, taken), nil
+}
+
+// freeUsername returns base, or base followed by the smallest number that
+// makes it neither taken nor reserved. taken holds lower case names.
+func freeUsername(base string, taken map[string]bool) string {
+	candidate := base
+	for n := 2; taken[candidate] || reservedUsernames[candidate]; n++ {
+		candidate = base + strconv.Itoa(n)
+	}
+	return candidate
+}
+
+// UsernameAvailable reports whether nobody but exceptUserID uses or used
+// username. Former usernames stay reserved for their previous owner so
+// links to them keep redirecting to the right account.
+func (r *UserRepository) UsernameAvailable(c context.Context, username string, exceptUserID int32) (bool, error) {
+	var taken bool
+	err := r.db.QueryRowContext(c, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1) AND id <> $2)
+		    OR EXISTS (SELECT 1 FROM username_history WHERE lower(username) = lower($1) AND user_id <> $2);
+	`, username, exceptUserID).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("could not check username: %v", err)
+	}
+	return !taken, nil
+}
+
+// ChangeUsername renames the user and records the old name in the history.
+// Taking back one of your own former usernames removes it from the history.
+func (r *UserRepository) ChangeUsername(c context.Context, userID int32, username string) (*User, error) {
+	tx, err := r.db.BeginTx(c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	err = tx.QueryRowContext(c, `
+		SELECT username FROM users WHERE id = $1 AND is_deleted = false FOR UPDATE;
+	`, userID).Scan(&current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("could not query user: %v", err)
+	}
+
+	// Serialise renames involving the same name, since the check against the
+	// history table below is not covered by a unique index. The current name
+	// is locked too: once renamed away it becomes history, and a concurrent
+	// claim must not slip in between. Locks are taken in order so two renames
+	// cannot deadlock. SQLite runs one write transaction at a time anyway.
+	if !r.sqlite {
+		names := []string{strings.ToLower(username)}
+		if current.Valid && !strings.EqualFold(current.String, username) {
+			names = append(names, strings.ToLower(current.String))
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if _, err := tx.ExecContext(c, `SELECT pg_advisory_xact_lock(hashtext('username:' || $1));`, name); err != nil {
+				return nil, fmt.Errorf("could not lock username: %v", err)
+			}
+		}
+	}
+
+	var claimed bool
+	err = tx.QueryRowContext(c, `
+		SELECT EXISTS (SELECT 1 FROM username_history WHERE lower(username) = lower($1) AND user_id <> $2);
+	`, username, userID).Scan(&claimed)
+	if err != nil {
+		return nil, fmt.Errorf("could not check username: %v", err)
+	}
+	if claimed {
+		return nil, ErrUsernameTaken
+	}
+
+	if _, err := tx.ExecContext(c, `
+		DELETE FROM username_history WHERE user_id = $1 AND lower(username) = lower($2);
+	`, userID, username); err != nil {
+		return nil, fmt.Errorf("could not update username history: %v", err)
+	}
+	// A change of case only keeps the same handle.
+	if current.Valid && !strings.EqualFold(current.String, username) {
+		if _, err := tx.ExecContext(c, `
+			INSERT INTO username_history (user_id, username, changed_at) VALUES ($1, $2, $3);
+		`, userID, current.String, time.Now()); err != nil {
+			return nil, fmt.Errorf("could not update username history: %v", err)
+		}
+	}
+
+	query := `UPDATE users SET username = $2, updated_at = $3
+		WHERE id = $1
+		RETURNING ` + userColumns + `;
+    `
+	user, err := scanUser(tx.QueryRowContext(c, query, userID, username, time.Now()))
+	if err != nil {
+		if uerr := uniqueViolation(err); uerr != nil {
+			return nil, uerr
+		}
+		return nil, fmt.Errorf("could not update username: %v", err)
+	}
+
+	if err := enqueueUserEvent(c, tx, EventUserUpdated, user); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return user, nil
+}
+
+// ResolveUsername finds the active account currently or formerly known as
+// username and returns its current username.
+func (r *UserRepository) ResolveUsername(c context.Context, username string) (int32, string, error) {
+	var userID int32
+	var current string
+	err := r.db.QueryRowContext(c, `
+		SELECT u.id, u.username FROM users u
+		WHERE lower(u.username) = lower($1) AND u.is_deleted = false
+		UNION ALL
+		SELECT u.id, u.username FROM username_history h
+		JOIN users u ON u.id = h.user_id
+		WHERE lower(h.username) = lower($1) AND u.is_deleted = false
+		LIMIT 1;
+	`, username).Scan(&userID, &current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", ErrUserNotFound
+		}
+		return 0, "", fmt.Errorf("could not resolve username: %v", err)
+	}
+	return userID, current, nil
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// newUsernameUsers registers alice and bob under those usernames and
+// returns their ids by name.
+func newUsernameUsers(t *testing.T, repo Repository) map[string]int32 {
+	t.Helper()
+	password := "correct horse battery staple"
+	ids := make(map[string]int32)
+	for i, name := range []string{"alice", "bob"} {
+		user, err := repo.RegisterUser(context.Background(), UserRegister{
+			FullName:    name,
+			Username:    name,
+			Email:       name + "@example.com",
+			Password:    &password,
+			PhoneNumber: fmt.Sprintf("+62812000000%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = user.ID
+	}
+	return ids
+}
+
+func TestChangeUsername(t *testing.T) {
+	// rename is one ChangeUsername call by user.
+	type rename struct {
+		user    string
+		to      string
+		wantErr error
+	}
+	// resolved is who ResolveUsername finds under a name, and their current
+	// username; an empty owner means nobody.
+	type resolved struct {
+		owner   string
+		current string
+	}
+
+	tests := []struct {
+		name    string
+		renames []rename
+		want    map[string]resolved
+		// available lists for each name whether bob may take it; his own
+		// former names stay open to him.
+		available map[string]bool
+	}{
+		{
+			name:    "rename keeps the old name as history",
+			renames: []rename{{user: "alice", to: "alicia"}},
+			want: map[string]resolved{
+				"alicia": {"alice", "alicia"},
+				"alice":  {"alice", "alicia"},
+				"ALICE":  {"alice", "alicia"},
+			},
+			available: map[string]bool{"alice": false, "alicia": false, "carol": true},
+		},
+		{
+			name: "former name stays reserved",
+			renames: []rename{
+				{user: "alice", to: "alicia"},
+				{user: "bob", to: "alice", wantErr: ErrUsernameTaken},
+				{user: "bob", to: "Alice", wantErr: ErrUsernameTaken},
+			},
+			want: map[string]resolved{"alice": {"alice", "alicia"}, "bob": {"bob", "bob"}},
+		},
+		{
+			name:    "current name of another user",
+			renames: []rename{{user: "bob", to: "ALICE", wantErr: ErrUsernameTaken}},
+			want:    map[string]resolved{"alice": {"alice", "alice"}, "bob": {"bob", "bob"}},
+		},
+		{
+			name: "taking back a former name drops it from history",
+			renames: []rename{
+				{user: "alice", to: "alicia"},
+				{user: "alice", to: "alice"},
+			},
+			want: map[string]resolved{
+				"alice":  {"alice", "alice"},
+				"alicia": {"alice", "alice"},
+			},
+		},
+		{
+			name: "several renames are all kept",
+			renames: []rename{
+				{user: "alice", to: "alicia"},
+				{user: "alice", to: "ally"},
+				{user: "bob", to: "alicia", wantErr: ErrUsernameTaken},
+			},
+			want: map[string]resolved{
+				"alice":  {"alice", "ally"},
+				"alicia": {"alice", "ally"},
+				"ally":   {"alice", "ally"},
+			},
+		},
+		{
+			name: "change of case is not history",
+			renames: []rename{
+				{user: "alice", to: "Alice"},
+				{user: "alice", to: "alicia"},
+				{user: "alice", to: "alice"},
+			},
+			want:      map[string]resolved{"alice": {"alice", "alice"}, "alicia": {"alice", "alice"}},
+			available: map[string]bool{"alicia": false},
+		},
+		{
+			name: "former names stay open to their owner",
+			renames: []rename{
+				{user: "alice", to: "alicia"},
+				{user: "bob", to: "robert"},
+				{user: "bob", to: "bob"},
+			},
+			want:      map[string]resolved{"bob": {"bob", "bob"}, "robert": {"bob", "bob"}, "nobody": {}},
+			available: map[string]bool{"alice": false, "robert": true},
+		},
+		{
+			name:    "unknown user",
+			renames: []rename{{user: "ghost", to: "casper", wantErr: ErrUserNotFound}},
+			want:    map[string]resolved{"casper": {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, repo Repository) {
+				c := context.Background()
+				ids := newUsernameUsers(t, repo)
+				names := map[int32]string{ids["alice"]: "alice", ids["bob"]: "bob"}
+
+				for i, step := range tt.renames {
+					user, err := repo.ChangeUsername(c, ids[step.user], step.to)
+					if !errors.Is(err, step.wantErr) {
+						t.Fatalf("rename %d of %s to %s: got error %v, want %v", i, step.user, step.to, err, step.wantErr)
+					}
+					if err == nil && user.Username != step.to {
+						t.Fatalf("rename %d returned username %q, want %q", i, user.Username, step.to)
+					}
+				}
+
+				for name, want := range tt.want {
+					id, current, err := repo.ResolveUsername(c, name)
+					if want.owner == "" {
+						if !errors.Is(err, ErrUserNotFound) {
+							t.Errorf("ResolveUsername(%q) = %d, %q, %v; want %v", name, id, current, err, ErrUserNotFound)
+						}
+						continue
+					}
+					if err != nil || names[id] != want.owner || current != want.current {
+						t.Errorf("ResolveUsername(%q) = %s, %q, %v; want %s, %q", name, names[id], current, err, want.owner, want.current)
+					}
+				}
+
+				for name, want := range tt.available {
+					if got, err := repo.UsernameAvailable(c, name, ids["bob"]); err != nil || got != want {
+						t.Errorf("UsernameAvailable(%q) for bob = %v, %v; want %v", name, got, err, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestChangeUsernameConcurrent(t *testing.T) {
+	const rounds = 10
+
+	forEachBackend(t, func(t *testing.T, repo Repository) {
+		c := context.Background()
+		ids := newUsernameUsers(t, repo)
+
+		for i := range rounds {
+			old, renamed := fmt.Sprintf("alice%d", i), fmt.Sprintf("renamed%d", i)
+			if _, err := repo.ChangeUsername(c, ids["alice"], old); err != nil {
+				t.Fatal(err)
+			}
+
+			// Alice moves away from old while bob tries to claim it. In
+			// either order bob must lose: first the name is alice's, then
+			// it is her history.
+			var wg sync.WaitGroup
+			var aliceErr, bobErr error
+			wg.Go(func() { _, aliceErr = repo.ChangeUsername(c, ids["alice"], renamed) })
+			wg.Go(func() { _, bobErr = repo.ChangeUsername(c, ids["bob"], old) })
+			wg.Wait()
+
+			if aliceErr != nil {
+				t.Fatalf("round %d: alice's rename failed: %v", i, aliceErr)
+			}
+			if !errors.Is(bobErr, ErrUsernameTaken) {
+				t.Fatalf("round %d: bob claimed alice's former name %q: error %v", i, old, bobErr)
+			}
+		}
+
+		// Two users claiming the same free name: exactly one gets it.
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, user := range []string{"alice", "bob"} {
+			wg.Go(func() { _, errs[i] = repo.ChangeUsername(c, ids[user], "contested") })
+		}
+		wg.Wait()
+		won := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrUsernameTaken):
+				t.Errorf("claim of a contested name failed with %v", err)
+			}
+		}
+		if won != 1 {
+			t.Errorf("%d users got the contested name, want exactly 1", won)
+		}
+	})
+}
@@ -1,4 +1,4 @@
-create table users (
+create table if not exists users (
     id serial primary key,
     full_name varchar(100),
     username varchar(50),
@@ -12,6 +12,6 @@ create table users (
     updated_at timestamp default  current_timestamp
 );
 
-create index idx_users_username on users(username);
-create unique index idx_users_email on users(email) where is_deleted = false;
-create unique index idx_users_phone_number on users(phone_number);
\ No newline at end of file
+create index if not exists idx_users_username on users(username);
+create unique index if not exists idx_users_email on users(email) where is_deleted = false;
+create unique index if not exists idx_users_phone_number on users(phone_number);
\ No newline at end of file
@@ -0,0 +1,14 @@
+create table refresh_tokens (
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    family_id varchar(64) not null,
+    token_hash varchar(64) not null,
+    expires_at timestamp not null,
+    used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp default current_timestamp
+);
+
+create unique index idx_refresh_tokens_token_hash on refresh_tokens(token_hash);
+create index idx_refresh_tokens_family_id on refresh_tokens(family_id);
+create index idx_refresh_tokens_user_id on refresh_tokens(user_id);
@@ -0,0 +1,8 @@
+create table revoked_tokens (
+    jti varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    expires_at timestamp not null,
+    revoked_at timestamp default current_timestamp
+);
+
+create index idx_revoked_tokens_expires_at on revoked_tokens(expires_at);
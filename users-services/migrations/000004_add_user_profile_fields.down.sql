@@ -0,0 +1,6 @@
+alter table users
+    drop column if exists bio,
+    drop column if exists avatar_url,
+    drop column if exists locale,
+    drop column if exists timezone,
+    drop column if exists date_of_birth;
@@ -0,0 +1,6 @@
+alter table users
+    add column bio varchar(500),
+    add column avatar_url varchar(500),
+    add column locale varchar(35),
+    add column timezone varchar(64),
+    add column date_of_birth date;
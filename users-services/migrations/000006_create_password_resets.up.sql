@@ -0,0 +1,11 @@
+create table password_resets (
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    token_hash varchar(64) not null,
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp default current_timestamp
+);
+
+create unique index idx_password_resets_token_hash on password_resets(token_hash);
+create index idx_password_resets_user_id on password_resets(user_id);
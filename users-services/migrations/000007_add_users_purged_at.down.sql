@@ -0,0 +1,5 @@
+drop index if exists idx_users_phone_number;
+create unique index idx_users_phone_number on users(phone_number);
+
+drop index if exists idx_users_deleted_at;
+alter table users drop column if exists purged_at;
@@ -0,0 +1,7 @@
+alter table users add column purged_at timestamp;
+
+create index idx_users_deleted_at on users(deleted_at) where is_deleted = true and purged_at is null;
+
+-- Like emails, phone numbers of deleted accounts can be registered again.
+drop index if exists idx_users_phone_number;
+create unique index idx_users_phone_number on users(phone_number) where is_deleted = false;
@@ -0,0 +1,5 @@
+drop index if exists idx_users_username_prefix;
+drop index if exists idx_users_email_prefix;
+drop index if exists idx_users_username_id;
+drop index if exists idx_users_email_id;
+drop index if exists idx_users_created_at_id;
@@ -0,0 +1,8 @@
+-- Keyset pagination of the admin user listing orders by (sort key, id).
+create index idx_users_created_at_id on users(created_at, id);
+create index idx_users_email_id on users(coalesce(email, ''), id);
+create index idx_users_username_id on users(coalesce(username, ''), id);
+
+-- Case-insensitive prefix search.
+create index idx_users_email_prefix on users(lower(email) text_pattern_ops);
+create index idx_users_username_prefix on users(lower(username) text_pattern_ops);
@@ -0,0 +1,4 @@
+drop table if exists username_history;
+
+drop index if exists idx_users_username_lower;
+create index idx_users_username on users(username);
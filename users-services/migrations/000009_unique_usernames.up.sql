@@ -0,0 +1,20 @@
+-- Usernames used to be derived from the email local part without any
+-- uniqueness check, so existing duplicates get the user id appended.
+update users u set username = u.username || '-' || u.id
+where exists (
+    select 1 from users o
+    where lower(o.username) = lower(u.username) and o.id < u.id
+);
+
+drop index if exists idx_users_username;
+create unique index idx_users_username_lower on users(lower(username));
+
+create table username_history (
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    username varchar(50) not null,
+    changed_at timestamp default current_timestamp
+);
+
+create unique index idx_username_history_username on username_history(lower(username));
+create index idx_username_history_user_id on username_history(user_id);
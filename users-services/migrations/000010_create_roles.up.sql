@@ -0,0 +1,41 @@
+create table roles (
+    id serial primary key,
+    name varchar(50) not null unique,
+    description text,
+    created_at timestamp default current_timestamp
+);
+
+create table permissions (
+    id serial primary key,
+    name varchar(100) not null unique,
+    description text
+);
+
+create table role_permissions (
+    role_id integer not null references roles(id) on delete cascade,
+    permission_id integer not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table user_roles (
+    user_id integer not null references users(id) on delete cascade,
+    role_id integer not null references roles(id) on delete cascade,
+    assigned_at timestamp default current_timestamp,
+    primary key (user_id, role_id)
+);
+
+create index idx_user_roles_role_id on user_roles(role_id);
+
+insert into roles (name, description) values
+    ('admin', 'Full access to every admin endpoint'),
+    ('support', 'Read-only access to accounts for the support team');
+
+insert into permissions (name, description) values
+    ('users:read', 'List and look up accounts'),
+    ('users:write', 'Restore and modify accounts'),
+    ('roles:manage', 'Assign and revoke roles');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where r.name = 'admin'
+   or (r.name = 'support' and p.name = 'users:read');
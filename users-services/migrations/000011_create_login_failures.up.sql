@@ -0,0 +1,9 @@
+create table login_failures (
+    -- account:<lowercased email> or ip:<client address>
+    key varchar(255) primary key,
+    failures integer not null default 0,
+    last_failed_at timestamp not null,
+    locked_until timestamp
+);
+
+create index idx_login_failures_last_failed_at on login_failures(last_failed_at);
@@ -0,0 +1,19 @@
+create table user_totp (
+    user_id integer primary key references users(id) on delete cascade,
+    secret varchar(64) not null,
+    -- null until the user proved their app works with a first code
+    confirmed_at timestamp,
+    -- last accepted time step, so codes cannot be replayed
+    last_used_step bigint not null default 0,
+    created_at timestamp default current_timestamp
+);
+
+create table recovery_codes (
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at timestamp,
+    created_at timestamp default current_timestamp
+);
+
+create index idx_recovery_codes_user_id on recovery_codes(user_id);
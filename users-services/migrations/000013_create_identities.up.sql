@@ -0,0 +1,13 @@
+create table identities (
+    id serial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    provider varchar(50) not null,
+    -- the provider's stable user id (the OIDC sub claim)
+    subject varchar(255) not null,
+    email varchar(200),
+    created_at timestamp default current_timestamp,
+    last_login_at timestamp
+);
+
+create unique index idx_identities_provider_subject on identities(provider, subject);
+create unique index idx_identities_user_provider on identities(user_id, provider);
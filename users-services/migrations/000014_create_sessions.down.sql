@@ -0,0 +1,2 @@
+alter table refresh_tokens drop constraint if exists fk_refresh_tokens_session;
+drop table if exists sessions;
@@ -0,0 +1,32 @@
+-- A session is one login on one device. Its id doubles as the family id of
+-- the refresh tokens it rotates through.
+create table sessions (
+    id varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    user_agent varchar(512),
+    ip_address varchar(64),
+    device_label varchar(100),
+    created_at timestamp not null default current_timestamp,
+    last_seen_at timestamp not null default current_timestamp,
+    expires_at timestamp not null,
+    revoked_at timestamp
+);
+
+create index idx_sessions_user_id on sessions(user_id);
+
+-- Existing refresh token families become sessions without client details.
+insert into sessions (id, user_id, created_at, last_seen_at, expires_at, revoked_at)
+select
+    family_id,
+    min(user_id),
+    min(created_at),
+    max(created_at),
+    max(expires_at),
+    case when bool_or(used_at is null and revoked_at is null) then null
+         else max(coalesce(revoked_at, used_at)) end
+from refresh_tokens
+group by family_id;
+
+alter table refresh_tokens
+    add constraint fk_refresh_tokens_session
+    foreign key (family_id) references sessions(id) on delete cascade;
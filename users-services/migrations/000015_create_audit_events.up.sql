@@ -0,0 +1,35 @@
+-- Security relevant events. Rows are never changed once written; actor and
+-- target are plain ids so the history outlives purged accounts.
+create table audit_events (
+    id bigserial primary key,
+    occurred_at timestamp not null default current_timestamp,
+    event_type varchar(64) not null,
+    actor_id integer,
+    target_id integer,
+    ip_address varchar(64),
+    user_agent varchar(512),
+    outcome varchar(16) not null,
+    request_id varchar(64),
+    details jsonb
+);
+
+create index idx_audit_events_target_id on audit_events(target_id, id);
+create index idx_audit_events_actor_id on audit_events(actor_id, id);
+create index idx_audit_events_type on audit_events(event_type, id);
+
+create function audit_events_append_only() returns trigger as $$
+begin
+    raise exception 'audit_events is append-only';
+end;
+$$ language plpgsql;
+
+create trigger audit_events_append_only
+    before update or delete on audit_events
+    for each row execute function audit_events_append_only();
+
+insert into permissions (name, description) values
+    ('audit:read', 'Read the security audit log');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where r.name in ('admin', 'support') and p.name = 'audit:read';
@@ -0,0 +1,17 @@
+-- Events waiting to be published to Kafka. Rows are written in the same
+-- transaction as the change they describe and marked once the broker has
+-- acknowledged them, so an event is never lost but may be sent twice.
+create table outbox_events (
+    id bigserial primary key,
+    event_id varchar(64) not null unique,
+    event_type varchar(64) not null,
+    user_id integer not null,
+    payload jsonb not null,
+    created_at timestamp not null default current_timestamp,
+    published_at timestamp,
+    attempts integer not null default 0,
+    last_error text
+);
+
+create index idx_outbox_events_unpublished on outbox_events(id) where published_at is null;
+create index idx_outbox_events_published_at on outbox_events(published_at) where published_at is not null;
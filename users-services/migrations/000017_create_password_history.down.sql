@@ -0,0 +1,2 @@
+drop table if exists password_history;
+alter table users drop column if exists password_changed_at;
@@ -0,0 +1,15 @@
+-- password_changed_at drives password expiry; password_history keeps the
+-- hashes of previous passwords so they cannot be chosen again.
+alter table users add column password_changed_at timestamp;
+
+update users set password_changed_at = coalesce(updated_at, created_at)
+where password is not null and password <> '';
+
+create table password_history (
+    id bigserial primary key,
+    user_id integer not null references users(id) on delete cascade,
+    password_hash text not null,
+    created_at timestamp not null default current_timestamp
+);
+
+create index idx_password_history_user_id on password_history(user_id, id);
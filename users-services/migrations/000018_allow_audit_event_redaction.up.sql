@@ -0,0 +1,28 @@
+-- Audit events stay append-only except for removing personal data: purging
+-- an account clears the client address and user agent of its events, and
+-- emails and usernames are dropped from details. Everything else, and
+-- deleting rows, is still rejected.
+create or replace function audit_events_append_only() returns trigger as $$
+begin
+    if tg_op = 'UPDATE'
+        and new.id = old.id
+        and new.occurred_at = old.occurred_at
+        and new.event_type = old.event_type
+        and new.actor_id is not distinct from old.actor_id
+        and new.target_id is not distinct from old.target_id
+        and new.outcome = old.outcome
+        and new.request_id is not distinct from old.request_id
+        and (new.ip_address is null or new.ip_address = old.ip_address)
+        and (new.user_agent is null or new.user_agent = old.user_agent)
+        and new.details is not distinct from old.details - array['email', 'username']
+    then
+        return new;
+    end if;
+    raise exception 'audit_events is append-only';
+end;
+$$ language plpgsql;
+
+-- Events used to carry the email typed at login, even for accounts that do
+-- not exist, and the chosen username.
+update audit_events set details = details - array['email', 'username']
+where details ?| array['email', 'username'];
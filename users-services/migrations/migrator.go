@@ -0,0 +1,287 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed *.sql sqlite/*.sql
+var files embed.FS
+
+// lockKey identifies the Postgres advisory lock held while migrating, so two
+// instances starting at the same time do not apply the same migration twice.
+const lockKey int64 = 724981353001
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	// advisoryLock is false for SQLite, which lets only one writer in at a
+	// time anyway.
+	advisoryLock bool
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, advisoryLock: true}, nil
+}
+
+// NewSQLiteMigrator migrates a database opened with internal.OpenSQLite.
+// SQLite has its own migrations in sqlite/, which follow the Postgres ones
+// schema-wise but not version by version.
+func NewSQLiteMigrator(db *sql.DB) (*Migrator, error) {
+	sqliteFiles, err := fs.Sub(files, "sqlite")
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite migrations: %v", err)
+	}
+	migrations, err := load(sqliteFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// load reads files named <version>_<name>.<up|down>.sql, sorted by version.
+func load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("could not list migrations: %v", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, file := range names {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>.up.sql or .down.sql", file)
+		}
+		rawVersion, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(rawVersion, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version %q", file, rawVersion)
+		}
+
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %v", file, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by both %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(c context.Context) error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+	return m.Goto(c, m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the last steps applied migrations.
+func (m *Migrator) Down(c context.Context, steps int) error {
+	return m.withLock(c, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(c, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; !ok {
+				continue
+			}
+			if err := m.apply(c, conn, m.migrations[i], false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Goto migrates up or down until version is the latest applied migration.
+// Version 0 rolls back everything.
+func (m *Migrator) Goto(c context.Context, version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+
+	return m.withLock(c, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(c, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				if err := m.apply(c, conn, mig, false); err != nil {
+					return err
+				}
+			}
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				if err := m.apply(c, conn, mig, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status lists every known migration with the time it was applied, if any.
+func (m *Migrator) Status(c context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(c, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(c, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			st := MigrationStatus{Migration: mig}
+			if at, ok := applied[mig.Version]; ok {
+				st.AppliedAt = &at
+			}
+			statuses = append(statuses, st)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock. Session level advisory locks belong to a connection, so everything
+// has to run on that same connection. SQLite goes without the lock.
+func (m *Migrator) withLock(c context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(c)
+	if err != nil {
+		return fmt.Errorf("could not get connection: %v", err)
+	}
+	defer conn.Close()
+
+	if m.advisoryLock {
+		if _, err := conn.ExecContext(c, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return fmt.Errorf("could not acquire migration lock: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+	}
+
+	if _, err := conn.ExecContext(c, `
+		create table if not exists schema_migrations (
+		    version bigint primary key,
+		    name varchar(200) not null,
+		    applied_at timestamp default current_timestamp
+		)
+	`); err != nil {
+		return fmt.Errorf("could not create schema_migrations: %v", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(c context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(c, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("could not scan schema_migrations: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// apply runs one migration and records it in schema_migrations inside a
+// single transaction, so a failing migration leaves no trace.
+func (m *Migrator) apply(c context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	body, direction := mig.Up, "up"
+	if !up {
+		body, direction = mig.Down, "down"
+		if body == "" {
+			return fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+		}
+	}
+
+	tx, err := conn.BeginTx(c, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(c, body); err != nil {
+		return fmt.Errorf("migration %d_%s %s failed: %v", mig.Version, mig.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(c, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name)
+	} else {
+		_, err = tx.ExecContext(c, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("could not record migration %d_%s: %v", mig.Version, mig.Name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit migration %d_%s: %v", mig.Version, mig.Name, err)
+	}
+	log.Printf("migrated %d_%s %s", mig.Version, mig.Name, direction)
+	return nil
+}
@@ -0,0 +1,17 @@
+drop table if exists outbox_events;
+drop table if exists audit_events;
+drop table if exists identities;
+drop table if exists recovery_codes;
+drop table if exists user_totp;
+drop table if exists login_failures;
+drop table if exists user_roles;
+drop table if exists role_permissions;
+drop table if exists permissions;
+drop table if exists roles;
+drop table if exists password_history;
+drop table if exists password_resets;
+drop table if exists revoked_tokens;
+drop table if exists refresh_tokens;
+drop table if exists sessions;
+drop table if exists username_history;
+drop table if exists users;
@@ -0,0 +1,228 @@
+-- The schema of Postgres migrations 1 to 17 in one go. Timestamps are
+-- stored as UTC text, which compares correctly as long as every value uses
+-- the same layout; the repository takes care of that for the values it
+-- writes and the column defaults below produce the same layout.
+create table users (
+    id integer primary key autoincrement,
+    full_name varchar(100),
+    username varchar(50),
+    email varchar(200) unique,
+    password text,
+    phone_number varchar(20),
+    is_active boolean,
+    is_deleted boolean default false,
+    deleted_at timestamp,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    updated_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    bio varchar(500),
+    avatar_url varchar(500),
+    locale varchar(35),
+    timezone varchar(64),
+    date_of_birth date,
+    tokens_valid_after timestamp,
+    purged_at timestamp,
+    password_changed_at timestamp
+);
+
+create unique index idx_users_email on users(email) where is_deleted = false;
+create unique index idx_users_phone_number on users(phone_number) where is_deleted = false;
+create unique index idx_users_username_lower on users(lower(username));
+create index idx_users_deleted_at on users(deleted_at) where is_deleted = true and purged_at is null;
+create index idx_users_created_at_id on users(created_at, id);
+create index idx_users_email_id on users(coalesce(email, ''), id);
+create index idx_users_username_id on users(coalesce(username, ''), id);
+
+create table username_history (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    username varchar(50) not null,
+    changed_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create unique index idx_username_history_username on username_history(lower(username));
+create index idx_username_history_user_id on username_history(user_id);
+
+create table sessions (
+    id varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    user_agent varchar(512),
+    ip_address varchar(64),
+    device_label varchar(100),
+    created_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    last_seen_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    expires_at timestamp not null,
+    revoked_at timestamp
+);
+
+create index idx_sessions_user_id on sessions(user_id);
+
+create table refresh_tokens (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    family_id varchar(64) not null references sessions(id) on delete cascade,
+    token_hash varchar(64) not null,
+    expires_at timestamp not null,
+    used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create unique index idx_refresh_tokens_token_hash on refresh_tokens(token_hash);
+create index idx_refresh_tokens_family_id on refresh_tokens(family_id);
+create index idx_refresh_tokens_user_id on refresh_tokens(user_id);
+
+create table revoked_tokens (
+    jti varchar(64) primary key,
+    user_id integer not null references users(id) on delete cascade,
+    expires_at timestamp not null,
+    revoked_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create index idx_revoked_tokens_expires_at on revoked_tokens(expires_at);
+
+create table password_resets (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    token_hash varchar(64) not null,
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create unique index idx_password_resets_token_hash on password_resets(token_hash);
+create index idx_password_resets_user_id on password_resets(user_id);
+
+create table password_history (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    password_hash text not null,
+    created_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create index idx_password_history_user_id on password_history(user_id, id);
+
+create table roles (
+    id integer primary key autoincrement,
+    name varchar(50) not null unique,
+    description text,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create table permissions (
+    id integer primary key autoincrement,
+    name varchar(100) not null unique,
+    description text
+);
+
+create table role_permissions (
+    role_id integer not null references roles(id) on delete cascade,
+    permission_id integer not null references permissions(id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table user_roles (
+    user_id integer not null references users(id) on delete cascade,
+    role_id integer not null references roles(id) on delete cascade,
+    assigned_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    primary key (user_id, role_id)
+);
+
+create index idx_user_roles_role_id on user_roles(role_id);
+
+insert into roles (name, description) values
+    ('admin', 'Full access to every admin endpoint'),
+    ('support', 'Read-only access to accounts for the support team');
+
+insert into permissions (name, description) values
+    ('users:read', 'List and look up accounts'),
+    ('users:write', 'Restore and modify accounts'),
+    ('roles:manage', 'Assign and revoke roles'),
+    ('audit:read', 'Read the security audit log');
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where r.name = 'admin'
+   or (r.name = 'support' and p.name in ('users:read', 'audit:read'));
+
+create table login_failures (
+    -- account:<lowercased email> or ip:<client address>
+    key varchar(255) primary key,
+    failures integer not null default 0,
+    last_failed_at timestamp not null,
+    locked_until timestamp
+);
+
+create index idx_login_failures_last_failed_at on login_failures(last_failed_at);
+
+create table user_totp (
+    user_id integer primary key references users(id) on delete cascade,
+    secret varchar(64) not null,
+    confirmed_at timestamp,
+    last_used_step bigint not null default 0,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create table recovery_codes (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at timestamp,
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000')
+);
+
+create index idx_recovery_codes_user_id on recovery_codes(user_id);
+
+create table identities (
+    id integer primary key autoincrement,
+    user_id integer not null references users(id) on delete cascade,
+    provider varchar(50) not null,
+    subject varchar(255) not null,
+    email varchar(200),
+    created_at timestamp default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    last_login_at timestamp
+);
+
+create unique index idx_identities_provider_subject on identities(provider, subject);
+create unique index idx_identities_user_provider on identities(user_id, provider);
+
+create table audit_events (
+    id integer primary key autoincrement,
+    occurred_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    event_type varchar(64) not null,
+    actor_id integer,
+    target_id integer,
+    ip_address varchar(64),
+    user_agent varchar(512),
+    outcome varchar(16) not null,
+    request_id varchar(64),
+    details text
+);
+
+create index idx_audit_events_target_id on audit_events(target_id, id);
+create index idx_audit_events_actor_id on audit_events(actor_id, id);
+create index idx_audit_events_type on audit_events(event_type, id);
+
+create trigger audit_events_no_update before update on audit_events
+begin
+    select raise(abort, 'audit_events is append-only');
+end;
+
+create trigger audit_events_no_delete before delete on audit_events
+begin
+    select raise(abort, 'audit_events is append-only');
+end;
+
+create table outbox_events (
+    id integer primary key autoincrement,
+    event_id varchar(64) not null unique,
+    event_type varchar(64) not null,
+    user_id integer not null,
+    payload text not null,
+    created_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now') || '000000'),
+    published_at timestamp,
+    attempts integer not null default 0,
+    last_error text
+);
+
+create index idx_outbox_events_unpublished on outbox_events(id) where published_at is null;
+create index idx_outbox_events_published_at on outbox_events(published_at) where published_at is not null;
@@ -0,0 +1,6 @@
+drop trigger audit_events_no_update;
+
+create trigger audit_events_no_update before update on audit_events
+begin
+    select raise(abort, 'audit_events is append-only');
+end;
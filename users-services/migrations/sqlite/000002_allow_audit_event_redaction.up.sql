@@ -0,0 +1,24 @@
+-- Audit events stay append-only except for removing personal data: purging
+-- an account clears the client address and user agent of its events, and
+-- emails and usernames are dropped from details.
+drop trigger audit_events_no_update;
+
+create trigger audit_events_no_update before update on audit_events
+when not (
+    new.id = old.id
+    and new.occurred_at = old.occurred_at
+    and new.event_type = old.event_type
+    and new.actor_id is old.actor_id
+    and new.target_id is old.target_id
+    and new.outcome = old.outcome
+    and new.request_id is old.request_id
+    and (new.ip_address is null or new.ip_address = old.ip_address)
+    and (new.user_agent is null or new.user_agent = old.user_agent)
+    and new.details is json_remove(old.details, '$.email', '$.username')
+)
+begin
+    select raise(abort, 'audit_events is append-only');
+end;
+
+update audit_events set details = json_remove(details, '$.email', '$.username')
+where json_extract(details, '$.email') is not null or json_extract(details, '$.username') is not null;